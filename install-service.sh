@@ -35,7 +35,8 @@ if [ ! -f "go.mod" ]; then
     go mod init redis-proxy
 fi
 
-go build -o redis-proxy main.go
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+go build -ldflags "-X main.version=$VERSION" -o redis-proxy main.go
 
 if [ $? -ne 0 ]; then
     echo -e "${RED}Failed to build Redis proxy${NC}"
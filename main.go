@@ -3,27 +3,140 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/syslog"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
+// version is the proxy build, set at compile time with
+// -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
 // RedisProxy represents a Redis proxy with automatic prefix functionality
 type RedisProxy struct {
-	proxyAddr     string
-	targetAddr    string
-	prefixes      map[net.Conn]string
-	prefixMux     sync.RWMutex
-	defaultPrefix string
-	lastCommand   map[net.Conn]string // Track last command per connection
-	lastCmdMux    sync.RWMutex        // Mutex for lastCommand
+	proxyAddr      string
+	targetAddr     string
+	targetAddrs    string                  // Weighted backends to balance across, e.g. "10.0.0.1:6379=2,10.0.0.2:6379"
+	targets        *targetPool             // Backends built from targetAddrs, nil to always use targetAddr
+	listenAddr     net.Addr                // Address the client listener is bound to
+	conns          map[net.Conn]*connState // Per-connection state keyed by client connection
+	connMux        sync.RWMutex            // Mutex for conns and the states it holds
+	defaultPrefix  string
+	prefixTemplate string            // Template for AUTH-derived prefixes, e.g. "tenant:{user}:"
+	autoTemplate   string            // Template for prefixes generated without a default prefix, e.g. "anon:{ip}:"
+	breaker        *circuitBreaker   // Stops dialing the backend after repeated failures
+	adminSocket    string            // Path of the admin control socket, empty to disable
+	tlsCertFile    string            // Server certificate for TLS clients, empty for plain TCP
+	tlsKeyFile     string            // Private key for tlsCertFile
+	tlsClientCA    string            // CA bundle used to verify client certificates
+	prefixFromCert bool              // Derive the prefix from the client certificate instead of AUTH
+	shardMapFile   string            // JSON file mapping prefixes to backend addresses
+	shardMap       map[string]string // Backend address per prefix, loaded from shardMapFile
+	ttlMapFile     string            // JSON file mapping prefixes to a default SET TTL in seconds
+	defaultTTLs    map[string]int    // Default SET TTL in seconds per prefix, loaded from ttlMapFile
+	configMux      sync.RWMutex      // Mutex for configuration swapped in by reloadConfig
+	metricsAddr    string            // Address of the Prometheus metrics endpoint, empty to disable
+	latency        *latencyHistogram // Backend round-trip time of non-blocking commands
+	commandTimeout time.Duration     // Longest wait for a non-blocking command's reply, 0 to disable
+	dialTimeout    time.Duration     // Longest wait for a backend connection to be established
+	allowTopology  bool              // Forward CLUSTER subcommands that reveal the backend topology
+	captureFile    string            // File client commands are captured to for replay, empty to disable
+	capture        *captureLog       // Open capture file, nil when capturing is off
+	keyCounts      *keyCountCache    // Per-prefix key counts, nil unless REDIS_KEY_COUNTS is set
+	selectMode     string            // How SELECT is handled: selectPassThrough, selectScope or selectReject
+	passwordAuth   string            // How a password-only AUTH is handled: passwordAuthReject, passwordAuthDefault or passwordAuthPrefix
+	maxArgs        int               // Most arguments accepted in a client command, 0 for no limit
+	maxInflight    int               // Most commands awaiting a reply per connection, 0 for no limit
+	maxLineLength  int               // Longest RESP line read from either side, 0 for no limit
+	requireRESP    bool              // Reject client commands that aren't RESP arrays, such as inline commands
+	requireAuth    bool              // Answer NOAUTH to commands sent before an accepted AUTH
+	tenantMaxConns int               // Most simultaneous connections per prefix, 0 for no limit
+	compressMin    int               // Smallest string value gzipped before it's stored, 0 to disable
+	typeCacheTTL   time.Duration     // How long a connection reuses TYPE and OBJECT ENCODING replies, 0 to disable
+	tenantConns    map[string]int    // Open connections per prefix, guarded by connMux
+	drained        *sync.Cond        // Signalled on connMux whenever pending commands complete
+	allowCommands  map[string]bool   // Only commands permitted when set (REDIS_COMMAND_WHITELIST), nil to allow all
+	tenantFlush    bool              // Answer FLUSHDB/FLUSHALL by unlinking only the tenant's keys
+	blockedMessage string            // Error sent for blocked commands, starting with its error code
+	defaultKeyed   *commandCounter   // Commands prefixed by the default single-key handling
+	scanKeys       scanFilterStats   // Keys in all SCAN replies before and after filtering
+	unknownPolicy  string            // How commands in no command table are handled: unknownForward, unknownReject or unknownLog
+	unknownSeen    *commandCounter   // Commands in no command table, counted under unknownLog
+	denied         *deniedCounter    // Commands denied by policy per prefix and reason
+	globalSentinel string            // Key marker that skips prefixing for the rest of the key, empty to disable
+	adminTenants   map[string]bool   // Prefixes allowed to run adminOnlyCommands
+	logLevel       string            // logLevelDebug, logLevelInfo or logLevelSilent
+	logger         *log.Logger       // Where logf writes, stderr unless REDIS_LOG_TARGET names another target
+
+	// PrefixResolver, when set, decides the prefix for AUTH credentials in place
+	// of the username or password derivation. An error rejects the AUTH.
+	PrefixResolver func(username, password string, remote net.Addr) (string, error)
+
+	// KeyRewriter, when set, returns the key sent to the backend for each key
+	// argument of a command in place of the connection's prefix plus the key.
+	// Replies are still unprefixed by the connection's prefix. Pub/sub channels
+	// always get the plain prefix, since pushed messages are unprefixed by it.
+	KeyRewriter func(command, key string) string
+}
+
+// connState holds everything the proxy tracks for a single client connection
+type connState struct {
+	prefix        string
+	prefixBound   bool             // Prefix comes from the client certificate and AUTH can't change it
+	seq           uint64           // Sequence number of the last command read from the client
+	pending       []pendingCommand // Forwarded commands awaiting a reply, oldest first
+	writeMu       sync.Mutex       // Serializes writes to the client connection
+	subscriptions int64            // Channels and patterns subscribed to, as last confirmed by the server
+	channels      int64            // Channels among subscriptions
+	patterns      int64            // Patterns among subscriptions
+	db            int              // Logical database chosen with SELECT
+	counted       bool             // Counted in tenantConns under prefix
+	auth          []byte           // Last AUTH command forwarded, replayed on side connections
+	authenticated bool             // The backend answered +OK to an AUTH
+	resp3         bool             // The backend accepted HELLO 3, so replies may use RESP3 types
+	scanKeys      scanFilterStats  // Keys in this connection's SCAN replies before and after filtering
+	multi         bool             // Inside MULTI, where the server queues commands instead of answering them
+	keyTypes      typeCache        // Reusable TYPE and OBJECT ENCODING replies by typeCacheKey
+}
+
+// pendingCommand is a forwarded command whose reply has not been seen yet
+type pendingCommand struct {
+	seq      uint64
+	command  string
+	replies  int          // Replies still expected, e.g. one per channel for SUBSCRIBE; 0 until known for unsubscribe-all
+	blocking bool         // The command may wait on the server, see isBlockingCommand
+	cacheKey string       // Type cache entry this command's reply fills, empty when it isn't cached
+	setNX    bool         // SET ... NX, whose +OK proves a key was created
+	db       int          // Database a forwarded SELECT moves to once the backend accepts it
+	auth     *pendingAuth // What a forwarded AUTH applies once the backend accepts it
+	after    []byte       // Proxy replies to send right after this command's last reply
+	sent     time.Time    // When the command was read from the client, for latency tracking
+}
+
+// pendingAuth is an AUTH awaiting the backend's reply. Its prefix, if any, is
+// only claimed once the backend accepts the credentials.
+type pendingAuth struct {
+	command []byte // The AUTH command, replayed by key scans and flushes
+	prefix  string // Prefix the credentials name, empty to keep the current one
+	source  string // How the prefix was derived, for the log
 }
 
 // NewRedisProxy creates a new Redis proxy instance
@@ -33,40 +146,158 @@ func NewRedisProxy(proxyAddr, targetAddr string) *RedisProxy {
 		defaultPrefix += ":"
 	}
 
-	return &RedisProxy{
-		proxyAddr:     proxyAddr,
-		targetAddr:    targetAddr,
-		prefixes:      make(map[net.Conn]string),
-		defaultPrefix: defaultPrefix,
-		lastCommand:   make(map[net.Conn]string),
+	p := &RedisProxy{
+		proxyAddr:      proxyAddr,
+		targetAddr:     targetAddr,
+		targetAddrs:    getEnv("REDIS_TARGET_ADDRS", ""),
+		conns:          make(map[net.Conn]*connState),
+		defaultPrefix:  defaultPrefix,
+		prefixTemplate: getEnv("REDIS_PREFIX_TEMPLATE", ""),
+		autoTemplate:   getEnv("REDIS_AUTO_PREFIX_TEMPLATE", "default:{addr}:"),
+		adminSocket:    getEnv("REDIS_ADMIN_SOCKET", ""),
+		tlsCertFile:    getEnv("REDIS_TLS_CERT", ""),
+		tlsKeyFile:     getEnv("REDIS_TLS_KEY", ""),
+		tlsClientCA:    getEnv("REDIS_TLS_CLIENT_CA", ""),
+		prefixFromCert: getEnvBool("REDIS_PREFIX_FROM_CERT", false),
+		shardMapFile:   getEnv("REDIS_SHARD_MAP", ""),
+		ttlMapFile:     getEnv("REDIS_TTL_MAP", ""),
+		metricsAddr:    getEnv("REDIS_METRICS_ADDR", ""),
+		latency:        newLatencyHistogram(latencyBuckets),
+		defaultKeyed:   newCommandCounter(),
+		unknownPolicy:  getEnv("REDIS_UNKNOWN_COMMAND", unknownForward),
+		unknownSeen:    newCommandCounter(),
+		denied:         newDeniedCounter(getEnvInt("REDIS_DENIED_MAX_PREFIXES", 1000)),
+		globalSentinel: getEnv("REDIS_GLOBAL_SENTINEL", ""),
+		adminTenants:   parsePrefixList(getEnv("REDIS_ADMIN_TENANTS", "")),
+		logLevel:       getEnv("REDIS_LOG_LEVEL", logLevelDebug),
+		logger:         log.New(os.Stderr, "", log.LstdFlags),
+		commandTimeout: getEnvDuration("REDIS_COMMAND_TIMEOUT", 0),
+		dialTimeout:    getEnvDuration("REDIS_DIAL_TIMEOUT", 5*time.Second),
+		allowTopology:  getEnvBool("REDIS_ALLOW_CLUSTER_TOPOLOGY", false),
+		captureFile:    getEnv("REDIS_CAPTURE_FILE", ""),
+		selectMode:     getEnv("REDIS_SELECT_MODE", selectPassThrough),
+		passwordAuth:   getEnv("REDIS_PASSWORD_AUTH", passwordAuthReject),
+		maxArgs:        getEnvInt("REDIS_MAX_ARGS", 1024*1024),
+		maxInflight:    getEnvInt("REDIS_MAX_INFLIGHT", 0),
+		maxLineLength:  getEnvInt("REDIS_MAX_LINE_LENGTH", 64*1024),
+		requireRESP:    getEnvBool("REDIS_REQUIRE_RESP", false),
+		requireAuth:    getEnvBool("REDIS_REQUIRE_AUTH", false),
+		tenantMaxConns: getEnvInt("REDIS_TENANT_MAX_CONNS", 0),
+		compressMin:    getEnvInt("REDIS_COMPRESS_THRESHOLD", 0),
+		typeCacheTTL:   getEnvDuration("REDIS_TYPE_CACHE_TTL", 0),
+		tenantConns:    make(map[string]int),
+		allowCommands:  parseCommandList(getEnv("REDIS_COMMAND_WHITELIST", "")),
+		tenantFlush:    getEnvBool("REDIS_ALLOW_TENANT_FLUSH", false),
+		blockedMessage: getEnv("REDIS_BLOCKED_MESSAGE", "ERR Command not allowed"),
+	}
+	p.drained = sync.NewCond(&p.connMux)
+	p.breaker = newCircuitBreaker(
+		getEnvInt("REDIS_BREAKER_THRESHOLD", 5),
+		getEnvDuration("REDIS_BREAKER_COOLDOWN", 10*time.Second),
+		p.logf,
+	)
+	if getEnvBool("REDIS_KEY_COUNTS", false) {
+		p.keyCounts = newKeyCountCache(getEnvInt("REDIS_KEY_COUNTS_MAX_PREFIXES", 1000))
 	}
+	return p
 }
 
-// Start begins listening for connections and proxying them
+// Start begins listening for connections and proxying them until SIGINT or SIGTERM
 func (p *RedisProxy) Start() error {
-	listener, err := net.Listen("tcp", p.proxyAddr)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			cancel(fmt.Errorf("received signal %s", sig))
+		case <-ctx.Done():
+		}
+	}()
+	return p.StartContext(ctx)
+}
+
+// StartContext proxies connections until ctx is cancelled. It returns nil when
+// the shutdown was requested through ctx, and an error when the proxy fails to
+// start or stops accepting connections on its own.
+func (p *RedisProxy) StartContext(ctx context.Context) error {
+	if err := p.validateConfig(); err != nil {
+		return err
+	}
+
+	if p.targetAddrs != "" {
+		targets, _ := parseTargets(p.targetAddrs)
+		p.targets = newTargetPool(targets)
+	}
+
+	if err := p.reloadConfig(); err != nil {
+		return fmt.Errorf("failed to load config files: %v", err)
+	}
+
+	if p.captureFile != "" {
+		capture, err := openCaptureLog(p.captureFile, p.logf)
+		if err != nil {
+			return fmt.Errorf("failed to open capture file: %v", err)
+		}
+		defer capture.Close()
+		p.capture = capture
+		p.logf("Capturing client commands to %s", p.captureFile)
+	}
+
+	listener, err := p.listen()
 	if err != nil {
-		return fmt.Errorf("failed to listen: %v", err)
+		return err
 	}
 	defer listener.Close()
+	p.listenAddr = listener.Addr()
+
+	// The admin socket is auxiliary: serve Redis traffic even without it
+	if p.adminSocket != "" {
+		if adminListener, err := p.startAdminSocket(); err != nil {
+			p.logf("Warning: admin socket disabled, failed to listen on %s: %v", p.adminSocket, err)
+		} else {
+			defer adminListener.Close()
+		}
+	}
 
-	log.Printf("Redis proxy listening on %s, forwarding to %s",
-		p.proxyAddr, p.targetAddr)
+	if p.metricsAddr != "" {
+		metricsListener, err := p.startMetricsServer()
+		if err != nil {
+			return fmt.Errorf("failed to start metrics endpoint: %v", err)
+		}
+		defer metricsListener.Close()
+	}
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	target := p.targetAddr
+	if p.targets != nil {
+		target = p.targetAddrs
+	}
+	p.logf("Redis proxy listening on %s, forwarding to %s",
+		p.proxyAddr, target)
 
+	stopped := make(chan struct{})
+	defer close(stopped)
 	go func() {
-		<-sigChan
-		log.Println("Shutting down Redis proxy...")
-		listener.Close()
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
 	}()
 
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if ctx.Err() != nil {
+				p.logf("Shutting down Redis proxy: %v", context.Cause(ctx))
+				return nil
+			}
+			p.logf("Failed to accept connection: %v", err)
 			return err
 		}
 
@@ -74,344 +305,3349 @@ func (p *RedisProxy) Start() error {
 	}
 }
 
-// handleConnection processes a single client connection
-func (p *RedisProxy) handleConnection(clientConn net.Conn) {
-	defer func() {
-		clientConn.Close()
-		// Clean up prefix for this connection
-		p.prefixMux.Lock()
-		delete(p.prefixes, clientConn)
-		p.prefixMux.Unlock()
-	}()
+// listen opens the client listener, wrapping it in TLS when a certificate is configured
+func (p *RedisProxy) listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", p.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	if p.tlsCertFile == "" {
+		return listener, nil
+	}
 
-	// Connect to the actual Redis server
-	serverConn, err := net.Dial("tcp", p.targetAddr)
+	tlsConfig, err := p.loadTLSConfig()
 	if err != nil {
-		log.Printf("Failed to connect to Redis server: %v", err)
-		return
+		listener.Close()
+		return nil, fmt.Errorf("failed to load TLS config: %v", err)
 	}
-	defer serverConn.Close()
+	return tls.NewListener(listener, tlsConfig), nil
+}
 
-	log.Printf("New connection from %s", clientConn.RemoteAddr())
+// loadTLSConfig builds the server TLS config, requiring client certificates
+// signed by tlsClientCA when one is configured
+func (p *RedisProxy) loadTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(p.tlsCertFile, p.tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
 
-	// Set a default prefix for this connection if none is set via AUTH
-	// This ensures all operations get prefixed even without explicit AUTH
-	p.prefixMux.Lock()
-	if _, exists := p.prefixes[clientConn]; !exists {
-		if p.defaultPrefix != "" {
-			p.prefixes[clientConn] = p.defaultPrefix
-			log.Printf("Set configured default prefix '%s' for connection %s", p.defaultPrefix, clientConn.RemoteAddr())
-		} else {
-			defaultPrefix := "default:" + clientConn.RemoteAddr().String() + ":"
-			p.prefixes[clientConn] = defaultPrefix
-			log.Printf("Set auto-generated default prefix '%s' for connection %s", defaultPrefix, clientConn.RemoteAddr())
+	if p.tlsClientCA != "" {
+		caPEM, err := os.ReadFile(p.tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", p.tlsClientCA)
 		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	p.prefixMux.Unlock()
+	return config, nil
+}
 
-	// Create bidirectional proxy with prefix modification
-	done := make(chan bool, 2)
+// certPrefix derives a prefix from a verified client certificate's Common Name,
+// falling back to its first DNS SAN
+func certPrefix(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return ""
+	}
+	return name + ":"
+}
 
-	// Client to server (with prefix modification)
-	go func() {
-		p.forwardWithPrefix(clientConn, serverConn, true)
-		done <- true
-	}()
+// startAdminSocket listens on the admin unix socket and serves operator commands
+func (p *RedisProxy) startAdminSocket() (net.Listener, error) {
+	listener, err := net.Listen("unix", p.adminSocket)
+	if err != nil {
+		return nil, err
+	}
+	p.logf("Admin socket listening on %s", p.adminSocket)
 
-	// Server to client (pass through)
 	go func() {
-		p.forwardWithPrefix(serverConn, clientConn, false)
-		done <- true
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleAdminConn(conn)
+		}
 	}()
-
-	// Wait for either direction to close
-	<-done
-	log.Printf("Connection closed for %s", clientConn.RemoteAddr())
+	return listener, nil
 }
 
-// forwardWithPrefix forwards data between connections, adding prefix to Redis commands
-func (p *RedisProxy) forwardWithPrefix(src, dst net.Conn, isClientToServer bool) {
-	reader := bufio.NewReader(src)
-	direction := "client->server"
-	if !isClientToServer {
-		direction = "server->client"
+// handleAdminConn answers newline-separated admin commands, one reply line per command
+func (p *RedisProxy) handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if _, err := conn.Write([]byte(p.adminCommand(line) + "\n")); err != nil {
+			return
+		}
 	}
+}
 
-	for {
-		// Read RESP (Redis Serialization Protocol) data
-		data, err := p.readRESP(reader)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Read error (%s): %v", direction, err)
+// adminCommand executes a single admin socket command and returns its reply
+func (p *RedisProxy) adminCommand(line string) string {
+	fields := strings.Fields(line)
+	switch strings.ToLower(fields[0]) {
+	case "breaker":
+		return p.breaker.String()
+	case "latency":
+		return p.latency.String()
+	case "keycount":
+		if p.keyCounts == nil {
+			return "ERR key counts are disabled, set REDIS_KEY_COUNTS"
+		}
+		if len(fields) > 1 {
+			count, ok := p.keyCounts.get(fields[1])
+			if !ok {
+				return fmt.Sprintf("ERR no key count for prefix '%s'", fields[1])
 			}
-			return
+			return strconv.FormatInt(count, 10)
+		}
+		return p.keyCounts.String()
+	case "kill":
+		if len(fields) != 2 {
+			return "ERR usage: kill <remoteaddr>"
+		}
+		killed := p.killConns(func(conn net.Conn, state *connState) bool {
+			return conn.RemoteAddr().String() == fields[1]
+		})
+		if killed == 0 {
+			return fmt.Sprintf("ERR no connection from %s", fields[1])
+		}
+		return fmt.Sprintf("killed=%d", killed)
+	case "kill-prefix":
+		if len(fields) != 2 {
+			return "ERR usage: kill-prefix <prefix>"
+		}
+		prefix := fields[1]
+		if !strings.HasSuffix(prefix, ":") {
+			prefix += ":"
+		}
+		killed := p.killConns(func(conn net.Conn, state *connState) bool {
+			return state.prefix == prefix
+		})
+		return fmt.Sprintf("killed=%d", killed)
+	case "default-keyed":
+		return p.defaultKeyed.String()
+	case "unknown-commands":
+		return p.unknownSeen.String()
+	case "scan-filter":
+		remoteAddr := ""
+		if len(fields) > 1 {
+			remoteAddr = fields[1]
+		}
+		summary, ok := p.scanFilterSummary(remoteAddr)
+		if !ok {
+			return fmt.Sprintf("ERR no connection from %s", remoteAddr)
+		}
+		return summary
+	case "config":
+		raw, err := json.Marshal(p.effectiveConfig())
+		if err != nil {
+			return fmt.Sprintf("ERR %v", err)
+		}
+		return string(raw)
+	case "reload":
+		if err := p.reloadConfig(); err != nil {
+			return fmt.Sprintf("ERR %v", err)
 		}
+		return "OK"
+	default:
+		return fmt.Sprintf("ERR unknown admin command '%s'", fields[0])
+	}
+}
 
-		// Log the data being processed (for debugging)
-		if len(data) > 0 {
-			logLen := len(data)
-			if logLen > 50 {
-				logLen = 50
-			}
-			log.Printf("Processing %s data: %q", direction, data[:logLen])
+// configSnapshot is the configuration the running proxy resolved from the
+// environment and config files, as reported by the admin "config" command
+type configSnapshot struct {
+	Version          string            `json:"version"`
+	ProxyAddr        string            `json:"proxy_addr"`
+	TargetAddr       string            `json:"target_addr"`
+	TargetAddrs      string            `json:"target_addrs,omitempty"`
+	DefaultPrefix    string            `json:"default_prefix"`
+	PrefixTemplate   string            `json:"prefix_template,omitempty"`
+	AutoTemplate     string            `json:"auto_prefix_template"`
+	AdminSocket      string            `json:"admin_socket,omitempty"`
+	TLSCert          string            `json:"tls_cert,omitempty"`
+	TLSKey           string            `json:"tls_key,omitempty"`
+	TLSClientCA      string            `json:"tls_client_ca,omitempty"`
+	PrefixFromCert   bool              `json:"prefix_from_cert"`
+	ShardMapFile     string            `json:"shard_map_file,omitempty"`
+	ShardMap         map[string]string `json:"shard_map,omitempty"`
+	TTLMapFile       string            `json:"ttl_map_file,omitempty"`
+	DefaultTTLs      map[string]int    `json:"default_ttls,omitempty"`
+	MetricsAddr      string            `json:"metrics_addr,omitempty"`
+	CommandTimeout   string            `json:"command_timeout"`
+	AllowTopology    bool              `json:"allow_cluster_topology"`
+	CaptureFile      string            `json:"capture_file,omitempty"`
+	KeyCounts        bool              `json:"key_counts"`
+	KeyCountPrefixes int               `json:"key_count_max_prefixes,omitempty"`
+	DeniedPrefixes   int               `json:"denied_max_prefixes"`
+	SelectMode       string            `json:"select_mode"`
+	PasswordAuth     string            `json:"password_auth"`
+	UnknownCommand   string            `json:"unknown_command"`
+	LogLevel         string            `json:"log_level"`
+	GlobalSentinel   string            `json:"global_sentinel,omitempty"`
+	AdminTenants     []string          `json:"admin_tenants,omitempty"`
+	MaxArgs          int               `json:"max_args"`
+	MaxInflight      int               `json:"max_inflight"`
+	MaxLineLength    int               `json:"max_line_length"`
+	RequireRESP      bool              `json:"require_resp"`
+	RequireAuth      bool              `json:"require_auth"`
+	TenantMaxConns   int               `json:"tenant_max_conns"`
+	CompressMin      int               `json:"compress_min"`
+	TypeCacheTTL     string            `json:"type_cache_ttl"`
+	CommandWhitelist []string          `json:"command_whitelist,omitempty"`
+	AllowTenantFlush bool              `json:"allow_tenant_flush"`
+	BlockedMessage   string            `json:"blocked_message"`
+	PrefixResolver   bool              `json:"prefix_resolver"`
+	KeyRewriter      bool              `json:"key_rewriter"`
+	BreakerThreshold int               `json:"breaker_threshold"`
+	BreakerCooldown  string            `json:"breaker_cooldown"`
+	DialTimeout      string            `json:"dial_timeout"`
+}
+
+// effectiveConfig snapshots the running configuration. Only file paths are
+// reported for TLS material, never the contents of certificates or keys.
+func (p *RedisProxy) effectiveConfig() configSnapshot {
+	var whitelist []string
+	for command := range p.allowCommands {
+		whitelist = append(whitelist, command)
+	}
+	sort.Strings(whitelist)
+	var adminTenants []string
+	for prefix := range p.adminTenants {
+		adminTenants = append(adminTenants, prefix)
+	}
+	sort.Strings(adminTenants)
+	keyCountPrefixes := 0
+	if p.keyCounts != nil {
+		keyCountPrefixes = p.keyCounts.lru.maxPrefixes
+	}
+
+	p.configMux.RLock()
+	defer p.configMux.RUnlock()
+	return configSnapshot{
+		Version:          version,
+		ProxyAddr:        p.proxyAddr,
+		TargetAddr:       p.targetAddr,
+		TargetAddrs:      p.targetAddrs,
+		DefaultPrefix:    p.defaultPrefix,
+		PrefixTemplate:   p.prefixTemplate,
+		AutoTemplate:     p.autoTemplate,
+		AdminSocket:      p.adminSocket,
+		TLSCert:          p.tlsCertFile,
+		TLSKey:           p.tlsKeyFile,
+		TLSClientCA:      p.tlsClientCA,
+		PrefixFromCert:   p.prefixFromCert,
+		ShardMapFile:     p.shardMapFile,
+		ShardMap:         p.shardMap,
+		TTLMapFile:       p.ttlMapFile,
+		DefaultTTLs:      p.defaultTTLs,
+		MetricsAddr:      p.metricsAddr,
+		CommandTimeout:   p.commandTimeout.String(),
+		AllowTopology:    p.allowTopology,
+		CaptureFile:      p.captureFile,
+		KeyCounts:        p.keyCounts != nil,
+		KeyCountPrefixes: keyCountPrefixes,
+		DeniedPrefixes:   p.denied.lru.maxPrefixes,
+		SelectMode:       p.selectMode,
+		PasswordAuth:     p.passwordAuth,
+		UnknownCommand:   p.unknownPolicy,
+		LogLevel:         p.logLevel,
+		GlobalSentinel:   p.globalSentinel,
+		AdminTenants:     adminTenants,
+		MaxArgs:          p.maxArgs,
+		MaxInflight:      p.maxInflight,
+		MaxLineLength:    p.maxLineLength,
+		RequireRESP:      p.requireRESP,
+		RequireAuth:      p.requireAuth,
+		TenantMaxConns:   p.tenantMaxConns,
+		CompressMin:      p.compressMin,
+		TypeCacheTTL:     p.typeCacheTTL.String(),
+		CommandWhitelist: whitelist,
+		AllowTenantFlush: p.tenantFlush,
+		BlockedMessage:   p.blockedMessage,
+		PrefixResolver:   p.PrefixResolver != nil,
+		KeyRewriter:      p.KeyRewriter != nil,
+		BreakerThreshold: p.breaker.threshold,
+		BreakerCooldown:  p.breaker.cooldown.String(),
+		DialTimeout:      p.dialTimeout.String(),
+	}
+}
+
+// startMetricsServer serves Prometheus metrics over HTTP on metricsAddr
+func (p *RedisProxy) startMetricsServer() (net.Listener, error) {
+	listener, err := net.Listen("tcp", p.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	p.logf("Metrics endpoint listening on %s", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.writeMetrics(w)
+	})
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+// writeMetrics writes all proxy metrics in the Prometheus text format
+func (p *RedisProxy) writeMetrics(w io.Writer) {
+	p.latency.writePrometheus(w, "redis_proxy_backend_latency_seconds",
+		"Backend round-trip time of non-blocking commands.")
+	p.connMux.RLock()
+	scanKeys := p.scanKeys
+	p.connMux.RUnlock()
+	fmt.Fprintf(w, "# HELP redis_proxy_scan_keys_returned_total Keys in SCAN replies from the backend.\n")
+	fmt.Fprintf(w, "# TYPE redis_proxy_scan_keys_returned_total counter\nredis_proxy_scan_keys_returned_total %d\n", scanKeys.returned)
+	fmt.Fprintf(w, "# HELP redis_proxy_scan_keys_kept_total Keys in SCAN replies that belonged to the tenant.\n")
+	fmt.Fprintf(w, "# TYPE redis_proxy_scan_keys_kept_total counter\nredis_proxy_scan_keys_kept_total %d\n", scanKeys.kept)
+	if p.keyCounts != nil {
+		p.keyCounts.writePrometheus(w, "redis_proxy_tenant_keys",
+			"Approximate key count per tenant prefix.")
+	}
+	p.denied.writePrometheus(w, "redis_proxy_denied_commands_total",
+		"Commands the proxy refused by policy, per tenant prefix and reason.")
+}
+
+// killConns closes every client connection match selects and returns how many
+// were closed. Each connection then goes through its normal cleanup.
+func (p *RedisProxy) killConns(match func(conn net.Conn, state *connState) bool) int {
+	var victims []net.Conn
+	p.connMux.RLock()
+	for conn, state := range p.conns {
+		if match(conn, state) {
+			victims = append(victims, conn)
 		}
+	}
+	p.connMux.RUnlock()
 
-		if isClientToServer {
-			data = p.processClientCommand(src, data)
-		} else {
-			// Server->client: check if last command was SCAN
-			p.lastCmdMux.RLock()
-			lastCmd := p.lastCommand[dst]
-			p.lastCmdMux.RUnlock()
-			if lastCmd == "SCAN" {
-				// Filter SCAN response
-				p.prefixMux.RLock()
-				prefix := p.prefixes[dst]
-				p.prefixMux.RUnlock()
-				data = p.filterScanResponse(data, prefix)
+	for _, conn := range victims {
+		p.logf("Killing connection %s on admin request", conn.RemoteAddr())
+		conn.Close()
+	}
+	return len(victims)
+}
+
+// validateConfig checks the proxy configuration before any connection is accepted
+func (p *RedisProxy) validateConfig() error {
+	if err := validateAddr(p.proxyAddr); err != nil {
+		return fmt.Errorf("invalid proxy address %q: %v", p.proxyAddr, err)
+	}
+	if err := validateAddr(p.targetAddr); err != nil {
+		return fmt.Errorf("invalid target address %q: %v", p.targetAddr, err)
+	}
+	if addrsCollide(p.proxyAddr, p.targetAddr) {
+		return fmt.Errorf("target address %q points back at the proxy address %q", p.targetAddr, p.proxyAddr)
+	}
+	if p.targetAddrs != "" {
+		targets, err := parseTargets(p.targetAddrs)
+		if err != nil {
+			return fmt.Errorf("invalid REDIS_TARGET_ADDRS %q: %v", p.targetAddrs, err)
+		}
+		for _, target := range targets {
+			if addrsCollide(p.proxyAddr, target.addr) {
+				return fmt.Errorf("target address %q points back at the proxy address %q", target.addr, p.proxyAddr)
 			}
 		}
+	}
+	if (p.tlsCertFile == "") != (p.tlsKeyFile == "") {
+		return fmt.Errorf("REDIS_TLS_CERT and REDIS_TLS_KEY must be set together")
+	}
+	if p.prefixFromCert && (p.tlsCertFile == "" || p.tlsClientCA == "") {
+		return fmt.Errorf("REDIS_PREFIX_FROM_CERT requires REDIS_TLS_CERT, REDIS_TLS_KEY and REDIS_TLS_CLIENT_CA")
+	}
+	if p.prefixTemplate != "" {
+		if err := validatePrefixTemplate(p.prefixTemplate); err != nil {
+			return fmt.Errorf("invalid REDIS_PREFIX_TEMPLATE %q: %v", p.prefixTemplate, err)
+		}
+	}
+	if p.blockedMessage == "" || strings.ContainsAny(p.blockedMessage, "\r\n") {
+		return fmt.Errorf("invalid REDIS_BLOCKED_MESSAGE %q: must be a single non-empty line", p.blockedMessage)
+	}
+	if err := validateAutoPrefixTemplate(p.autoTemplate); err != nil {
+		return fmt.Errorf("invalid REDIS_AUTO_PREFIX_TEMPLATE %q: %v", p.autoTemplate, err)
+	}
+	switch p.selectMode {
+	case selectPassThrough, selectScope, selectReject:
+	default:
+		return fmt.Errorf("invalid REDIS_SELECT_MODE %q: must be %s, %s or %s",
+			p.selectMode, selectPassThrough, selectScope, selectReject)
+	}
+	if err := checkCommandTables(keyCommands, noPrefixCommands, keyHandlers, subcommandKeys); err != nil {
+		return fmt.Errorf("inconsistent command tables: %v", err)
+	}
+	switch p.passwordAuth {
+	case passwordAuthReject, passwordAuthDefault, passwordAuthPrefix:
+	default:
+		return fmt.Errorf("invalid REDIS_PASSWORD_AUTH %q: must be %s, %s or %s",
+			p.passwordAuth, passwordAuthReject, passwordAuthDefault, passwordAuthPrefix)
+	}
+	switch p.logLevel {
+	case logLevelDebug, logLevelInfo, logLevelSilent:
+	default:
+		return fmt.Errorf("invalid REDIS_LOG_LEVEL %q: must be %s, %s or %s",
+			p.logLevel, logLevelDebug, logLevelInfo, logLevelSilent)
+	}
+	switch p.unknownPolicy {
+	case unknownForward, unknownReject, unknownLog:
+	default:
+		return fmt.Errorf("invalid REDIS_UNKNOWN_COMMAND %q: must be %s, %s or %s",
+			p.unknownPolicy, unknownForward, unknownReject, unknownLog)
+	}
+	return nil
+}
+
+// reloadConfig re-reads the file-based configuration and swaps it in atomically.
+// Nothing changes if any file fails to load. New connections use the new config;
+// existing connections keep the backend they were routed to.
+func (p *RedisProxy) reloadConfig() error {
+	var shardMap map[string]string
+	if p.shardMapFile != "" {
+		var err error
+		shardMap, err = loadShardMap(p.shardMapFile)
+		if err != nil {
+			return fmt.Errorf("shard map: %v", err)
+		}
+		p.logf("Loaded %d shard(s) from %s", len(shardMap), p.shardMapFile)
+	}
 
-		// Forward the data
-		_, err = dst.Write(data)
+	var defaultTTLs map[string]int
+	if p.ttlMapFile != "" {
+		var err error
+		defaultTTLs, err = loadTTLMap(p.ttlMapFile)
 		if err != nil {
-			log.Printf("Write error (%s): %v", direction, err)
-			return
+			return fmt.Errorf("TTL map: %v", err)
 		}
+		p.logf("Loaded %d default TTL(s) from %s", len(defaultTTLs), p.ttlMapFile)
 	}
+
+	p.configMux.Lock()
+	p.shardMap = shardMap
+	p.defaultTTLs = defaultTTLs
+	p.configMux.Unlock()
+	return nil
 }
 
-// readRESP reads a complete RESP message with improved error handling
-func (p *RedisProxy) readRESP(reader *bufio.Reader) ([]byte, error) {
-	// Read the first byte to determine the type
-	firstByte, err := reader.ReadByte()
+// loadShardMap reads a JSON object mapping prefixes to backend addresses,
+// e.g. {"alice": "10.0.0.1:6379"}. Prefixes get a trailing ':' like REDIS_DEFAULT_PREFIX.
+func loadShardMap(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	var entries map[string]string
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
 
-	switch firstByte {
-	case '+': // Simple String
-		return p.readSimpleString(reader, firstByte)
-	case '-': // Error
-		return p.readSimpleString(reader, firstByte)
-	case ':': // Integer
-		return p.readInteger(reader, firstByte)
-	case '$': // Bulk String
-		return p.readBulkString(reader, firstByte)
-	case '*': // Array
-		return p.readArray(reader, firstByte)
+	shardMap := make(map[string]string, len(entries))
+	for prefix, addr := range entries {
+		if err := validateAddr(addr); err != nil {
+			return nil, fmt.Errorf("invalid backend address %q for prefix %q: %v", addr, prefix, err)
+		}
+		if !strings.HasSuffix(prefix, ":") {
+			prefix += ":"
+		}
+		shardMap[prefix] = addr
+	}
+	return shardMap, nil
+}
+
+// loadTTLMap reads a JSON object mapping prefixes to a default SET TTL in
+// seconds, e.g. {"alice": 3600}. Prefixes get a trailing ':' like in the shard map.
+func loadTTLMap(path string) (map[string]int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]int
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+
+	ttls := make(map[string]int, len(entries))
+	for prefix, ttl := range entries {
+		if ttl <= 0 {
+			return nil, fmt.Errorf("invalid TTL %d for prefix %q: must be positive", ttl, prefix)
+		}
+		if !strings.HasSuffix(prefix, ":") {
+			prefix += ":"
+		}
+		ttls[prefix] = ttl
+	}
+	return ttls, nil
+}
+
+// captureRecord is one client command in a capture file: the bytes the client
+// sent, the prefix in effect and what the proxy turned them into
+type captureRecord struct {
+	Conn   string `json:"conn"`
+	Prefix string `json:"prefix"`
+	In     []byte `json:"in"`
+	Out    []byte `json:"out"`
+	Reply  bool   `json:"reply,omitempty"` // Out is the proxy's own reply, nothing was forwarded
+}
+
+// captureLog appends captureRecords to a file as JSON lines
+type captureLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	logf func(format string, args ...interface{}) // Reports failed writes
+}
+
+// openCaptureLog opens path for appending capture records
+func openCaptureLog(path string, logf func(format string, args ...interface{})) (*captureLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &captureLog{file: file, enc: json.NewEncoder(file), logf: logf}, nil
+}
+
+// record appends a single processed client command
+func (c *captureLog) record(clientConn net.Conn, prefix string, in, out []byte, reply bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec := captureRecord{Conn: clientConn.RemoteAddr().String(), Prefix: prefix, In: in, Out: out, Reply: reply}
+	if err := c.enc.Encode(rec); err != nil {
+		c.logf("Failed to write capture record: %v", err)
+	}
+}
+
+// redactedPassword replaces passwords in captured commands
+const redactedPassword = "<redacted>"
+
+// redactCredentials hides the password of an AUTH or HELLO ... AUTH command so
+// capture files never hold credentials. The username stays, since replaying a
+// capture needs it to derive the same prefix.
+func (p *RedisProxy) redactCredentials(data []byte) []byte {
+	args, _, err := p.parseRESPArgs(data)
+	inline := err != nil
+	if inline {
+		args = strings.Fields(string(data))
+	}
+	if len(args) < 2 {
+		return data
+	}
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		args[len(args)-1] = redactedPassword
+	case "HELLO":
+		redacted := false
+		for i := 2; i+2 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "AUTH" {
+				args[i+2] = redactedPassword
+				redacted = true
+			}
+		}
+		if !redacted {
+			return data
+		}
 	default:
-		// Log the unknown byte and try to read more context for debugging
-		log.Printf("Unknown RESP type: %c (0x%02x), attempting to read context", firstByte, firstByte)
+		return data
+	}
+	if inline {
+		return []byte(strings.Join(args, " ") + "\r\n")
+	}
+	return RESPCodec{}.Encode(args)
+}
 
-		// Try to read a few more bytes to see what's coming
-		peekBytes, err := reader.Peek(10)
-		if err == nil {
-			log.Printf("Next bytes: %q", peekBytes)
+// Close closes the capture file
+func (c *captureLog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// readCapture loads the records of a capture file, in the order they were written
+func readCapture(r io.Reader) ([]captureRecord, error) {
+	var records []captureRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec captureRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid capture record %d: %v", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// validateAddr checks that addr is a host:port pair, with IPv6 hosts in brackets
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("IPv6 addresses must be bracketed, e.g. [::1]:6379")
 		}
+		return err
+	}
+	if port == "" {
+		return fmt.Errorf("missing port")
+	}
+	return nil
+}
 
-		// For now, let's try to handle this gracefully by reading until we find a valid RESP type
-		// This might be some kind of protocol negotiation or malformed data
-		return p.handleUnknownProtocol(reader, firstByte)
+// addrsCollide reports whether dialing targetAddr would reach a listener bound to proxyAddr
+func addrsCollide(proxyAddr, targetAddr string) bool {
+	listen, err := net.ResolveTCPAddr("tcp", proxyAddr)
+	if err != nil {
+		return false
+	}
+	target, err := net.ResolveTCPAddr("tcp", targetAddr)
+	if err != nil {
+		return false
+	}
+	return tcpAddrsCollide(listen, target)
+}
+
+// tcpAddrsCollide reports whether remote is served by a listener bound to listen
+func tcpAddrsCollide(listen, remote *net.TCPAddr) bool {
+	if listen.Port != remote.Port {
+		return false
+	}
+	if listen.IP == nil || listen.IP.IsUnspecified() {
+		return isLocalIP(remote.IP)
+	}
+	return listen.IP.Equal(remote.IP)
+}
+
+// isLocalIP reports whether ip belongs to this host
+func isLocalIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePrefixTemplate checks that a prefix template references the username
+// and uses no unknown placeholders
+func validatePrefixTemplate(template string) error {
+	if !strings.Contains(template, "{user}") {
+		return fmt.Errorf("template must contain {user}")
+	}
+	rest := strings.ReplaceAll(template, "{user}", "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("template contains an unknown placeholder")
+	}
+	return nil
+}
+
+// validateAutoPrefixTemplate checks that an auto-generated prefix template
+// references the client address and uses no unknown placeholders
+func validateAutoPrefixTemplate(template string) error {
+	if !strings.Contains(template, "{ip}") && !strings.Contains(template, "{addr}") {
+		return fmt.Errorf("template must contain {ip} or {addr}")
+	}
+	rest := strings.NewReplacer("{ip}", "", "{addr}", "").Replace(template)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("template contains an unknown placeholder")
+	}
+	return nil
+}
+
+// autoPrefix fills in the auto-generated prefix template for a client address:
+// {addr} is the full address and {ip} the address without its port
+func (p *RedisProxy) autoPrefix(remoteAddr net.Addr) string {
+	addr := remoteAddr.String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	return strings.NewReplacer("{ip}", ip, "{addr}", addr).Replace(p.autoTemplate)
+}
+
+// handleConnection processes a single client connection
+func (p *RedisProxy) handleConnection(clientConn net.Conn) {
+	defer func() {
+		clientConn.Close()
+		// Clean up state for this connection
+		p.connMux.Lock()
+		if state, exists := p.conns[clientConn]; exists {
+			p.releasePrefixLocked(state)
+		}
+		delete(p.conns, clientConn)
+		p.connMux.Unlock()
+		p.signalDrained()
+	}()
+
+	// In mTLS mode the client certificate decides the tenant, not AUTH
+	if tlsConn, ok := clientConn.(*tls.Conn); ok && p.prefixFromCert {
+		if err := tlsConn.Handshake(); err != nil {
+			p.logf("TLS handshake failed for %s: %v", clientConn.RemoteAddr(), err)
+			return
+		}
+		prefix := certPrefix(tlsConn.ConnectionState())
+		if prefix == "" {
+			p.logf("Client certificate from %s has no usable name, rejecting", clientConn.RemoteAddr())
+			clientConn.Write(p.createErrorResponse("ERR client certificate has no Common Name"))
+			return
+		}
+		p.connMux.Lock()
+		p.conns[clientConn] = &connState{prefix: prefix, prefixBound: true}
+		p.connMux.Unlock()
+		p.logf("Set certificate prefix '%s' for connection %s", prefix, clientConn.RemoteAddr())
+	}
+
+	p.logf("New connection from %s", clientConn.RemoteAddr())
+
+	// Set a default prefix for this connection if none is set via AUTH
+	// This ensures all operations get prefixed even without explicit AUTH
+	p.connMux.Lock()
+	if _, exists := p.conns[clientConn]; !exists {
+		if p.defaultPrefix != "" {
+			p.conns[clientConn] = &connState{prefix: p.defaultPrefix}
+			p.logf("Set configured default prefix '%s' for connection %s", p.defaultPrefix, clientConn.RemoteAddr())
+		} else {
+			defaultPrefix := p.autoPrefix(clientConn.RemoteAddr())
+			p.conns[clientConn] = &connState{prefix: defaultPrefix}
+			p.logf("Set auto-generated default prefix '%s' for connection %s", defaultPrefix, clientConn.RemoteAddr())
+		}
+	}
+	p.connMux.Unlock()
+
+	// Only a certificate names a tenant on connect; the shared default prefix is
+	// never counted, so anonymous clients can't use up a slot and block AUTH
+	if prefix := p.tenantPrefix(clientConn); p.isPrefixBound(clientConn) && !p.claimPrefix(clientConn, prefix) {
+		p.logf("Tenant '%s' is at its connection limit, rejecting connection from %s", prefix, clientConn.RemoteAddr())
+		p.denied.observe(prefix, denyLimit)
+		clientConn.Write(p.createErrorResponse("ERR tenant connection limit reached"))
+		return
+	}
+
+	// Don't dial until a command actually needs the backend: an AUTH may change
+	// the prefix, which decides the backend, and commands the proxy answers itself
+	// (or a client that never sends anything) shouldn't cost a backend connection
+	clientReader := bufio.NewReader(clientConn)
+	var first []byte
+	for first == nil {
+		data, err := p.readCommand(clientReader)
+		if err != nil {
+			if reply := protocolErrorReply(err); reply != nil {
+				p.abortCommands(clientConn, reply)
+			}
+			if err != io.EOF {
+				p.logf("Read error (client->server): %v", err)
+			}
+			return
+		}
+		data, reply := p.processClientCommand(clientConn, data)
+		if !reply {
+			first = data
+		} else if err := p.replyToClient(clientConn, data); err != nil {
+			p.logf("Write error (client): %v", err)
+			return
+		}
+	}
+	backendAddr := p.backendFor(p.routingPrefix(clientConn))
+
+	// Guard against a backend that resolves back to ourselves at runtime (e.g. DNS
+	// changes), which would otherwise chain connections until resources run out
+	if p.isSelfAddr(backendAddr) {
+		p.logf("Backend %s loops back to the proxy, rejecting connection from %s", backendAddr, clientConn.RemoteAddr())
+		clientConn.Write(p.createErrorResponse("ERR proxy target loops back to the proxy"))
+		return
+	}
+
+	// Fail fast without dialing while the backend is known to be down
+	if !p.breaker.allow() {
+		p.logf("Backend circuit breaker open, rejecting connection from %s", clientConn.RemoteAddr())
+		clientConn.Write(p.createErrorResponse("ERR backend unavailable"))
+		return
+	}
+
+	// Connect to the actual Redis server. A blackholed backend would otherwise
+	// hold the client for the OS connect timeout before the breaker counts it.
+	serverConn, err := net.DialTimeout("tcp", backendAddr, p.dialTimeout)
+	if err != nil {
+		p.breaker.failure()
+		p.logf("Failed to connect to Redis server %s: %v", backendAddr, err)
+		// The command that needed the backend must not vanish without an answer
+		p.abortCommands(clientConn, p.createErrorResponse("ERR backend unavailable"))
+		return
+	}
+	p.breaker.success()
+	defer serverConn.Close()
+
+	if _, err := writeAll(serverConn, first); err != nil {
+		p.logf("Write error (client->server): %v", err)
+		return
+	}
+	p.armCommandTimeout(clientConn, serverConn)
+
+	// Create bidirectional proxy with prefix modification
+	done := make(chan bool, 2)
+
+	// Client to server (with prefix modification)
+	go func() {
+		p.forwardWithPrefix(clientReader, clientConn, serverConn, true)
+		done <- true
+	}()
+
+	// Server to client (pass through)
+	go func() {
+		p.forwardWithPrefix(bufio.NewReader(serverConn), serverConn, clientConn, false)
+		done <- true
+	}()
+
+	// Wait for either direction to close
+	<-done
+	p.logf("Connection closed for %s", clientConn.RemoteAddr())
+}
+
+// backendFor returns the backend address serving a prefix, using the shard map
+// when it has an entry for the prefix and the default target otherwise
+func (p *RedisProxy) backendFor(prefix string) string {
+	p.configMux.RLock()
+	defer p.configMux.RUnlock()
+	if addr, ok := p.shardMap[prefix]; ok {
+		return addr
+	}
+	if p.targets != nil {
+		return p.targets.next()
+	}
+	return p.targetAddr
+}
+
+// weightedTarget is a backend in a targetPool
+type weightedTarget struct {
+	addr    string
+	weight  int
+	current int // Smooth weighted round-robin state
+}
+
+// targetPool spreads new connections across equivalent backends by smooth
+// weighted round-robin, so a backend with weight 2 gets every other pick
+// against one with weight 1, interleaved rather than in bursts
+type targetPool struct {
+	mu      sync.Mutex
+	targets []weightedTarget
+	total   int
+}
+
+// newTargetPool creates a pool picking among targets
+func newTargetPool(targets []weightedTarget) *targetPool {
+	pool := &targetPool{targets: targets}
+	for _, target := range targets {
+		pool.total += target.weight
+	}
+	return pool
+}
+
+// next picks the backend for a new connection
+func (t *targetPool) next() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	best := 0
+	for i := range t.targets {
+		t.targets[i].current += t.targets[i].weight
+		if t.targets[i].current > t.targets[best].current {
+			best = i
+		}
+	}
+	t.targets[best].current -= t.total
+	return t.targets[best].addr
+}
+
+// parseTargets parses a comma separated list of backend addresses, each with
+// an optional "=weight" suffix (default 1)
+func parseTargets(list string) ([]weightedTarget, error) {
+	var targets []weightedTarget
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, weight := entry, 1
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight in %q: must be a positive integer", entry)
+			}
+			addr, weight = entry[:i], w
+		}
+		if err := validateAddr(addr); err != nil {
+			return nil, fmt.Errorf("invalid backend address %q: %v", addr, err)
+		}
+		targets = append(targets, weightedTarget{addr: addr, weight: weight})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no backend addresses")
+	}
+	return targets, nil
+}
+
+// defaultTTLFor returns the default SET TTL in seconds for a prefix, 0 for none
+func (p *RedisProxy) defaultTTLFor(prefix string) int {
+	p.configMux.RLock()
+	defer p.configMux.RUnlock()
+	return p.defaultTTLs[prefix]
+}
+
+// isSelfAddr reports whether addr currently resolves to the proxy's own listener
+func (p *RedisProxy) isSelfAddr(addr string) bool {
+	listen, ok := p.listenAddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	target, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	return tcpAddrsCollide(listen, target)
+}
+
+// breakerState is the state of a circuitBreaker
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Dials are attempted normally
+	breakerOpen                         // Dials are skipped until the cooldown expires
+	breakerHalfOpen                     // A single trial dial is in flight
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops dialing the backend after consecutive dial failures and
+// lets a single trial dial through once the cooldown has passed
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // Consecutive failures before opening, 0 disables the breaker
+	cooldown  time.Duration // How long to stay open before a trial dial
+	failures  int
+	openedAt  time.Time
+	state     breakerState
+	logf      func(format string, args ...interface{}) // Reports state changes
+}
+
+// newCircuitBreaker creates a closed circuit breaker reporting state changes to logf
+func newCircuitBreaker(threshold int, cooldown time.Duration, logf func(format string, args ...interface{})) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, logf: logf}
+}
+
+// allow reports whether a backend dial may be attempted
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.logf("Backend circuit breaker half-open, trying a dial")
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// success records a successful dial and closes the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		b.logf("Backend circuit breaker closed")
+	}
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// failure records a failed dial, opening the breaker once the threshold is reached
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold <= 0 {
+		return
+	}
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.logf("Backend circuit breaker open after %d consecutive failures", b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// String summarizes the breaker for the admin socket
+func (b *circuitBreaker) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("state=%s failures=%d", b.state, b.failures)
+}
+
+// latencyBuckets are the histogram upper bounds in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// blockingCommands can wait on the server for as long as the client asks, so
+// their round-trip time says nothing about backend latency and they are exempt
+// from the command timeout
+var blockingCommands = map[string]bool{
+	"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BLMOVE": true, "BLMPOP": true,
+	"BZPOPMIN": true, "BZPOPMAX": true, "BZMPOP": true, "WAIT": true, "WAITAOF": true,
+}
+
+// blockOptionCommands only block when given a BLOCK option before STREAMS
+var blockOptionCommands = map[string]bool{
+	"XREAD": true, "XREADGROUP": true,
+}
+
+// isBlockingCommand reports whether a command may wait on the server, from the
+// command tables and, for commands with a BLOCK option, its arguments
+func isBlockingCommand(command string, args []string) bool {
+	if blockingCommands[command] {
+		return true
+	}
+	if !blockOptionCommands[command] {
+		return false
+	}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BLOCK":
+			return true
+		case "STREAMS":
+			// Everything after STREAMS is a stream name or an ID
+			return false
+		}
+	}
+	return false
+}
+
+// latencyHistogram counts observed durations into fixed buckets
+type latencyHistogram struct {
+	mu     sync.Mutex
+	bounds []float64 // Bucket upper bounds in seconds, ascending
+	counts []uint64  // Observations per bucket, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// newLatencyHistogram creates an empty histogram with the given bucket bounds
+func newLatencyHistogram(bounds []float64) *latencyHistogram {
+	return &latencyHistogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records a single duration
+func (h *latencyHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// cumulative returns the number of observations at or below each bound, ending with +Inf
+func (h *latencyHistogram) cumulative() []uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]uint64, len(h.counts))
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		out[i] = total
+	}
+	return out
+}
+
+// quantile returns the upper bound of the bucket holding quantile q, or +Inf
+func (h *latencyHistogram) quantile(q float64) float64 {
+	cumulative := h.cumulative()
+	total := cumulative[len(cumulative)-1]
+	for i, c := range cumulative[:len(h.bounds)] {
+		if total > 0 && float64(c) >= q*float64(total) {
+			return h.bounds[i]
+		}
+	}
+	return math.Inf(1)
+}
+
+// writePrometheus writes the histogram in the Prometheus text format
+func (h *latencyHistogram) writePrometheus(w io.Writer, name, help string) {
+	cumulative := h.cumulative()
+	h.mu.Lock()
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative[len(h.bounds)])
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(sum, 'g', -1, 64), name, count)
+}
+
+// String summarizes the histogram for the admin socket
+func (h *latencyHistogram) String() string {
+	h.mu.Lock()
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+	if count == 0 {
+		return "count=0"
+	}
+	avg := time.Duration(sum / float64(count) * float64(time.Second))
+	return fmt.Sprintf("count=%d avg=%s p50<=%ss p99<=%ss", count, avg,
+		strconv.FormatFloat(h.quantile(0.5), 'g', -1, 64), strconv.FormatFloat(h.quantile(0.99), 'g', -1, 64))
+}
+
+// keyCountCache keeps an approximate key count per prefix. Counts are seeded by
+// scanning the backend and then follow the replies that prove a key was created
+// or removed; a plain SET may overwrite, so it isn't counted, and expirations
+// are not seen.
+// At most maxPrefixes counts are kept, the least recently used prefix is dropped
+// to make room and seeded again on its next AUTH.
+type keyCountCache struct {
+	mu      sync.Mutex
+	counts  map[string]int64 // Key count per seeded prefix
+	seeding map[string]bool  // Prefixes with a seeding scan in flight
+	lru     *prefixLRU       // Bounds counts to the most recently updated prefixes
+}
+
+// newKeyCountCache creates an empty key count cache holding up to maxPrefixes counts
+func newKeyCountCache(maxPrefixes int) *keyCountCache {
+	return &keyCountCache{
+		counts:  make(map[string]int64),
+		seeding: make(map[string]bool),
+		lru:     newPrefixLRU(maxPrefixes),
+	}
+}
+
+// touchLocked marks prefix as just used and, when over the limit, drops the
+// least recently used count. The caller must hold c.mu.
+func (c *keyCountCache) touchLocked(prefix string) {
+	if evicted, ok := c.lru.touch(prefix); ok {
+		delete(c.counts, evicted)
+	}
+}
+
+// prefixLRU bounds a map keyed by prefix, remembering when each prefix was last
+// used so the least recently used one can be dropped. It has no lock of its own;
+// its owner guards it together with the map it bounds.
+type prefixLRU struct {
+	used        map[string]uint64 // Tick of each prefix's last use
+	tick        uint64            // Increases on every use
+	maxPrefixes int               // Most prefixes kept, 0 for no limit
+}
+
+// newPrefixLRU creates an empty LRU keeping up to maxPrefixes prefixes
+func newPrefixLRU(maxPrefixes int) *prefixLRU {
+	return &prefixLRU{used: make(map[string]uint64), maxPrefixes: maxPrefixes}
+}
+
+// touch marks prefix as just used. When that puts the LRU over maxPrefixes it
+// forgets the least recently used prefix and returns it for the caller to drop.
+func (l *prefixLRU) touch(prefix string) (evicted string, ok bool) {
+	l.tick++
+	l.used[prefix] = l.tick
+	if l.maxPrefixes <= 0 || len(l.used) <= l.maxPrefixes {
+		return "", false
+	}
+	for candidate, tick := range l.used {
+		if !ok || tick < l.used[evicted] {
+			evicted, ok = candidate, true
+		}
+	}
+	delete(l.used, evicted)
+	return evicted, true
+}
+
+// reset forgets every prefix
+func (l *prefixLRU) reset() {
+	l.used = make(map[string]uint64)
+}
+
+// startSeeding reports whether prefix still needs seeding, marking it in flight if so
+func (c *keyCountCache) startSeeding(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, seeded := c.counts[prefix]; seeded || c.seeding[prefix] {
+		return false
+	}
+	c.seeding[prefix] = true
+	return true
+}
+
+// finishSeeding stores the scanned count for prefix, or forgets the attempt when
+// the scan failed (ok is false) so the next AUTH tries again
+func (c *keyCountCache) finishSeeding(prefix string, count int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.seeding[prefix] {
+		return // Invalidated while scanning
+	}
+	delete(c.seeding, prefix)
+	if ok {
+		c.counts[prefix] = count
+		c.touchLocked(prefix)
+	}
+}
+
+// observe adjusts the count for prefix from a command's reply. Prefixes that are
+// not seeded yet are skipped, their scan will pick the change up.
+func (c *keyCountCache) observe(prefix, command string, reply []byte) {
+	var delta int64
+	switch command {
+	case "SET NX":
+		if !bytes.Equal(reply, []byte("+OK\r\n")) {
+			return
+		}
+		delta = 1
+	case "SETNX":
+		if !bytes.Equal(reply, []byte(":1\r\n")) {
+			return
+		}
+		delta = 1
+	case "DEL", "UNLINK":
+		if len(reply) < 3 || reply[0] != ':' {
+			return
+		}
+		removed, err := strconv.ParseInt(string(bytes.TrimSpace(reply[1:])), 10, 64)
+		if err != nil {
+			return
+		}
+		delta = -removed
+	case "FLUSHDB", "FLUSHALL":
+		if bytes.Equal(reply, []byte("+OK\r\n")) {
+			c.invalidate()
+		}
+		return
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if count, seeded := c.counts[prefix]; seeded {
+		c.counts[prefix] = max(count+delta, 0)
+		c.touchLocked(prefix)
+	}
+}
+
+// invalidate drops every count after keys were purged; each prefix is seeded
+// again on its next AUTH
+func (c *keyCountCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = make(map[string]int64)
+	c.seeding = make(map[string]bool)
+	c.lru.reset()
+}
+
+// get returns the count for prefix and whether it has been seeded
+func (c *keyCountCache) get(prefix string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, ok := c.counts[prefix]
+	return count, ok
+}
+
+// sortedPrefixesLocked returns the counted prefixes in order. The caller must hold c.mu.
+func (c *keyCountCache) sortedPrefixesLocked() []string {
+	prefixes := make([]string, 0, len(c.counts))
+	for prefix := range c.counts {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// String lists the counts for the admin socket, sorted by prefix
+func (c *keyCountCache) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) == 0 {
+		return "(none)"
+	}
+	prefixes := c.sortedPrefixesLocked()
+	parts := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		parts[i] = fmt.Sprintf("%s=%d", prefix, c.counts[prefix])
+	}
+	return strings.Join(parts, " ")
+}
+
+// prometheusLabel escapes a label value for the Prometheus text format
+var prometheusLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes the counts as a gauge labeled by prefix
+func (c *keyCountCache) writePrometheus(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, prefix := range c.sortedPrefixesLocked() {
+		fmt.Fprintf(w, "%s{prefix=\"%s\"} %d\n", name, prometheusLabel.Replace(prefix), c.counts[prefix])
+	}
+}
+
+// commandCounter counts how often each command was seen
+type commandCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// newCommandCounter creates an empty command counter
+func newCommandCounter() *commandCounter {
+	return &commandCounter{counts: make(map[string]int64)}
+}
+
+// observe counts one use of command and reports whether it is the first
+func (c *commandCounter) observe(command string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[command]++
+	return c.counts[command] == 1
+}
+
+// String formats the counts as "COMMAND=n" pairs sorted by command
+func (c *commandCounter) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) == 0 {
+		return "(none)"
+	}
+	commands := make([]string, 0, len(c.counts))
+	for command := range c.counts {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	parts := make([]string, len(commands))
+	for i, command := range commands {
+		parts[i] = fmt.Sprintf("%s=%d", command, c.counts[command])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reasons a command is denied, the reason label of redis_proxy_denied_commands_total
+const (
+	denyBlocked   = "blocked"   // Blocked by the proxy: FLUSHDB/FLUSHALL, CLUSTER topology, SELECT or unknown commands
+	denyACL       = "acl"       // Reserved for admin tenants
+	denyWhitelist = "whitelist" // Not in REDIS_COMMAND_WHITELIST
+	denyLimit     = "limit"     // Tenant connection limit reached
+)
+
+// deniedCounter counts commands denied by policy per tenant prefix and reason.
+// At most maxPrefixes prefixes are counted; the prefix denied least recently is
+// dropped to make room for a new one.
+type deniedCounter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int64 // Denials per prefix, then per reason
+	lru    *prefixLRU                  // Bounds counts to the most recently denied prefixes
+}
+
+// newDeniedCounter creates an empty denial counter for up to maxPrefixes prefixes
+func newDeniedCounter(maxPrefixes int) *deniedCounter {
+	return &deniedCounter{
+		counts: make(map[string]map[string]int64),
+		lru:    newPrefixLRU(maxPrefixes),
+	}
+}
+
+// observe counts one denial of a command from prefix for reason
+func (c *deniedCounter) observe(prefix, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[prefix] == nil {
+		c.counts[prefix] = make(map[string]int64)
+	}
+	c.counts[prefix][reason]++
+	if evicted, ok := c.lru.touch(prefix); ok {
+		delete(c.counts, evicted)
+	}
+}
+
+// writePrometheus writes the denials as a counter labeled by prefix and reason
+func (c *deniedCounter) writePrometheus(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	prefixes := make([]string, 0, len(c.counts))
+	for prefix := range c.counts {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		reasons := make([]string, 0, len(c.counts[prefix]))
+		for reason := range c.counts[prefix] {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "%s{prefix=\"%s\",reason=\"%s\"} %d\n",
+				name, prometheusLabel.Replace(prefix), reason, c.counts[prefix][reason])
+		}
+	}
+}
+
+// seedKeyCount starts a background scan counting the keys of the connection's
+// prefix, unless the prefix is already counted. auth is the client's AUTH
+// command, replayed so the scan connection has the client's backend credentials.
+func (p *RedisProxy) seedKeyCount(clientConn net.Conn, auth []byte) {
+	if p.keyCounts == nil {
+		return
+	}
+	prefix := p.tenantPrefix(clientConn)
+	if !p.keyCounts.startSeeding(prefix) {
+		return
+	}
+	go func() {
+		count, err := p.scanKeyCount(p.backendFor(prefix), prefix, auth)
+		if err != nil {
+			p.logf("Failed to count keys for prefix '%s': %v", prefix, err)
+		} else {
+			p.logf("Counted %d key(s) for prefix '%s'", count, prefix)
+		}
+		p.keyCounts.finishSeeding(prefix, count, err == nil)
+	}()
+}
+
+// scanKeyCount counts the keys under prefix on the backend at addr with SCAN MATCH
+func (p *RedisProxy) scanKeyCount(addr, prefix string, auth []byte) (int64, error) {
+	var count int64
+	err := p.scanPrefix(addr, prefix, auth, 0, func(conn net.Conn, reader *bufio.Reader, keys []interface{}) error {
+		count += int64(len(keys))
+		return nil
+	})
+	return count, err
+}
+
+// allDatabases asks scanPrefix to walk every database holding keys
+const allDatabases = -1
+
+// scanPrefix walks every key under prefix in database db on the backend at addr
+// with SCAN MATCH on a connection of its own, calling visit with each non-empty
+// page of keys. auth is replayed first so the connection has the client's backend
+// credentials. With allDatabases, every database INFO keyspace lists is walked.
+func (p *RedisProxy) scanPrefix(addr, prefix string, auth []byte, db int, visit func(conn net.Conn, reader *bufio.Reader, keys []interface{}) error) error {
+	if p.isSelfAddr(addr) {
+		return fmt.Errorf("backend %s loops back to the proxy", addr)
+	}
+	conn, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	reader := bufio.NewReader(conn)
+
+	if auth != nil {
+		if _, err := writeAll(conn, auth); err != nil {
+			return err
+		}
+		reply, err := p.readRESP(reader)
+		if err != nil {
+			return err
+		}
+		if len(reply) > 0 && reply[0] == '-' {
+			return fmt.Errorf("AUTH failed: %s", bytes.TrimSpace(reply[1:]))
+		}
+	}
+
+	dbs := []int{db}
+	if db == allDatabases {
+		var err error
+		if dbs, err = p.keyspaceDatabases(conn, reader); err != nil {
+			return err
+		}
+	}
+	selected := 0
+	for _, db := range dbs {
+		if db != selected {
+			if _, err := writeAll(conn, p.buildRESPArray([]interface{}{"SELECT", strconv.Itoa(db)})); err != nil {
+				return err
+			}
+			reply, err := p.readRESP(reader)
+			if err != nil {
+				return err
+			}
+			if len(reply) > 0 && reply[0] == '-' {
+				return fmt.Errorf("SELECT %d failed: %s", db, bytes.TrimSpace(reply[1:]))
+			}
+			selected = db
+		}
+		if err := p.scanDatabase(conn, reader, prefix, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyspaceDatabases lists the databases holding keys from INFO keyspace
+func (p *RedisProxy) keyspaceDatabases(conn net.Conn, reader *bufio.Reader) ([]int, error) {
+	if _, err := writeAll(conn, p.buildRESPArray([]interface{}{"INFO", "keyspace"})); err != nil {
+		return nil, err
+	}
+	reply, err := p.readRESP(reader)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := p.parseRESP(reply)
+	info, ok := val.(string)
+	if err != nil || !ok || reply[0] != '$' {
+		return nil, fmt.Errorf("unexpected INFO keyspace reply %q", reply)
+	}
+	var dbs []int
+	for _, line := range strings.Split(info, "\n") {
+		// Lines look like db3:keys=12,expires=0,avg_ttl=0
+		name, _, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found || !strings.HasPrefix(name, "db") {
+			continue
+		}
+		if db, err := strconv.Atoi(name[2:]); err == nil {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs, nil
+}
+
+// scanDatabase walks the keys under prefix in the connection's current database
+func (p *RedisProxy) scanDatabase(conn net.Conn, reader *bufio.Reader, prefix string, visit func(conn net.Conn, reader *bufio.Reader, keys []interface{}) error) error {
+	cursor := "0"
+	pattern := escapeGlob(prefix) + "*"
+	for {
+		scan := p.buildRESPArray([]interface{}{"SCAN", cursor, "MATCH", pattern, "COUNT", "1000"})
+		if _, err := writeAll(conn, scan); err != nil {
+			return err
+		}
+		reply, err := p.readRESP(reader)
+		if err != nil {
+			return err
+		}
+		val, _, err := p.parseRESP(reply)
+		if err != nil {
+			return err
+		}
+		arr, ok := val.([]interface{})
+		if !ok || len(arr) != 2 {
+			return fmt.Errorf("unexpected SCAN reply %q", reply)
+		}
+		next, _ := arr[0].(string)
+		keys, _ := arr[1].([]interface{})
+		if len(keys) > 0 {
+			if err := visit(conn, reader, keys); err != nil {
+				return err
+			}
+		}
+		if next == "0" || next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// flushTenant answers FLUSHDB or FLUSHALL by unlinking only the connection's own
+// keys: the current database's prefix for FLUSHDB, every database of the tenant
+// for FLUSHALL. It replies once the keys are gone. Commands read before it are
+// answered by the backend first, so the flush never overtakes them.
+func (p *RedisProxy) flushTenant(clientConn net.Conn, command string, seq uint64) ([]byte, bool) {
+	prefix := p.getPrefix(clientConn)
+	if command == "FLUSHALL" {
+		prefix = p.tenantPrefix(clientConn)
+	}
+	if prefix == "" {
+		return p.denyCommand(clientConn, denyBlocked, p.blockedMessage)
+	}
+	if !p.waitForEarlierReplies(clientConn, seq) {
+		return nil, true
+	}
+
+	// With SELECT passed through the tenant's keys live in the backend database
+	// the client chose; otherwise the database is part of the prefix
+	db := 0
+	if p.selectMode == selectPassThrough {
+		db = p.connDB(clientConn)
+		if command == "FLUSHALL" {
+			db = allDatabases
+		}
+	}
+
+	var removed int64
+	err := p.scanPrefix(p.backendFor(p.tenantPrefix(clientConn)), prefix, p.connAuth(clientConn), db,
+		func(conn net.Conn, reader *bufio.Reader, keys []interface{}) error {
+			unlink := p.buildRESPArray(append([]interface{}{"UNLINK"}, keys...))
+			if _, err := writeAll(conn, unlink); err != nil {
+				return err
+			}
+			reply, err := p.readRESP(reader)
+			if err != nil {
+				return err
+			}
+			if len(reply) == 0 || reply[0] != ':' {
+				return fmt.Errorf("unexpected UNLINK reply %q", reply)
+			}
+			n, _ := strconv.ParseInt(string(bytes.TrimSpace(reply[1:])), 10, 64)
+			removed += n
+			return nil
+		})
+	if p.keyCounts != nil {
+		p.keyCounts.invalidate()
+	}
+	if err != nil {
+		p.logf("Tenant %s for prefix '%s' failed after %d key(s): %v", command, prefix, removed, err)
+		return p.rejectCommand(clientConn, "ERR tenant flush failed")
+	}
+	p.logf("Tenant %s removed %d key(s) for prefix '%s'", command, removed, prefix)
+	return p.answerCommand(clientConn, []byte("+OK\r\n"))
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as glob syntax. It works
+// on bytes so binary prefixes pass through unchanged.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// forwardWithPrefix forwards data read from src to dst, adding prefix to Redis commands
+func (p *RedisProxy) forwardWithPrefix(reader *bufio.Reader, src, dst net.Conn, isClientToServer bool) {
+	direction := "client->server"
+	if !isClientToServer {
+		direction = "server->client"
+	}
+
+	for {
+		// Hold off reading more commands while the backend is behind
+		if isClientToServer && !p.waitForWindow(reader, src) {
+			return
+		}
+
+		// Read RESP (Redis Serialization Protocol) data
+		var data []byte
+		var err error
+		if isClientToServer {
+			data, err = p.readCommand(reader)
+		} else if p.canStreamReply(dst, reader) {
+			// An array nothing rewrites goes to the client as it arrives
+			if err := p.streamReply(dst, src, reader); err != nil {
+				p.logf("Stream error (%s): %v", direction, err)
+				return
+			}
+			p.armCommandTimeout(dst, src)
+			continue
+		} else {
+			// Each inline line from an old server answers one command of its own
+			data, err = RESPCodec{MaxLineLength: p.maxLineLength, InlineLines: true, Logf: p.debugf}.Decode(reader)
+		}
+		if err != nil {
+			if reply := protocolErrorReply(err); reply != nil && isClientToServer {
+				// Like Redis, answer with a protocol error and drop the connection
+				p.abortCommands(src, reply)
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !isClientToServer {
+				// The backend is stuck on a command; its reply can't be paired any
+				// more, so tell the client and drop the connection
+				p.logf("Command timed out after %s for %s", p.commandTimeout, dst.RemoteAddr())
+				p.abortCommands(dst, p.createErrorResponse("ERR proxy: command timed out"))
+				return
+			}
+			if err != io.EOF {
+				p.logf("Read error (%s): %v", direction, err)
+			}
+			return
+		}
+
+		// Log the data being processed (for debugging)
+		if len(data) > 0 && p.debugLogging() {
+			logLen := len(data)
+			if logLen > 50 {
+				logLen = 50
+			}
+			p.logf("Processing %s data: %q", direction, data[:logLen])
+		}
+
+		if isClientToServer {
+			forward, reply := p.processClientCommand(src, data)
+			if reply {
+				// Answered by the proxy itself, nothing goes to the server
+				err = p.replyToClient(src, forward)
+			} else {
+				var n int
+				n, err = writeAll(dst, forward)
+				if err != nil && n > 0 {
+					// The backend holds a truncated command and the stream is out of
+					// sync, so neither side can be used any more
+					p.logf("Partial write (%s): %d of %d bytes", direction, n, len(forward))
+					src.Close()
+					dst.Close()
+				}
+			}
+			p.armCommandTimeout(src, dst)
+		} else {
+			err = p.forwardReply(dst, data)
+			p.armCommandTimeout(dst, src)
+		}
+		if err != nil {
+			p.logf("Write error (%s): %v", direction, err)
+			return
+		}
+	}
+}
+
+// abortCommands discards every command still awaiting a reply, along with the
+// proxy replies queued behind them, and sends reply to the client instead
+func (p *RedisProxy) abortCommands(clientConn net.Conn, reply []byte) error {
+	p.connMux.Lock()
+	if state, exists := p.conns[clientConn]; exists {
+		state.pending = nil
+	}
+	p.connMux.Unlock()
+	p.signalDrained()
+	return p.replyToClient(clientConn, reply)
+}
+
+// waitForWindow blocks until the connection has fewer than maxInflight commands
+// awaiting a reply. It returns false if the connection goes away meanwhile,
+// including the client hanging up while the backend is stalled.
+func (p *RedisProxy) waitForWindow(reader *bufio.Reader, clientConn net.Conn) bool {
+	if p.maxInflight <= 0 {
+		return true
+	}
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+
+	var closed chan struct{}
+	for {
+		state, exists := p.conns[clientConn]
+		if !exists {
+			return false
+		}
+		if len(state.pending) < p.maxInflight {
+			return true
+		}
+		if closed == nil {
+			closed = make(chan struct{})
+			stop := p.watchClientClose(reader, clientConn, closed)
+			defer func() {
+				// The watcher reads from reader, so it must be done before the
+				// caller reads again; connMux is released for it to finish
+				p.connMux.Unlock()
+				stop()
+				p.connMux.Lock()
+			}()
+		}
+		select {
+		case <-closed:
+			return false
+		default:
+		}
+		p.drained.Wait()
+	}
+}
+
+// watchClientClose buffers whatever the client sends while its commands wait
+// for the window, so a hang-up is seen without consuming any command. closed is
+// closed, and waitForWindow woken, when the client goes away. The returned
+// function stops the watcher and waits for it.
+func (p *RedisProxy) watchClientClose(reader *bufio.Reader, clientConn net.Conn, closed chan struct{}) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Once the buffer is full the client is held back by TCP instead
+		for n := reader.Buffered() + 1; n <= reader.Size(); n = reader.Buffered() + 1 {
+			if _, err := reader.Peek(n); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					return // Stopped by the caller
+				}
+				p.connMux.Lock()
+				close(closed)
+				p.drained.Broadcast()
+				p.connMux.Unlock()
+				return
+			}
+		}
+	}()
+	return func() {
+		clientConn.SetReadDeadline(time.Now())
+		<-done
+		clientConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// waitForEarlierReplies blocks until every command read before seq has had its
+// reply. It returns false if the connection goes away meanwhile.
+func (p *RedisProxy) waitForEarlierReplies(clientConn net.Conn, seq uint64) bool {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	for {
+		state, exists := p.conns[clientConn]
+		if !exists {
+			return false
+		}
+		if len(state.pending) == 0 || state.pending[0].seq >= seq {
+			return true
+		}
+		p.drained.Wait()
+	}
+}
+
+// signalDrained wakes connections waiting in waitForWindow or waitForEarlierReplies
+func (p *RedisProxy) signalDrained() {
+	p.drained.Broadcast()
+}
+
+// armCommandTimeout sets the backend read deadline for the oldest command still
+// awaiting a reply. Blocking commands and an idle connection get no deadline.
+// Both directions call it, so the deadline is worked out and set under writeMu;
+// otherwise a deadline computed before a reply arrived could be set after it.
+func (p *RedisProxy) armCommandTimeout(clientConn, serverConn net.Conn) {
+	if p.commandTimeout <= 0 {
+		return
+	}
+	if state := p.lookupState(clientConn); state != nil {
+		state.writeMu.Lock()
+		defer state.writeMu.Unlock()
+	}
+	var deadline time.Time
+	p.connMux.RLock()
+	if state, exists := p.conns[clientConn]; exists && len(state.pending) > 0 {
+		if head := state.pending[0]; !head.blocking {
+			deadline = head.sent.Add(p.commandTimeout)
+		}
+	}
+	p.connMux.RUnlock()
+	serverConn.SetReadDeadline(deadline)
+}
+
+// writeAll writes data to conn, looping over short writes until everything is
+// written or an error occurs. It returns the number of bytes written.
+func writeAll(conn net.Conn, data []byte) (int, error) {
+	written := 0
+	for written < len(data) {
+		n, err := conn.Write(data[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// forwardReply pairs a server reply with the oldest pending command, rewrites it
+// based on that command and writes it to the client, followed by any proxy
+// replies that were queued behind the command
+func (p *RedisProxy) forwardReply(clientConn net.Conn, data []byte) error {
+	state := p.lookupState(clientConn)
+	if state == nil {
+		_, err := writeAll(clientConn, data)
+		return err
+	}
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	// A RESP3 push may arrive on any connection, e.g. a client-side caching
+	// invalidation; only a subscription confirmation answers a command
+	if isPush(data) || p.inSubscribeMode(clientConn) {
+		kind, count, ok := p.parsePubSubReply(data)
+		if ok && subscriptionReplies[kind] {
+			p.connMux.Lock()
+			p.updateSubscriptions(state, kind, count)
+			p.connMux.Unlock()
+		} else if ok || isPush(data) {
+			// Published messages are pushed, not replies to a command
+			_, err := writeAll(clientConn, p.stripPubSubReply(data, p.getPrefix(clientConn)))
+			return err
+		}
+	}
+
+	data = p.noteStateReply(clientConn, state, data)
+	if cmd, ok := p.completeCommand(clientConn); ok {
+		if p.debugLogging() {
+			p.logf("[%s #%d] Reply for %s", clientConn.RemoteAddr(), cmd.seq, cmd.command)
+		}
+		if !cmd.blocking && !pubsubCommands[cmd.command] {
+			p.latency.observe(time.Since(cmd.sent))
+		}
+		// Metadata in a RESP3 attribute goes to the client as is, only the reply
+		// after it is inspected and rewritten
+		attr, reply := splitAttribute(data)
+		if p.keyCounts != nil {
+			command := cmd.command
+			if cmd.setNX {
+				command = "SET NX"
+			}
+			p.keyCounts.observe(p.tenantPrefix(clientConn), command, reply)
+		}
+		if cmd.cacheKey != "" {
+			p.storeTypeReply(clientConn, cmd.cacheKey, reply)
+		}
+		if cmd.command == "RESET" && string(reply) == "+RESET\r\n" {
+			p.connMux.Lock()
+			resetConnState(state)
+			p.connMux.Unlock()
+		}
+		data = p.rewriteResponse(clientConn, cmd.command, reply)
+		if len(attr) > 0 {
+			data = append(attr, data...)
+		}
+		data = append(data, cmd.after...)
+	}
+	_, err := writeAll(clientConn, data)
+	return err
+}
+
+// canStreamReply reports whether the next server reply is an array that can be
+// streamed to the client: its command's reply is never rewritten and the
+// connection isn't subscribed, where arrays may be pushed messages
+func (p *RedisProxy) canStreamReply(clientConn net.Conn, reader *bufio.Reader) bool {
+	if next, err := reader.Peek(1); err != nil || next[0] != '*' || p.inSubscribeMode(clientConn) {
+		return false
+	}
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	state, exists := p.conns[clientConn]
+	if !exists || len(state.pending) == 0 {
+		return false
+	}
+	// A HELLO's reply is an array under RESP2, and one that authenticates has
+	// to reach noteStateReply
+	head := state.pending[0]
+	return responseRewrites[head.command] == rewriteNone && !pubsubCommands[head.command] && head.auth == nil
+}
+
+// streamReply copies an array reply from the server to the client while it is
+// being read, then completes its command like forwardReply does. The reply has
+// started arriving, so the command timeout no longer applies; a reply cut short
+// can't be finished, so the client connection is closed rather than left with
+// a truncated aggregate.
+func (p *RedisProxy) streamReply(clientConn, serverConn net.Conn, reader *bufio.Reader) error {
+	state := p.lookupState(clientConn)
+	if state == nil {
+		// The connection was cleaned up since canStreamReply; pass the reply on
+		return RESPCodec{MaxLineLength: p.maxLineLength, Logf: p.debugf}.Stream(reader, clientConn)
+	}
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	// armCommandTimeout waits for writeMu, so nothing re-arms this mid-stream
+	serverConn.SetReadDeadline(time.Time{})
+	out := bufio.NewWriter(clientConn)
+	if err := (RESPCodec{MaxLineLength: p.maxLineLength, Logf: p.debugf}).Stream(reader, out); err != nil {
+		clientConn.Close()
+		return err
+	}
+	if cmd, ok := p.completeCommand(clientConn); ok {
+		if p.debugLogging() {
+			p.logf("[%s #%d] Streamed reply for %s", clientConn.RemoteAddr(), cmd.seq, cmd.command)
+		}
+		if !cmd.blocking {
+			p.latency.observe(time.Since(cmd.sent))
+		}
+		out.Write(cmd.after)
+	}
+	return out.Flush()
+}
+
+// replyToClient sends a reply generated by the proxy. While earlier commands
+// still await server replies it is queued behind them so replies stay in order.
+func (p *RedisProxy) replyToClient(clientConn net.Conn, reply []byte) error {
+	state := p.lookupState(clientConn)
+	if state == nil {
+		_, err := writeAll(clientConn, reply)
+		return err
+	}
+	state.writeMu.Lock()
+	defer state.writeMu.Unlock()
+
+	p.connMux.Lock()
+	if n := len(state.pending); n > 0 {
+		state.pending[n-1].after = append(state.pending[n-1].after, reply...)
+		p.connMux.Unlock()
+		return nil
+	}
+	p.connMux.Unlock()
+
+	_, err := writeAll(clientConn, reply)
+	return err
+}
+
+// readRESP reads a complete RESP message (see RESPCodec.Decode)
+func (p *RedisProxy) readRESP(reader *bufio.Reader) ([]byte, error) {
+	return RESPCodec{MaxLineLength: p.maxLineLength, Logf: p.debugf}.Decode(reader)
+}
+
+// errTooManyArgs reports a client command with more arguments than maxArgs
+var errTooManyArgs = errors.New("too many arguments")
+
+// protocolError is malformed RESP, described in the words Redis uses for it
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// protocolErrorReply returns the error reply Redis sends before closing a
+// connection whose input can't be parsed, or nil when err is not a parse error.
+// Once a length is wrong the rest of the stream can't be framed, so every parse
+// error ends the connection; I/O errors close it without a reply.
+func protocolErrorReply(err error) []byte {
+	var perr protocolError
+	switch {
+	case errors.Is(err, errTooManyArgs):
+		return []byte("-ERR Protocol error: invalid multibulk length\r\n")
+	case errors.As(err, &perr):
+		return []byte("-ERR " + perr.Error() + "\r\n")
+	}
+	return nil
+}
+
+// readCommand reads a client command like readRESP, but refuses command arrays
+// with more than maxArgs elements before reading any of them
+func (p *RedisProxy) readCommand(reader *bufio.Reader) ([]byte, error) {
+	return RESPCodec{MaxArgs: p.maxArgs, MaxLineLength: p.maxLineLength, RequireArrays: p.requireRESP, Logf: p.debugf}.Decode(reader)
+}
+
+// RESPCodec reads and writes RESP independently of any connection, so the
+// protocol handling can be exercised, or embedded, on its own
+type RESPCodec struct {
+	MaxArgs       int  // Most elements in a top-level array, 0 for no limit
+	MaxLineLength int  // Longest simple string, integer or length line in bytes, 0 for no limit
+	InlineLines   bool // Return data without RESP framing one line at a time
+	RequireArrays bool // Fail with a protocol error unless each message is an array
+
+	// Logf, when set, receives diagnostics about data that isn't RESP
+	Logf func(format string, args ...interface{})
+}
+
+// logf passes a diagnostic to Logf, if set
+func (c RESPCodec) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+// Decode reads a complete RESP message from reader and returns its raw bytes.
+// A top-level array with more than MaxArgs elements fails with errTooManyArgs
+// before any element is read.
+func (c RESPCodec) Decode(reader *bufio.Reader) ([]byte, error) {
+	if c.RequireArrays {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '*' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%c'", first[0]))
+		}
+	}
+	return c.decodeValue(reader, c.MaxArgs)
+}
+
+// Encode builds a RESP array of bulk strings, the form every client command takes
+func (c RESPCodec) Encode(args []string) []byte {
+	var result bytes.Buffer
+
+	// Write array header
+	result.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+
+	// Write each argument as a bulk string
+	for _, arg := range args {
+		result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+
+	return result.Bytes()
+}
+
+// decodeValue reads a single RESP value, limiting an array to maxLen elements
+func (c RESPCodec) decodeValue(reader *bufio.Reader, maxLen int) ([]byte, error) {
+	// Read the first byte to determine the type
+	firstByte, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch firstByte {
+	case '+': // Simple String
+		return c.readSimpleString(reader, firstByte)
+	case '-': // Error
+		return c.readSimpleString(reader, firstByte)
+	case ':': // Integer
+		return c.readInteger(reader, firstByte)
+	case '$': // Bulk String
+		return c.readBulkString(reader, firstByte)
+	case '*': // Array
+		return c.readArray(reader, firstByte, maxLen)
+	case '_', '#', ',', '(': // RESP3 null, boolean, double and big number
+		return c.readSimpleString(reader, firstByte)
+	case '!', '=': // RESP3 blob error and verbatim string
+		return c.readBulkString(reader, firstByte)
+	case '~', '>': // RESP3 set and push
+		return c.readArray(reader, firstByte, maxLen)
+	case '%': // RESP3 map
+		return c.readMap(reader, firstByte)
+	case '|': // RESP3 attribute, followed by the reply it annotates
+		attr, err := c.readMap(reader, firstByte)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := c.decodeValue(reader, maxLen)
+		if err != nil {
+			return nil, err
+		}
+		return append(attr, reply...), nil
+	default:
+		// Log the unknown byte and try to read more context for debugging
+		c.logf("Unknown RESP type: %c (0x%02x), attempting to read context", firstByte, firstByte)
+
+		// Log a few of the bytes already received, without waiting for more
+		peekBytes, err := reader.Peek(min(10, reader.Buffered()))
+		if err == nil {
+			c.logf("Next bytes: %q", peekBytes)
+		}
+
+		// For now, let's try to handle this gracefully by reading until we find a valid RESP type
+		// This might be some kind of protocol negotiation or malformed data
+		return c.handleUnknownProtocol(reader, firstByte)
+	}
+}
+
+// readSimpleString reads a simple string (status or error) with improved line ending handling
+func (c RESPCodec) readSimpleString(reader *bufio.Reader, firstByte byte) ([]byte, error) {
+	line, err := c.readLine(reader, "too big inline request")
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize line endings to \r\n
+	if !strings.HasSuffix(line, "\r\n") {
+		line = strings.TrimSuffix(line, "\n") + "\r\n"
+	}
+
+	return append([]byte{firstByte}, []byte(line)...), nil
+}
+
+// readInteger reads an integer with improved line ending handling
+func (c RESPCodec) readInteger(reader *bufio.Reader, firstByte byte) ([]byte, error) {
+	line, err := c.readLine(reader, "too big inline request")
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize line endings to \r\n
+	if !strings.HasSuffix(line, "\r\n") {
+		line = strings.TrimSuffix(line, "\n") + "\r\n"
+	}
+
+	return append([]byte{firstByte}, []byte(line)...), nil
+}
+
+// readBulkString reads a bulk string with improved error handling
+func (c RESPCodec) readBulkString(reader *bufio.Reader, firstByte byte) ([]byte, error) {
+	// Read length
+	lengthLine, err := c.readLine(reader, "too big bulk count string")
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize line endings
+	if !strings.HasSuffix(lengthLine, "\r\n") {
+		lengthLine = strings.TrimSuffix(lengthLine, "\n") + "\r\n"
+	}
+
+	result := append([]byte{firstByte}, []byte(lengthLine)...)
+
+	// Parse length
+	lengthStr := strings.TrimSpace(lengthLine)
+	length, err := strconv.Atoi(lengthStr)
+	if err != nil {
+		return nil, protocolError("invalid bulk length")
+	}
+
+	if length == -1 {
+		// Null bulk string
+		return result, nil
+	}
+	if length < 0 {
+		return nil, protocolError("invalid bulk length")
+	}
+
+	// Read the actual string
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the trailing \r\n
+	crlf := make([]byte, 2)
+	_, err = io.ReadFull(reader, crlf)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, append(data, crlf...)...), nil
+}
+
+// readArray reads an array with improved error handling, failing with errTooManyArgs
+// when it has more than maxLen elements (0 for no limit)
+func (c RESPCodec) readArray(reader *bufio.Reader, firstByte byte, maxLen int) ([]byte, error) {
+	result, length, err := c.readArrayHeader(reader, firstByte)
+	if err != nil {
+		return nil, err
+	}
+	if length == -1 {
+		// Null array
+		return result, nil
+	}
+	if maxLen > 0 && length > maxLen {
+		return nil, fmt.Errorf("%w: array of %d exceeds %d", errTooManyArgs, length, maxLen)
+	}
+
+	// Read each element
+	for i := 0; i < length; i++ {
+		element, err := c.decodeValue(reader, 0)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, element...)
+	}
+
+	return result, nil
+}
+
+// readArrayHeader reads the length line of an array, returning the header bytes
+// and the element count, -1 for a null array
+func (c RESPCodec) readArrayHeader(reader *bufio.Reader, firstByte byte) ([]byte, int, error) {
+	// Read array length
+	lengthLine, err := c.readLine(reader, "too big mbulk count string")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Normalize line endings
+	if !strings.HasSuffix(lengthLine, "\r\n") {
+		lengthLine = strings.TrimSuffix(lengthLine, "\n") + "\r\n"
+	}
+
+	// Parse length
+	length, err := strconv.Atoi(strings.TrimSpace(lengthLine))
+	if err != nil || length < -1 {
+		return nil, 0, protocolError("invalid multibulk length")
+	}
+	return append([]byte{firstByte}, []byte(lengthLine)...), length, nil
+}
+
+// readMap reads a RESP3 map, or an attribute without the reply that follows
+// it: the length line and that many key value pairs
+func (c RESPCodec) readMap(reader *bufio.Reader, firstByte byte) ([]byte, error) {
+	result, length, err := c.readArrayHeader(reader, firstByte)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 2*length; i++ {
+		element, err := c.decodeValue(reader, 0)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, element...)
+	}
+	return result, nil
+}
+
+// splitAttribute separates any RESP3 attributes at the start of a decoded reply
+// from the reply itself
+func splitAttribute(data []byte) (attr, reply []byte) {
+	n := 0
+	for n < len(data) && data[n] == '|' {
+		frame, err := RESPCodec{}.readMap(bufio.NewReader(bytes.NewReader(data[n+1:])), '|')
+		if err != nil {
+			break
+		}
+		n += len(frame)
+	}
+	return data[:n:n], data[n:]
+}
+
+// Stream copies a single RESP value from reader to w, writing each array element
+// as soon as it is read, so a large array is never held in memory as a whole.
+// The bytes written are the ones Decode would return.
+func (c RESPCodec) Stream(reader *bufio.Reader, w io.Writer) error {
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	if firstByte[0] != '*' {
+		data, err := c.decodeValue(reader, 0)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	reader.ReadByte()
+	header, length, err := c.readArrayHeader(reader, '*')
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < length; i++ {
+		if err := c.Stream(reader, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUnknownProtocol attempts to handle unknown protocol data gracefully
+func (c RESPCodec) handleUnknownProtocol(reader *bufio.Reader, firstByte byte) ([]byte, error) {
+	// Only whole lines are returned, so a line split across TCP segments waits for
+	// the rest instead of being forwarded in pieces
+	line, err := readLineLimited(reader, maxUnknownProtocolSize-1)
+	if errors.Is(err, errLineTooLong) {
+		return nil, protocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unknown protocol data: %w", err)
+	}
+
+	c.logf("Unknown protocol data: %c%s", firstByte, line)
+
+	// If this looks like a text-based protocol, try to forward it as-is
+	// This might be some kind of protocol negotiation or handshake
+	data := append([]byte{firstByte}, line...)
+	if c.InlineLines {
+		return data, nil
+	}
+
+	// Take further unknown lines that have already arrived, but never block waiting
+	// for more: the client may be waiting for a reply to what it sent
+	for reader.Buffered() > 0 {
+		peekBytes, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+
+		nextByte := peekBytes[0]
+		if nextByte == '+' || nextByte == '-' || nextByte == ':' || nextByte == '$' || nextByte == '*' {
+			// Found a valid RESP type, stop here
+			c.logf("Found valid RESP type after unknown protocol data: %c", nextByte)
+			break
+		}
+
+		line, err := readLineLimited(reader, maxUnknownProtocolSize-len(data))
+		if errors.Is(err, errLineTooLong) {
+			return nil, protocolError("too big inline request")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read unknown protocol data: %w", err)
+		}
+		data = append(data, line...)
+	}
+
+	return data, nil
+}
+
+// maxUnknownProtocolSize caps how much non-RESP data handleUnknownProtocol buffers
+const maxUnknownProtocolSize = 64 * 1024
+
+// readLine reads a line up to and including '\n', failing with tooLong once it
+// grows beyond MaxLineLength
+func (c RESPCodec) readLine(reader *bufio.Reader, tooLong protocolError) (string, error) {
+	if c.MaxLineLength <= 0 {
+		return reader.ReadString('\n')
+	}
+	line, err := readLineLimited(reader, c.MaxLineLength)
+	if errors.Is(err, errLineTooLong) {
+		return "", tooLong
+	}
+	return string(line), err
+}
+
+// errLineTooLong reports a line longer than readLineLimited allows
+var errLineTooLong = errors.New("line too long")
+
+// readLineLimited reads up to and including the next '\n', failing once the line
+// grows beyond limit bytes
+func readLineLimited(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, fmt.Errorf("%w: exceeds %d bytes", errLineTooLong, limit)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
+	}
+}
+
+// processClientCommand processes client commands, handling AUTH and adding prefixes.
+// It returns the bytes to forward to the server, or a reply for the client when
+// reply is true.
+func (p *RedisProxy) processClientCommand(clientConn net.Conn, data []byte) (out []byte, reply bool) {
+	// Parse command for tracking
+	args, integers, err := p.parseRESPArgs(data)
+	if integers {
+		// Redis only accepts bulk strings in a command, so integer elements are
+		// sent on as their string form whether or not they are keys
+		data = RESPCodec{}.Encode(args)
+	}
+	if err == nil && len(args) == 0 {
+		// Redis silently ignores an empty command (*0), so neither forward nor answer it
+		return nil, true
+	}
+	command := ""
+	if len(args) > 0 {
+		command = strings.ToUpper(args[0])
+	}
+	seq := p.trackCommand(clientConn, command, expectedReplies(command, args), isBlockingCommand(command, args))
+	if p.keyCounts != nil && command == "SET" && hasSetOption(args, "NX") {
+		p.markSetNX(clientConn)
+	}
+	if !p.awaitPendingAuth(clientConn, seq) {
+		return nil, true
+	}
+	if p.capture != nil {
+		prefix := p.getPrefix(clientConn)
+		defer func() {
+			p.capture.record(clientConn, prefix, p.redactCredentials(data), p.redactCredentials(out), reply)
+		}()
+	}
+	if p.debugLogging() {
+		p.logf("[%s #%d] Processing client command: %q", clientConn.RemoteAddr(), seq, data)
+	}
+	if p.allowCommands != nil && err != nil {
+		// Inline commands aren't parsed, so the whitelist can't vouch for them
+		p.logf("Unparsed command not permitted by whitelist from %s", clientConn.RemoteAddr())
+		return p.denyCommand(clientConn, denyWhitelist, "ERR command not permitted")
+	}
+	if p.allowCommands != nil && command != "" && !p.allowCommands[command] && !alwaysPermittedCommands[command] {
+		p.logf("Command %s not in whitelist from %s", command, clientConn.RemoteAddr())
+		return p.denyCommand(clientConn, denyWhitelist, "ERR command not permitted")
+	}
+
+	// Each command before AUTH is refused on its own; the connection stays open
+	// so the client can still authenticate. Inline commands aren't parsed, so
+	// they can't be told apart from an AUTH and are refused too, and a HELLO
+	// only goes ahead when it authenticates.
+	permitted := err == nil && alwaysPermittedCommands[command] && (command != "HELLO" || helloAuth(args) != nil)
+	if p.requireAuth && !permitted && !p.isAuthenticated(clientConn) {
+		return p.rejectCommand(clientConn, "NOAUTH Authentication required.")
+	}
+
+	if p.typeCacheTTL > 0 && command != "" {
+		p.invalidateTypeCache(clientConn, command, args)
+	}
+
+	// PROXY commands are about the proxy itself and never reach the backend
+	if command == "PROXY" {
+		return p.handleProxyCommand(clientConn, args)
+	}
+
+	// A tenant may clear its own keys, never the whole backend
+	if p.tenantFlush && (command == "FLUSHDB" || command == "FLUSHALL") && !p.inSubscribeMode(clientConn) {
+		return p.flushTenant(clientConn, command, seq)
+	}
+
+	// Check if this is a blocked command
+	if p.isBlockedCommand(data) {
+		p.logf("Blocked command from %s", clientConn.RemoteAddr())
+		return p.denyCommand(clientConn, denyBlocked, p.blockedMessage)
+	}
+
+	// Subscribing to nothing is an arity error in Redis; answer it here so the
+	// connection never counts as entering subscribe mode
+	if (command == "SUBSCRIBE" || command == "PSUBSCRIBE") && len(args) < 2 {
+		return p.rejectCommand(clientConn, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+
+	// A subscribed connection may only manage subscriptions; answer like Redis
+	// would rather than forwarding a prefixed key the error could echo back
+	if command != "" && !subscribeModeCommands[command] && p.inSubscribeMode(clientConn) {
+		return p.rejectCommand(clientConn, fmt.Sprintf(
+			"ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+			strings.ToLower(args[0])))
+	}
+
+	if command == "SELECT" {
+		return p.handleSelect(clientConn, args, data)
+	}
+
+	// Slot key listings and counts span every tenant's keys, topology or not
+	if command == "CLUSTER" && len(args) > 1 && clusterKeyspaceCommands[strings.ToUpper(args[1])] {
+		return p.denyCommand(clientConn, denyBlocked, fmt.Sprintf("ERR CLUSTER %s is not available through the proxy", strings.ToUpper(args[1])))
+	}
+	if command == "CLUSTER" && len(args) > 1 && clusterTopologyCommands[strings.ToUpper(args[1])] && !p.allowTopology {
+		return p.denyCommand(clientConn, denyBlocked, fmt.Sprintf("ERR CLUSTER %s is not available through the proxy", strings.ToUpper(args[1])))
+	}
+
+	// Commands that affect every tenant on the backend need an admin tenant
+	if len(args) > 1 && adminOnlyCommands[command+" "+strings.ToUpper(args[1])] && !p.adminTenants[p.tenantPrefix(clientConn)] {
+		p.logf("Rejected %s %s from non-admin tenant on %s", command, strings.ToUpper(args[1]), clientConn.RemoteAddr())
+		return p.denyCommand(clientConn, denyACL, fmt.Sprintf("ERR %s %s is reserved for admin tenants", command, strings.ToUpper(args[1])))
+	}
+
+	if command == "CLIENT" && len(args) > 2 && strings.ToUpper(args[1]) == "TRACKING" {
+		return p.rewriteTracking(data, args, p.getPrefix(clientConn)), false
+	}
+
+	// Connection flags name no keys or clients, so they skip any CLIENT handling
+	if command == "CLIENT" && len(args) > 1 && clientFlagSubcommands[strings.ToUpper(args[1])] {
+		return data, false
+	}
+
+	// Check if this is an AUTH command, or a HELLO authenticating like one. The
+	// prefix comes from the AUTH form of the credentials, which key scans replay.
+	auth := data
+	if command == "HELLO" {
+		auth = helloAuth(args)
+	}
+	if p.isAuthCommand(auth) {
+		if p.isPrefixBound(clientConn) {
+			// The certificate-derived prefix wins; AUTH only reaches the backend
+			p.markAuth(clientConn, &pendingAuth{command: auth})
+			return data, false
+		}
+		username := p.extractAuthUsername(auth)
+		if p.debugLogging() {
+			p.logf("Extracted username: %s", username)
+		}
+		prefix, source := "", ""
+		if p.PrefixResolver != nil {
+			resolved, err := p.PrefixResolver(username, p.extractAuthPassword(auth), clientConn.RemoteAddr())
+			if err != nil {
+				p.logf("Prefix resolver rejected AUTH from %s: %v", clientConn.RemoteAddr(), err)
+				return p.rejectCommand(clientConn, "ERR "+err.Error())
+			}
+			prefix, source = resolved, "resolved "
+		} else if username != "" {
+			prefix = p.authPrefix(username)
+		} else if password := p.extractAuthPassword(auth); password != "" {
+			// AUTH <password> authenticates Redis's default user and names no tenant
+			switch p.passwordAuth {
+			case passwordAuthReject:
+				p.logf("Rejected password-only AUTH from %s", clientConn.RemoteAddr())
+				return p.rejectCommand(clientConn, "ERR AUTH needs a username through the proxy, use AUTH <username> <password>")
+			case passwordAuthDefault:
+				p.logf("Keeping prefix '%s' for password-only AUTH from %s", p.getPrefix(clientConn), clientConn.RemoteAddr())
+			case passwordAuthPrefix:
+				prefix, source = password+":", "password-based "
+			}
+		}
+		// A full tenant is refused without troubling the backend; the prefix is
+		// only claimed once the backend accepts the credentials, see noteStateReply
+		if prefix != "" && p.tenantFull(clientConn, prefix) {
+			return p.answerCommand(clientConn, p.tenantLimitError(clientConn, prefix))
+		}
+		p.markAuth(clientConn, &pendingAuth{command: auth, prefix: prefix, source: source})
+		return data, false
+	}
+
+	if command != "" && p.unknownPolicy != unknownForward && isUnknownCommand(command) {
+		if p.unknownPolicy == unknownReject {
+			p.logf("Rejected unknown command %s from %s", command, clientConn.RemoteAddr())
+			return p.denyCommand(clientConn, denyBlocked, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		}
+		p.unknownSeen.observe(command)
+		p.logf("Forwarding unknown command %s from %s", command, clientConn.RemoteAddr())
+	}
+
+	// Any string may be stored gzipped, and these commands would read or write
+	// its compressed bytes
+	if p.compressMin > 0 && rawValueCommands[command] {
+		return p.rejectCommand(clientConn, fmt.Sprintf("ERR %s is not available while the proxy compresses values", command))
+	}
+
+	if p.typeCacheTTL > 0 {
+		if cached, ok := p.cachedTypeReply(clientConn, command, args); ok {
+			return p.answerCommand(clientConn, cached)
+		}
+	}
+
+	// Add prefix to keys for other commands
+	return p.compressValues(p.addPrefixToKeys(clientConn, data)), false
+}
+
+// handleProxyCommand answers PROXY subcommands locally
+func (p *RedisProxy) handleProxyCommand(clientConn net.Conn, args []string) ([]byte, bool) {
+	if len(args) == 2 && strings.ToUpper(args[1]) == "VERSION" {
+		return p.answerCommand(clientConn, []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(version), version)))
+	}
+	return p.rejectCommand(clientConn, "ERR unknown PROXY subcommand, try PROXY VERSION")
+}
+
+// alwaysPermittedCommands pass the command whitelist without being listed, so
+// clients can still authenticate, health check and disconnect
+var alwaysPermittedCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"PING":  true,
+	"QUIT":  true,
+}
+
+// parseCommandList parses a comma separated list of command names, returning
+// nil for an empty list
+func parseCommandList(list string) map[string]bool {
+	var commands map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if commands == nil {
+			commands = make(map[string]bool)
+		}
+		commands[name] = true
+	}
+	return commands
+}
+
+// parsePrefixList parses a comma separated list of tenant prefixes, adding the
+// trailing ':' where it is missing, and returns nil for an empty list
+func parsePrefixList(list string) map[string]bool {
+	var prefixes map[string]bool
+	for _, prefix := range strings.Split(list, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		if !strings.HasSuffix(prefix, ":") {
+			prefix += ":"
+		}
+		if prefixes == nil {
+			prefixes = make(map[string]bool)
+		}
+		prefixes[prefix] = true
+	}
+	return prefixes
+}
+
+// Password-only AUTH handling modes (REDIS_PASSWORD_AUTH)
+const (
+	passwordAuthReject  = "reject"          // Refuse AUTH <password>; clients must send a username
+	passwordAuthDefault = "default-prefix"  // Forward AUTH <password> and keep the connection's default prefix
+	passwordAuthPrefix  = "password-prefix" // Use the password as the prefix, keying tenants by a secret
+)
+
+// Handling of commands in no command table (REDIS_UNKNOWN_COMMAND)
+const (
+	unknownForward = "forward" // Forward them unchanged
+	unknownReject  = "reject"  // Answer them with an error
+	unknownLog     = "log"     // Forward them, logging and counting each command name
+)
+
+// isUnknownCommand reports whether command is in none of the command tables
+func isUnknownCommand(command string) bool {
+	return !keyCommands[command] && !noPrefixCommands[command] && !alwaysPermittedCommands[command]
+}
+
+// authPrefix derives the key prefix for an AUTH username, applying the
+// configured prefix template when one is set
+func (p *RedisProxy) authPrefix(username string) string {
+	if p.prefixTemplate == "" {
+		return username + ":"
+	}
+	return strings.ReplaceAll(p.prefixTemplate, "{user}", username)
+}
+
+// getPrefix returns the key prefix for a client connection: the tenant prefix,
+// scoped to the selected database in selectScope mode
+func (p *RedisProxy) getPrefix(clientConn net.Conn) string {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	if state, exists := p.conns[clientConn]; exists {
+		if p.selectMode == selectScope && state.db != 0 {
+			return fmt.Sprintf("%sdb%d:", state.prefix, state.db)
+		}
+		return state.prefix
+	}
+	return ""
+}
+
+// tenantPrefix returns the connection's prefix without any database scoping,
+// which is what identifies the tenant for routing and key counts
+func (p *RedisProxy) tenantPrefix(clientConn net.Conn) string {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	if state, exists := p.conns[clientConn]; exists {
+		return state.prefix
+	}
+	return ""
+}
+
+// SELECT handling modes (REDIS_SELECT_MODE)
+const (
+	selectPassThrough = "pass-through"      // Forward SELECT; the backend switches databases
+	selectScope       = "scope-into-prefix" // Answer SELECT locally and add "db<n>:" to the prefix
+	selectReject      = "reject"            // Refuse SELECT
+)
+
+// handleSelect applies the configured SELECT mode, tracking the selected database
+func (p *RedisProxy) handleSelect(clientConn net.Conn, args []string, data []byte) ([]byte, bool) {
+	if p.selectMode == selectReject {
+		return p.denyCommand(clientConn, denyBlocked, "ERR SELECT is not allowed through the proxy")
+	}
+	if len(args) != 2 {
+		return p.rejectCommand(clientConn, "ERR wrong number of arguments for 'select' command")
+	}
+	db, err := strconv.Atoi(args[1])
+	if err != nil || db < 0 {
+		return p.rejectCommand(clientConn, "ERR value is not an integer or out of range")
+	}
+
+	if p.selectMode == selectScope {
+		// The backend stays on its database; only the prefix changes
+		p.connMux.Lock()
+		if state, exists := p.conns[clientConn]; exists {
+			state.db = db
+		}
+		p.connMux.Unlock()
+		return p.answerCommand(clientConn, []byte("+OK\r\n"))
+	}
+	// The database is tracked once the backend accepts it, see noteStateReply
+	p.markSelect(clientConn, db)
+	return data, false
+}
+
+// answerCommand answers the command just read with reply instead of forwarding it
+func (p *RedisProxy) answerCommand(clientConn net.Conn, reply []byte) ([]byte, bool) {
+	p.untrackCommand(clientConn)
+	return reply, true
+}
+
+// rejectCommand answers the command just read with an error instead of forwarding it
+func (p *RedisProxy) rejectCommand(clientConn net.Conn, message string) ([]byte, bool) {
+	return p.answerCommand(clientConn, p.createErrorResponse(message))
+}
+
+// denyCommand rejects the command just read for a policy reason, counting the
+// denial for the connection's tenant
+func (p *RedisProxy) denyCommand(clientConn net.Conn, reason, message string) ([]byte, bool) {
+	p.denied.observe(p.tenantPrefix(clientConn), reason)
+	return p.rejectCommand(clientConn, message)
+}
+
+// tenantLimitError logs and counts an AUTH refused because prefix's tenant is
+// full, returning the error for the client
+func (p *RedisProxy) tenantLimitError(clientConn net.Conn, prefix string) []byte {
+	p.logf("Tenant '%s' is at its connection limit, rejecting AUTH from %s", prefix, clientConn.RemoteAddr())
+	p.denied.observe(prefix, denyLimit)
+	return p.createErrorResponse("ERR tenant connection limit reached")
+}
+
+// isPrefixBound reports whether the connection's prefix is fixed by its client certificate
+func (p *RedisProxy) isPrefixBound(clientConn net.Conn) bool {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	state, exists := p.conns[clientConn]
+	return exists && state.prefixBound
+}
+
+// claimPrefix moves a client connection to prefix, counting it against the
+// tenant's connections. It returns false, leaving the connection as it was,
+// when the tenant already holds tenantMaxConns connections. Only prefixes from
+// AUTH, the resolver or a certificate are claimed; default prefixes aren't.
+func (p *RedisProxy) claimPrefix(clientConn net.Conn, prefix string) bool {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists {
+		state = &connState{}
+		p.conns[clientConn] = state
+	}
+	if state.counted && state.prefix == prefix {
+		return true
+	}
+	if p.tenantFullLocked(state, prefix) {
+		return false
+	}
+	p.releasePrefixLocked(state)
+	if p.tenantConns == nil {
+		p.tenantConns = make(map[string]int)
+	}
+	p.tenantConns[prefix]++
+	state.prefix, state.counted = prefix, true
+	return true
+}
+
+// tenantFull reports whether prefix's tenant has no room for the connection
+func (p *RedisProxy) tenantFull(clientConn net.Conn, prefix string) bool {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	state, exists := p.conns[clientConn]
+	if !exists {
+		state = &connState{}
+	}
+	return p.tenantFullLocked(state, prefix)
+}
+
+// tenantFullLocked reports whether the tenant of prefix already holds
+// tenantMaxConns connections other than state's. The caller must hold connMux.
+func (p *RedisProxy) tenantFullLocked(state *connState, prefix string) bool {
+	if state.counted && state.prefix == prefix {
+		return false
+	}
+	return p.tenantMaxConns > 0 && p.tenantConns[prefix] >= p.tenantMaxConns
+}
+
+// releasePrefixLocked stops counting a connection against its tenant. The
+// caller must hold connMux.
+func (p *RedisProxy) releasePrefixLocked(state *connState) {
+	if !state.counted {
+		return
+	}
+	state.counted = false
+	if p.tenantConns[state.prefix]--; p.tenantConns[state.prefix] <= 0 {
+		delete(p.tenantConns, state.prefix)
+	}
+}
+
+// setPrefix sets the key prefix for a client connection
+func (p *RedisProxy) setPrefix(clientConn net.Conn, prefix string) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists {
+		state.prefix = prefix
+	} else {
+		p.conns[clientConn] = &connState{prefix: prefix}
+	}
+}
+
+// setAuth remembers the AUTH command forwarded for a client connection
+func (p *RedisProxy) setAuth(clientConn net.Conn, auth []byte) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists {
+		state.auth = auth
+	}
+}
+
+// isAuthenticated reports whether the backend accepted an AUTH on the connection
+// or it has a prefix from its client certificate
+func (p *RedisProxy) isAuthenticated(clientConn net.Conn) bool {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	state, exists := p.conns[clientConn]
+	return exists && (state.authenticated || state.prefixBound)
+}
+
+// awaitPendingAuth waits for the reply to an AUTH read before the command seq,
+// as Redis would have answered the AUTH before reading the command, so the
+// command sees the prefix and authentication that reply settles. It returns
+// false if the connection goes away meanwhile.
+func (p *RedisProxy) awaitPendingAuth(clientConn net.Conn, seq uint64) bool {
+	p.connMux.RLock()
+	authPending := false
+	if state, exists := p.conns[clientConn]; exists {
+		for _, cmd := range state.pending {
+			authPending = authPending || (cmd.auth != nil && cmd.seq < seq)
+		}
+	}
+	p.connMux.RUnlock()
+	return !authPending || p.waitForEarlierReplies(clientConn, seq)
+}
+
+// routingPrefix returns the prefix choosing a connection's backend: the one an
+// AUTH awaiting its reply names, as that reply comes from the backend, or else
+// the tenant prefix
+func (p *RedisProxy) routingPrefix(clientConn net.Conn) string {
+	p.connMux.RLock()
+	if state, exists := p.conns[clientConn]; exists {
+		for _, cmd := range state.pending {
+			if cmd.auth != nil && cmd.auth.prefix != "" {
+				p.connMux.RUnlock()
+				return cmd.auth.prefix
+			}
+		}
+	}
+	p.connMux.RUnlock()
+	return p.tenantPrefix(clientConn)
+}
+
+// markAuth attaches auth to the AUTH command just read
+func (p *RedisProxy) markAuth(clientConn net.Conn, auth *pendingAuth) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists && len(state.pending) > 0 {
+		state.pending[len(state.pending)-1].auth = auth
+	}
+}
+
+// noteStateReply applies what the backend's reply to the AUTH, HELLO ... AUTH
+// or SELECT at the head of the pending commands settles, and returns the reply to send on. An
+// accepted AUTH claims its prefix, or is answered with the tenant limit error
+// when another connection took the last slot meanwhile; a refused one leaves
+// the connection unauthenticated on its previous prefix. It runs before the
+// command completes, so a command waiting in awaitPendingAuth or
+// waitForEarlierReplies sees the outcome.
+func (p *RedisProxy) noteStateReply(clientConn net.Conn, state *connState, data []byte) []byte {
+	p.connMux.Lock()
+	if len(state.pending) == 0 {
+		p.connMux.Unlock()
+		return data
+	}
+	head := state.pending[0]
+	accepted := string(data) == "+OK\r\n"
+	if head.command == "HELLO" {
+		// HELLO answers with the server's properties unless it fails
+		accepted = len(data) > 0 && data[0] != '-' && data[0] != '!'
+	}
+	if head.command == "SELECT" && accepted {
+		state.db = head.db
+	}
+	if head.command == "HELLO" && accepted {
+		// HELLO answers in the protocol it switched to, a map only under RESP3
+		state.resp3 = data[0] == '%'
+	}
+	if head.auth != nil {
+		state.authenticated = false
+	}
+	p.connMux.Unlock()
+	if head.auth == nil || !accepted {
+		return data
+	}
+
+	if head.auth.prefix != "" {
+		if !p.claimPrefix(clientConn, head.auth.prefix) {
+			return p.tenantLimitError(clientConn, head.auth.prefix)
+		}
+		p.logf("Set %sprefix '%s' for connection %s", head.auth.source, head.auth.prefix, clientConn.RemoteAddr())
+	}
+	p.setAuth(clientConn, head.auth.command)
+	p.seedKeyCount(clientConn, head.auth.command)
+	p.connMux.Lock()
+	state.authenticated = true
+	p.connMux.Unlock()
+	return data
+}
+
+// connAuth returns the AUTH command last forwarded for a client connection, nil if none
+func (p *RedisProxy) connAuth(clientConn net.Conn) []byte {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	if state, exists := p.conns[clientConn]; exists {
+		return state.auth
+	}
+	return nil
+}
+
+// connDB returns the logical database the connection last chose with SELECT
+func (p *RedisProxy) connDB(clientConn net.Conn) int {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	if state, exists := p.conns[clientConn]; exists {
+		return state.db
+	}
+	return 0
+}
+
+// trackCommand records a command read from the client and queues it until its reply
+// arrives, returning the command's per-connection sequence number
+func (p *RedisProxy) trackCommand(clientConn net.Conn, command string, replies int, blocking bool) uint64 {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists {
+		state = &connState{}
+		p.conns[clientConn] = state
+	}
+	state.seq++
+	state.pending = append(state.pending, pendingCommand{seq: state.seq, command: command, replies: replies, blocking: blocking, sent: time.Now()})
+	return state.seq
+}
+
+// typeCache holds a connection's reusable TYPE and OBJECT ENCODING replies by
+// typeCacheKey
+type typeCache map[string]typeCacheEntry
+
+// typeCacheEntry is a cached reply and when it stops being reused
+type typeCacheEntry struct {
+	reply   []byte
+	expires time.Time
+}
+
+// typeCacheFlushCommands may change what every key of the connection refers
+// to, so they drop its whole type cache
+var typeCacheFlushCommands = map[string]bool{
+	"AUTH": true, "HELLO": true, "SELECT": true, "SWAPDB": true, "RESET": true,
+	"FLUSHDB": true, "FLUSHALL": true,
+}
+
+// typeCacheKey returns the type cache entry for a TYPE or OBJECT ENCODING
+// command, or "" for any other command
+func typeCacheKey(command string, args []string) string {
+	switch {
+	case command == "TYPE" && len(args) == 2:
+		return "TYPE " + args[1]
+	case command == "OBJECT" && len(args) == 3 && strings.ToUpper(args[1]) == "ENCODING":
+		return "OBJECT ENCODING " + args[2]
+	}
+	return ""
+}
+
+// invalidateTypeCache drops the cached replies a command may make stale. The
+// proxy doesn't tell reads from writes, so any command naming a key drops that
+// key's entries, including the reply of a lookup still in flight. Writes from
+// other connections are only bounded by typeCacheTTL.
+func (p *RedisProxy) invalidateTypeCache(clientConn net.Conn, command string, args []string) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists {
+		return
+	}
+	switch command {
+	case "MULTI":
+		state.multi = true
+	case "EXEC", "DISCARD", "RESET":
+		state.multi = false
+	}
+
+	flush := typeCacheFlushCommands[command]
+	if !flush && typeCacheKey(command, args) != "" {
+		return
+	}
+	named := make(map[string]bool, 2*(len(args)-1))
+	for _, arg := range args[1:] {
+		named["TYPE "+arg] = true
+		named["OBJECT ENCODING "+arg] = true
+	}
+	for cacheKey := range state.keyTypes {
+		if flush || named[cacheKey] {
+			delete(state.keyTypes, cacheKey)
+		}
+	}
+	for i := range state.pending {
+		if cacheKey := state.pending[i].cacheKey; cacheKey != "" && (flush || named[cacheKey]) {
+			state.pending[i].cacheKey = ""
+		}
 	}
 }
 
-// readSimpleString reads a simple string (status or error) with improved line ending handling
-func (p *RedisProxy) readSimpleString(reader *bufio.Reader, firstByte byte) ([]byte, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// cachedTypeReply returns the cached reply for a TYPE or OBJECT ENCODING
+// command that hasn't expired. On a miss the forwarded command is marked so
+// its reply fills the cache; inside MULTI it is neither answered nor cached.
+func (p *RedisProxy) cachedTypeReply(clientConn net.Conn, command string, args []string) ([]byte, bool) {
+	cacheKey := typeCacheKey(command, args)
+	if cacheKey == "" {
+		return nil, false
 	}
-
-	// Normalize line endings to \r\n
-	if !strings.HasSuffix(line, "\r\n") {
-		line = strings.TrimSuffix(line, "\n") + "\r\n"
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists || state.multi || len(state.pending) == 0 {
+		return nil, false
 	}
-
-	return append([]byte{firstByte}, []byte(line)...), nil
+	if entry, ok := state.keyTypes[cacheKey]; ok && time.Now().Before(entry.expires) {
+		return entry.reply, true
+	}
+	state.pending[len(state.pending)-1].cacheKey = cacheKey
+	return nil, false
 }
 
-// readInteger reads an integer with improved line ending handling
-func (p *RedisProxy) readInteger(reader *bufio.Reader, firstByte byte) ([]byte, error) {
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// markSetNX flags the command just read as a SET ... NX for the key counts
+func (p *RedisProxy) markSetNX(clientConn net.Conn) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists && len(state.pending) > 0 {
+		state.pending[len(state.pending)-1].setNX = true
 	}
+}
 
-	// Normalize line endings to \r\n
-	if !strings.HasSuffix(line, "\r\n") {
-		line = strings.TrimSuffix(line, "\n") + "\r\n"
+// markSelect records the database the SELECT just read moves to
+func (p *RedisProxy) markSelect(clientConn net.Conn, db int) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists && len(state.pending) > 0 {
+		state.pending[len(state.pending)-1].db = db
 	}
-
-	return append([]byte{firstByte}, []byte(line)...), nil
 }
 
-// readBulkString reads a bulk string with improved error handling
-func (p *RedisProxy) readBulkString(reader *bufio.Reader, firstByte byte) ([]byte, error) {
-	// Read length
-	lengthLine, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// storeTypeReply caches the server's reply to a TYPE or OBJECT ENCODING
+// command; errors are never cached
+func (p *RedisProxy) storeTypeReply(clientConn net.Conn, cacheKey string, data []byte) {
+	if len(data) == 0 || data[0] == '-' {
+		return
 	}
-
-	// Normalize line endings
-	if !strings.HasSuffix(lengthLine, "\r\n") {
-		lengthLine = strings.TrimSuffix(lengthLine, "\n") + "\r\n"
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists {
+		return
 	}
-
-	result := append([]byte{firstByte}, []byte(lengthLine)...)
-
-	// Parse length
-	lengthStr := strings.TrimSpace(lengthLine)
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid bulk string length: %s", lengthStr)
+	if state.keyTypes == nil {
+		state.keyTypes = make(typeCache)
 	}
+	state.keyTypes[cacheKey] = typeCacheEntry{reply: bytes.Clone(data), expires: time.Now().Add(p.typeCacheTTL)}
+}
 
-	if length == -1 {
-		// Null bulk string
-		return result, nil
+// expectedReplies returns how many replies the server sends for a command:
+// subscribe commands get one confirmation per channel, everything else one reply.
+// An argument-less (P)UNSUBSCRIBE is confirmed once per current subscription,
+// which is only known when its first confirmation arrives, so it returns 0.
+func expectedReplies(command string, args []string) int {
+	if pubsubCommands[command] && len(args) > 1 {
+		return len(args) - 1
 	}
-
-	// Read the actual string
-	data := make([]byte, length)
-	_, err = io.ReadFull(reader, data)
-	if err != nil {
-		return nil, err
+	if command == "UNSUBSCRIBE" || command == "PUNSUBSCRIBE" {
+		return 0
 	}
+	return 1
+}
 
-	// Read the trailing \r\n
-	crlf := make([]byte, 2)
-	_, err = io.ReadFull(reader, crlf)
-	if err != nil {
-		return nil, err
+// untrackCommand drops the most recently tracked command, which the proxy
+// answered itself so no server reply will arrive for it
+func (p *RedisProxy) untrackCommand(clientConn net.Conn) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	if state, exists := p.conns[clientConn]; exists && len(state.pending) > 0 {
+		state.pending = state.pending[:len(state.pending)-1]
 	}
+}
 
-	return append(result, append(data, crlf...)...), nil
+// lookupState returns the state of a client connection, or nil once it's gone
+func (p *RedisProxy) lookupState(clientConn net.Conn) *connState {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	return p.conns[clientConn]
 }
 
-// readArray reads an array with improved error handling
-func (p *RedisProxy) readArray(reader *bufio.Reader, firstByte byte) ([]byte, error) {
-	// Read array length
-	lengthLine, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, err
+// completeCommand accounts for one reply to the oldest pending command, removing
+// the command once all its replies have arrived
+func (p *RedisProxy) completeCommand(clientConn net.Conn) (pendingCommand, bool) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	state, exists := p.conns[clientConn]
+	if !exists || len(state.pending) == 0 {
+		return pendingCommand{}, false
 	}
-
-	// Normalize line endings
-	if !strings.HasSuffix(lengthLine, "\r\n") {
-		lengthLine = strings.TrimSuffix(lengthLine, "\n") + "\r\n"
+	cmd := state.pending[0]
+	if cmd.replies > 1 {
+		// More replies to come: keep the command and hold its queued proxy replies
+		state.pending[0].replies--
+		cmd.after = nil
+		return cmd, true
 	}
+	state.pending = state.pending[1:]
+	p.signalDrained()
+	return cmd, true
+}
 
-	result := append([]byte{firstByte}, []byte(lengthLine)...)
+// pubsubCommands change a connection's subscriptions and are confirmed with
+// one reply per channel or pattern
+var pubsubCommands = map[string]bool{
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+}
 
-	// Parse length
-	lengthStr := strings.TrimSpace(lengthLine)
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid array length: %s", lengthStr)
-	}
+// subscribeModeCommands are the only commands Redis accepts from a subscribed connection
+var subscribeModeCommands = map[string]bool{
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"PING": true, "QUIT": true, "RESET": true,
+}
 
-	if length == -1 {
-		// Null array
-		return result, nil
+// inSubscribeMode reports whether a connection is in RESP2 subscribe mode, or
+// is about to be because a subscribe command is still awaiting confirmation.
+// Under RESP3 a subscribed connection may run any command and its pub/sub
+// traffic comes as pushes, so it never is.
+func (p *RedisProxy) inSubscribeMode(clientConn net.Conn) bool {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	state, exists := p.conns[clientConn]
+	if !exists || state.resp3 {
+		return false
 	}
-
-	// Read each element
-	for i := 0; i < length; i++ {
-		element, err := p.readRESP(reader)
-		if err != nil {
-			return nil, err
+	if state.subscriptions > 0 {
+		return true
+	}
+	for _, cmd := range state.pending {
+		if cmd.command == "SUBSCRIBE" || cmd.command == "PSUBSCRIBE" {
+			return true
 		}
-		result = append(result, element...)
 	}
-
-	return result, nil
+	return false
 }
 
-// handleUnknownProtocol attempts to handle unknown protocol data gracefully
-func (p *RedisProxy) handleUnknownProtocol(reader *bufio.Reader, firstByte byte) ([]byte, error) {
-	// Try to read a line to see if this is some kind of text-based protocol
-	line, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, fmt.Errorf("failed to read unknown protocol data: %v", err)
+// updateSubscriptions applies a subscription confirmation to state. The caller
+// must hold connMux. The first confirmation of an unsubscribe-all settles how
+// many confirmations it gets: one per channel (or pattern) still subscribed.
+func (p *RedisProxy) updateSubscriptions(state *connState, kind string, count int64) {
+	isPattern := kind == "psubscribe" || kind == "punsubscribe"
+	if len(state.pending) > 0 && state.pending[0].replies == 0 {
+		remaining := state.channels
+		if isPattern {
+			remaining = state.patterns
+		}
+		state.pending[0].replies = int(max(remaining, 1))
 	}
 
-	log.Printf("Unknown protocol data: %c%s", firstByte, line)
+	delta := count - state.subscriptions
+	if isPattern {
+		state.patterns += delta
+	} else {
+		state.channels += delta
+	}
+	state.subscriptions = count
+}
 
-	// If this looks like a text-based protocol, try to forward it as-is
-	// This might be some kind of protocol negotiation or handshake
-	data := append([]byte{firstByte}, []byte(line)...)
+// resetConnState forgets what RESET discards on the server: the connection's
+// subscriptions, selected database and protocol
+func resetConnState(state *connState) {
+	state.subscriptions = 0
+	state.channels = 0
+	state.patterns = 0
+	state.db = 0
+	state.resp3 = false
+	state.authenticated = false // RESET switches back to the default user
+}
 
-	// Try to read more data until we find a valid RESP type or connection ends
-	for {
-		// Peek at the next byte
-		peekBytes, err := reader.Peek(1)
-		if err != nil {
-			break
+// stripPubSubReply removes the prefix from the channel (and pattern) names in a
+// subscription confirmation or published message, and from the keys of a
+// client-side caching invalidation. A RESP3 push stays a push.
+func (p *RedisProxy) stripPubSubReply(data []byte, prefix string) []byte {
+	val, _, err := p.parseRESP(data)
+	if err != nil {
+		return data
+	}
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) < 2 {
+		return data
+	}
+	kind, _ := arr[0].(string)
+	if strings.ToLower(kind) == "invalidate" {
+		// RESP3 sends invalidations in band, with the keys right after the kind
+		if keys, ok := arr[1].([]interface{}); ok {
+			return p.stripInvalidation(data[0], arr, 1, keys, prefix)
 		}
-
-		nextByte := peekBytes[0]
-		if nextByte == '+' || nextByte == '-' || nextByte == ':' || nextByte == '$' || nextByte == '*' {
-			// Found a valid RESP type, stop here
-			log.Printf("Found valid RESP type after unknown protocol data: %c", nextByte)
-			break
+		return data
+	}
+	if len(arr) < 3 {
+		return data
+	}
+	if keys, ok := arr[2].([]interface{}); ok && strings.ToLower(kind) == "message" && arr[1] == invalidateChannel {
+		return p.stripInvalidation(data[0], arr, 2, keys, prefix)
+	}
+	names := 1 // Confirmations and messages carry a single channel name
+	if strings.ToLower(kind) == "pmessage" {
+		names = 2 // Pattern, then the channel it matched
+	}
+	for i := 1; i <= names; i++ {
+		if name, ok := arr[i].(string); ok {
+			arr[i] = strings.TrimPrefix(name, prefix)
 		}
+	}
+	return p.buildPubSubReply(data[0], arr)
+}
 
-		// Read and forward this byte
-		b, err := reader.ReadByte()
-		if err != nil {
-			break
+// stripInvalidation unprefixes the keys at arr[index] of a client-side caching
+// invalidation and drops other tenants' keys, dropping the whole message when
+// none are left. A flush invalidation carries no key list and is never passed here.
+func (p *RedisProxy) stripInvalidation(frame byte, arr []interface{}, index int, keys []interface{}, prefix string) []byte {
+	var own []interface{}
+	for _, key := range keys {
+		if name, ok := key.(string); ok && strings.HasPrefix(name, prefix) {
+			own = append(own, strings.TrimPrefix(name, prefix))
 		}
-		data = append(data, b)
 	}
+	if len(own) == 0 {
+		return nil
+	}
+	arr[index] = own
+	return p.buildPubSubReply(frame, arr)
+}
 
-	return data, nil
+// buildPubSubReply encodes arr as a RESP2 array or, when frame is '>', a RESP3 push
+func (p *RedisProxy) buildPubSubReply(frame byte, arr []interface{}) []byte {
+	out := p.buildRESPArray(arr)
+	out[0] = frame
+	return out
 }
 
-// processClientCommand processes client commands, handling AUTH and adding prefixes
-func (p *RedisProxy) processClientCommand(clientConn net.Conn, data []byte) []byte {
-	// Parse command for tracking
-	args, _ := p.parseRESPArray(data)
-	if len(args) > 0 {
-		cmd := strings.ToUpper(args[0])
-		p.lastCmdMux.Lock()
-		p.lastCommand[clientConn] = cmd
-		p.lastCmdMux.Unlock()
+// parsePubSubReply recognizes pub/sub replies, returning their kind ("subscribe",
+// "message", ...) and, for subscription confirmations, the reported subscription count
+func (p *RedisProxy) parsePubSubReply(data []byte) (kind string, count int64, ok bool) {
+	if len(data) == 0 || (data[0] != '*' && data[0] != '>') {
+		return "", 0, false
 	}
-	// Check if this is a blocked command
-	log.Printf("Processing client command: %q", data)
-	if p.isBlockedCommand(data) {
-		log.Printf("Blocked command from %s", clientConn.RemoteAddr())
-		return p.createErrorResponse("ERR Command not allowed")
-	}
-
-	// Check if this is an AUTH command
-	if p.isAuthCommand(data) {
-		username := p.extractAuthUsername(data)
-		log.Printf("Extracted username: %s", username)
-		if username != "" {
-			prefix := username + ":"
-			p.prefixMux.Lock()
-			p.prefixes[clientConn] = prefix
-			p.prefixMux.Unlock()
-			log.Printf("Set prefix '%s' for connection %s", prefix, clientConn.RemoteAddr())
-		} else {
-			// If no username found, try to use a default prefix or the password
-			password := p.extractAuthPassword(data)
-			if password != "" {
-				prefix := password + ":"
-				p.prefixMux.Lock()
-				p.prefixes[clientConn] = prefix
-				p.prefixMux.Unlock()
-				log.Printf("Set password-based prefix '%s' for connection %s", prefix, clientConn.RemoteAddr())
-			}
-		}
-		return data
+	val, _, err := p.parseRESP(data)
+	if err != nil {
+		return "", 0, false
+	}
+	arr, isArr := val.([]interface{})
+	if !isArr || len(arr) < 2 {
+		return "", 0, false
 	}
+	kind, _ = arr[0].(string)
+	switch kind = strings.ToLower(kind); {
+	case subscriptionReplies[kind] && len(arr) >= 3:
+		count, ok = arr[2].(int64)
+		return kind, count, ok
+	case (kind == "message" || kind == "pmessage") && len(arr) >= 3:
+		return kind, 0, true
+	case kind == "invalidate" && data[0] == '>':
+		// RESP3 delivers client-side caching invalidations in band
+		return kind, 0, true
+	}
+	return "", 0, false
+}
 
-	// Add prefix to keys for other commands
-	return p.addPrefixToKeys(clientConn, data)
+// subscriptionReplies are the pub/sub reply kinds confirming a (P)SUBSCRIBE or
+// (P)UNSUBSCRIBE, which answer the command rather than being pushed
+var subscriptionReplies = map[string]bool{
+	"subscribe": true, "unsubscribe": true, "psubscribe": true, "punsubscribe": true,
+}
+
+// isPush reports whether data is a RESP3 push, which never answers a command
+// unless it confirms a subscription
+func isPush(data []byte) bool {
+	return len(data) > 0 && data[0] == '>'
 }
 
 // isBlockedCommand checks if the command is in the blocked commands list
@@ -449,6 +3685,17 @@ func (p *RedisProxy) isAuthCommand(data []byte) bool {
 	return command == "AUTH"
 }
 
+// helloAuth returns the AUTH command equivalent to the credentials of a
+// HELLO <protover> AUTH <username> <password> command, nil if it has none
+func helloAuth(args []string) []byte {
+	for i := 2; i+2 < len(args); i++ {
+		if strings.ToUpper(args[i]) == "AUTH" {
+			return RESPCodec{}.Encode([]string{"AUTH", args[i+1], args[i+2]})
+		}
+	}
+	return nil
+}
+
 // extractAuthUsername extracts the username from an AUTH command with proper RESP parsing
 func (p *RedisProxy) extractAuthUsername(data []byte) string {
 	args, err := p.parseRESPArray(data)
@@ -492,40 +3739,70 @@ func (p *RedisProxy) extractAuthPassword(data []byte) string {
 
 // parseRESPArray parses a RESP array and returns the arguments as strings
 func (p *RedisProxy) parseRESPArray(data []byte) ([]string, error) {
+	args, _, err := p.parseRESPArgs(data)
+	return args, err
+}
+
+// parseRESPArgs parses a RESP array like parseRESPArray and also reports
+// whether any element was an integer rather than a bulk string. Integers are
+// returned in their decimal string form.
+func (p *RedisProxy) parseRESPArgs(data []byte) (args []string, integers bool, err error) {
 	if len(data) == 0 || data[0] != '*' {
-		return nil, fmt.Errorf("not a RESP array")
+		return nil, false, fmt.Errorf("not a RESP array")
 	}
 
 	// Find the first \r\n to get the array length
 	crlfIndex := bytes.Index(data, []byte("\r\n"))
 	if crlfIndex == -1 {
-		return nil, fmt.Errorf("invalid RESP array format")
+		return nil, false, fmt.Errorf("invalid RESP array format")
 	}
 
 	// Parse array length
 	lengthStr := string(data[1:crlfIndex])
 	length, err := strconv.Atoi(lengthStr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid array length: %s", lengthStr)
+		return nil, false, fmt.Errorf("invalid array length: %s", lengthStr)
+	}
+	if length < 0 {
+		return nil, false, fmt.Errorf("invalid array length: %s", lengthStr)
+	}
+	if p.maxArgs > 0 && length > p.maxArgs {
+		return nil, false, fmt.Errorf("%w: array of %d exceeds %d", errTooManyArgs, length, p.maxArgs)
 	}
 
-	args := make([]string, 0, length)
+	args = make([]string, 0, length)
 	pos := crlfIndex + 2 // Skip past \r\n
 
 	// Parse each element in the array
 	for i := 0; i < length; i++ {
 		if pos >= len(data) {
-			return nil, fmt.Errorf("unexpected end of data")
+			return nil, false, fmt.Errorf("unexpected end of data")
 		}
 
+		if data[pos] == ':' {
+			// Keys are bulk strings on the wire, but some clients send numbers as
+			// integers; take their string form so they can be prefixed
+			crlfIndex = bytes.Index(data[pos:], []byte("\r\n"))
+			if crlfIndex == -1 {
+				return nil, false, fmt.Errorf("invalid integer format")
+			}
+			n, err := strconv.ParseInt(string(data[pos+1:pos+crlfIndex]), 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid integer: %s", data[pos+1:pos+crlfIndex])
+			}
+			args = append(args, strconv.FormatInt(n, 10))
+			integers = true
+			pos += crlfIndex + 2
+			continue
+		}
 		if data[pos] != '$' {
-			return nil, fmt.Errorf("expected bulk string, got %c", data[pos])
+			return nil, false, fmt.Errorf("expected bulk string, got %c", data[pos])
 		}
 
 		// Find the \r\n after the length
 		crlfIndex = bytes.Index(data[pos:], []byte("\r\n"))
 		if crlfIndex == -1 {
-			return nil, fmt.Errorf("invalid bulk string format")
+			return nil, false, fmt.Errorf("invalid bulk string format")
 		}
 		crlfIndex += pos
 
@@ -533,14 +3810,14 @@ func (p *RedisProxy) parseRESPArray(data []byte) ([]string, error) {
 		strLengthStr := string(data[pos+1 : crlfIndex])
 		strLength, err := strconv.Atoi(strLengthStr)
 		if err != nil {
-			return nil, fmt.Errorf("invalid string length: %s", strLengthStr)
+			return nil, false, fmt.Errorf("invalid string length: %s", strLengthStr)
 		}
 
 		pos = crlfIndex + 2 // Skip past \r\n
 
 		// Read the string content
 		if pos+strLength+2 > len(data) {
-			return nil, fmt.Errorf("string content exceeds data length")
+			return nil, false, fmt.Errorf("string content exceeds data length")
 		}
 
 		arg := string(data[pos : pos+strLength])
@@ -549,16 +3826,16 @@ func (p *RedisProxy) parseRESPArray(data []byte) ([]string, error) {
 		pos += strLength + 2 // Skip past string content and \r\n
 	}
 
-	return args, nil
+	return args, integers, nil
 }
 
-// parseRESP recursively parses a RESP value and returns it as interface{} (string or []interface{})
+// parseRESP recursively parses a RESP value and returns it as interface{} (string, int64, nil or []interface{})
 func (p *RedisProxy) parseRESP(data []byte) (interface{}, int, error) {
 	if len(data) == 0 {
 		return nil, 0, fmt.Errorf("empty data")
 	}
 	switch data[0] {
-	case '*': // Array
+	case '*', '>': // Array, or a RESP3 push framed like one
 		// Find array length
 		crlf := bytes.Index(data, []byte("\r\n"))
 		if crlf == -1 {
@@ -568,6 +3845,9 @@ func (p *RedisProxy) parseRESP(data []byte) (interface{}, int, error) {
 		if err != nil {
 			return nil, 0, fmt.Errorf("invalid array length")
 		}
+		if length < 0 {
+			return nil, crlf + 2, nil // Null array, e.g. a BLPOP timeout
+		}
 		arr := make([]interface{}, 0, length)
 		pos := crlf + 2
 		for i := 0; i < length; i++ {
@@ -579,6 +3859,16 @@ func (p *RedisProxy) parseRESP(data []byte) (interface{}, int, error) {
 			pos += n
 		}
 		return arr, pos, nil
+	case ':': // Integer
+		crlf := bytes.Index(data, []byte("\r\n"))
+		if crlf == -1 {
+			return nil, 0, fmt.Errorf("invalid integer")
+		}
+		n, err := strconv.ParseInt(string(data[1:crlf]), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid integer")
+		}
+		return n, crlf + 2, nil
 	case '$': // Bulk string
 		crlf := bytes.Index(data, []byte("\r\n"))
 		if crlf == -1 {
@@ -596,174 +3886,440 @@ func (p *RedisProxy) parseRESP(data []byte) (interface{}, int, error) {
 		if end+2 > len(data) {
 			return nil, 0, fmt.Errorf("bulk string out of bounds")
 		}
-		str := string(data[start:end])
-		return str, end + 2, nil
-	default:
-		return nil, 0, fmt.Errorf("unsupported RESP type: %c", data[0])
+		str := string(data[start:end])
+		return str, end + 2, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported RESP type: %c", data[0])
+	}
+}
+
+// buildRESPArray builds a RESP array from []interface{} (strings, int64s, nils or []interface{})
+func (p *RedisProxy) buildRESPArray(arr []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(arr)))
+	for _, v := range arr {
+		switch vv := v.(type) {
+		case nil:
+			buf.WriteString("$-1\r\n")
+		case int64:
+			buf.WriteString(fmt.Sprintf(":%d\r\n", vv))
+		case string:
+			buf.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(vv), vv))
+		case []interface{}:
+			buf.Write(p.buildRESPArray(vv))
+		}
+	}
+	return buf.Bytes()
+}
+
+// addPrefixToKeys adds the configured prefix to Redis keys in commands with proper RESP parsing
+func (p *RedisProxy) addPrefixToKeys(clientConn net.Conn, data []byte) []byte {
+	// Get prefix for this connection
+	prefix := p.getPrefix(clientConn)
+
+	if prefix == "" && p.KeyRewriter == nil {
+		return data
+	}
+
+	// Only process arrays (commands)
+	if len(data) == 0 || data[0] != '*' {
+		return data
+	}
+
+	// Parse the RESP array to get the command and arguments
+	args, err := p.parseRESPArray(data)
+	if err != nil {
+		return data
+	}
+
+	if len(args) == 0 {
+		return data
+	}
+
+	command := strings.ToUpper(args[0])
+
+	// Check if this is a key command
+	if !keyCommands[command] {
+		return data
+	}
+
+	if noPrefixCommands[command] {
+		return data
+	}
+
+	// Commands whose key position depends on the subcommand
+	if len(args) > 1 {
+		if keyIndex, ok := subcommandKeys[command+" "+strings.ToUpper(args[1])]; ok {
+			return p.addPrefixToSingleKeyRESP(data, args, prefix, keyIndex)
+		}
+	}
+
+	// Commands whose keys aren't just the first argument have a handler
+	if handler, ok := keyHandlers[command]; ok {
+		return handler(p, clientConn, data, args, prefix)
+	}
+	// For most commands, prefix the first key argument. Counted so commands
+	// that really need a handler can be spotted.
+	if p.defaultKeyed.observe(command) {
+		p.logf("Command %s uses the default single-key prefixing", command)
+	}
+	return p.addPrefixToSingleKeyRESP(data, args, prefix, 1)
+}
+
+// keyHandler rewrites the keys of one command, already parsed into args
+type keyHandler func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte
+
+// keysFrom prefixes every argument from start on
+func keysFrom(start int) keyHandler {
+	return func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToMultipleKeysRESP(data, args, prefix, start)
+	}
+}
+
+// keyAt prefixes the single key at index
+func keyAt(index int) keyHandler {
+	return func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToSingleKeyRESP(data, args, prefix, index)
+	}
+}
+
+// numKeysAt prefixes the keys counted by the numkeys argument at index
+func numKeysAt(index int) keyHandler {
+	return func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToNumKeysRESP(data, args, prefix, index)
+	}
+}
+
+// keyHandlers maps the commands whose keys aren't just the first argument to
+// their handler. addPrefixToKeys dispatches through it, so it is exactly the
+// set of dedicated handlers checkCommandTables checks.
+var keyHandlers = map[string]keyHandler{
+	// Every argument is a key
+	"MGET": keysFrom(1), "DEL": keysFrom(1), "UNLINK": keysFrom(1),
+	"EXISTS": keysFrom(1), "TOUCH": keysFrom(1), "WATCH": keysFrom(1),
+	// Set operations with multiple keys
+	"SINTER": keysFrom(1), "SUNION": keysFrom(1), "SDIFF": keysFrom(1),
+	"SINTERSTORE": keysFrom(1), "SUNIONSTORE": keysFrom(1), "SDIFFSTORE": keysFrom(1),
+	// BITOP operation destination key + source keys
+	"BITOP": keysFrom(1),
+	// HyperLogLog merge with multiple keys
+	"PFMERGE": keysFrom(1),
+	// Stream read operations with multiple streams
+	"XREAD": keysFrom(1), "XREADGROUP": keysFrom(1),
+	// RENAME and RENAMENX take two keys
+	"RENAME": keysFrom(1), "RENAMENX": keysFrom(1),
+	// MOVE takes key and database number
+	"MOVE": keyAt(1),
+	// OBJECT subcommand key: the key follows the subcommand (OBJECT HELP has none)
+	"OBJECT": keyAt(2),
+	// EVAL/EVALSHA: script, numkeys, key1, key2, ..., arg1, arg2, ...
+	// FCALL/FCALL_RO: function, numkeys, key1, key2, ..., arg1, arg2, ...
+	"EVAL": numKeysAt(2), "EVALSHA": numKeysAt(2), "FCALL": numKeysAt(2), "FCALL_RO": numKeysAt(2),
+	// numkeys, key1, key2, ... [LIMIT n]
+	"SINTERCARD": numKeysAt(1), "ZINTERCARD": numKeysAt(1),
+
+	// MSET key value [key value ...]; the values are not keys
+	"MSET": addPrefixToKeyValuePairs, "MSETNX": addPrefixToKeyValuePairs,
+	// destination numkeys key [key ...] [WEIGHTS ...] [AGGREGATE ...]
+	"ZINTERSTORE": addPrefixToStoreNumKeys, "ZUNIONSTORE": addPrefixToStoreNumKeys,
+	// Every argument is a channel or pattern
+	"SUBSCRIBE": addPrefixToChannels, "UNSUBSCRIBE": addPrefixToChannels,
+	"PSUBSCRIBE": addPrefixToChannels, "PUNSUBSCRIBE": addPrefixToChannels,
+	// PUBLISH channel message: the channel is named like (P)SUBSCRIBE's
+	"PUBLISH": func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		if len(args) < 2 {
+			return data
+		}
+		return p.rebuildRESPArray(data, append([]string{args[0], p.rewriteChannel(prefix, args[1])}, args[2:]...))
+	},
+	// BLPOP key [key ...] timeout: every argument but the timeout is a key
+	"BLPOP": addPrefixToBlockingPop, "BRPOP": addPrefixToBlockingPop,
+	// Subcommands without an entry in subcommandKeys take no key
+	"CLUSTER": noKeys, "DEBUG": noKeys,
+	// SET key value [options]: only the key is prefixed. The tenant's default
+	// TTL is added unless the client chose an expiry itself.
+	"SET": func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		if ttl := p.defaultTTLFor(p.tenantPrefix(clientConn)); ttl > 0 && !hasExpiryOption(args) {
+			args = append(args[:len(args):len(args)], "EX", strconv.Itoa(ttl))
+		}
+		return p.addPrefixToSingleKeyRESP(data, args, prefix, 1)
+	},
+	// SCAN cursor [MATCH pattern] [COUNT n] [TYPE type]: only the pattern names keys
+	"SCAN": func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToScanMatchRESP(data, args, prefix)
+	},
+	// GEORADIUS key longitude latitude radius unit [... STORE dest STOREDIST dest]
+	"GEORADIUS": func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToGeoStoreRESP(data, args, prefix, 6)
+	},
+	// GEORADIUSBYMEMBER key member radius unit [... STORE dest STOREDIST dest]
+	"GEORADIUSBYMEMBER": func(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+		return p.addPrefixToGeoStoreRESP(data, args, prefix, 5)
+	},
+	// SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA] [STORE dest]
+	"SORT": addPrefixToSort, "SORT_RO": addPrefixToSort,
+}
+
+// addPrefixToKeyValuePairs is the keyHandler for MSET and MSETNX
+func addPrefixToKeyValuePairs(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	return p.addPrefixToKeyValuePairsRESP(data, args, prefix)
+}
+
+// addPrefixToStoreNumKeys is the keyHandler for ZINTERSTORE and ZUNIONSTORE:
+// the destination, then the keys counted by numkeys
+func addPrefixToStoreNumKeys(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	if len(args) < 2 {
+		return data
+	}
+	withDest := append([]string{args[0], p.rewriteKey(prefix, args[0], args[1])}, args[2:]...)
+	return p.addPrefixToNumKeysRESP(p.rebuildRESPArray(data, withDest), withDest, prefix, 2)
+}
+
+// addPrefixToChannels is the keyHandler for the (P)SUBSCRIBE family
+func addPrefixToChannels(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	return p.addPrefixToChannelsRESP(data, args, prefix)
+}
+
+// addPrefixToBlockingPop is the keyHandler for BLPOP and BRPOP
+func addPrefixToBlockingPop(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	return p.addPrefixToKeyRangeRESP(data, args, prefix, 1, len(args)-1)
+}
+
+// addPrefixToSort is the keyHandler for SORT and SORT_RO
+func addPrefixToSort(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	return p.addPrefixToSortRESP(data, args, prefix)
+}
+
+// noKeys is the keyHandler for commands whose keyed subcommands are all in
+// subcommandKeys
+func noKeys(p *RedisProxy, clientConn net.Conn, data []byte, args []string, prefix string) []byte {
+	return data
+}
+
+// keyCommands lists the Redis commands that operate on keys; addPrefixToKeys
+// leaves every other command alone. This includes all data structure operations.
+var keyCommands = map[string]bool{
+	// String operations
+	"GET": true, "SET": true, "SETEX": true, "SETNX": true, "MSET": true, "MGET": true,
+	"INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
+	"APPEND": true, "STRLEN": true, "GETRANGE": true, "SETRANGE": true,
+	"GETSET": true, "PSETEX": true, "MSETNX": true,
+
+	// Hash operations
+	"HGET": true, "HSET": true, "HSETNX": true, "HMSET": true, "HMGET": true,
+	"HGETALL": true, "HDEL": true, "HEXISTS": true, "HLEN": true, "HKEYS": true,
+	"HVALS": true, "HINCRBY": true, "HINCRBYFLOAT": true, "HSCAN": true,
+	"HRANDFIELD": true,
+	// Hash field TTLs: only the key is prefixed, the FIELDS are hash fields
+	"HEXPIRE": true, "HPEXPIRE": true, "HEXPIREAT": true, "HPEXPIREAT": true,
+	"HTTL": true, "HPTTL": true, "HEXPIRETIME": true, "HPEXPIRETIME": true, "HPERSIST": true,
+
+	// List operations
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "LLEN": true,
+	"LINDEX": true, "LSET": true, "LRANGE": true, "LTRIM": true, "LREM": true,
+	"LPUSHX": true, "RPUSHX": true, "LINSERT": true, "RPOPLPUSH": true,
+	"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true,
+
+	// Set operations
+	"SADD": true, "SREM": true, "SMEMBERS": true, "SISMEMBER": true, "SCARD": true,
+	"SPOP": true, "SRANDMEMBER": true, "SMOVE": true, "SINTER": true, "SINTERSTORE": true,
+	"SUNION": true, "SUNIONSTORE": true, "SDIFF": true, "SDIFFSTORE": true,
+	"SSCAN": true, "SINTERCARD": true, "SMISMEMBER": true,
+
+	// Sorted Set operations
+	"ZADD": true, "ZREM": true, "ZSCORE": true, "ZINCRBY": true, "ZCARD": true,
+	"ZRANGE": true, "ZREVRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGEBYSCORE": true,
+	"ZCOUNT": true, "ZRANK": true, "ZREVRANK": true, "ZREMRANGEBYRANK": true,
+	"ZREMRANGEBYSCORE": true, "ZRANGEBYLEX": true, "ZREVRANGEBYLEX": true,
+	"ZREMRANGEBYLEX": true, "ZLEXCOUNT": true, "ZSCAN": true, "ZINTERCARD": true,
+	"ZINTERSTORE": true, "ZUNIONSTORE": true,
+	"ZRANDMEMBER": true, "ZMSCORE": true,
+
+	// Key operations
+	"DEL": true, "UNLINK": true, "EXISTS": true, "TOUCH": true, "EXPIRE": true, "EXPIREAT": true, "TTL": true,
+	"PERSIST": true, "PEXPIRE": true, "PEXPIREAT": true, "PTTL": true,
+	"RENAME": true, "RENAMENX": true, "TYPE": true, "RANDOMKEY": true,
+	"DUMP": true, "RESTORE": true, "MOVE": true, "OBJECT": true, "SCAN": true,
+	"SORT": true, "SORT_RO": true,
+
+	// Transaction operations
+	"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
+
+	// Script operations
+	"EVAL": true, "EVALSHA": true, "SCRIPT": true,
+
+	// Function operations
+	"FCALL": true, "FCALL_RO": true,
+
+	// Stream operations
+	"XADD": true, "XREAD": true, "XREADGROUP": true, "XRANGE": true, "XREVRANGE": true,
+	"XLEN": true, "XDEL": true, "XTRIM": true, "XACK": true, "XCLAIM": true,
+	"XPENDING": true, "XGROUP": true, "XINFO": true, "XAUTOCLAIM": true, "XSETID": true,
+
+	// HyperLogLog operations
+	"PFADD": true, "PFCOUNT": true, "PFMERGE": true,
+
+	// Bitmap operations
+	"SETBIT": true, "GETBIT": true, "BITCOUNT": true, "BITPOS": true,
+	"BITOP": true, "BITFIELD": true,
+
+	// Geo operations
+	"GEOADD": true, "GEOPOS": true, "GEODIST": true, "GEORADIUS": true,
+	"GEORADIUSBYMEMBER": true, "GEOHASH": true,
+
+	// Pub/Sub operations
+	"PUBLISH": true, "SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true,
+	"PUNSUBSCRIBE": true, "PUBSUB": true,
+
+	// Cluster operations, only the subcommands in subcommandKeys take a key
+	"CLUSTER": true,
+
+	// Debugging, only the subcommands in subcommandKeys take a key
+	"DEBUG": true,
+}
+
+// noPrefixCommands never have keys prefixed, whatever other tables say
+var noPrefixCommands = map[string]bool{
+	"AUTH": true, "PING": true, "ECHO": true, "SELECT": true, "FLUSHDB": true,
+	"FLUSHALL": true, "INFO": true, "CONFIG": true, "CLIENT": true, "SLOWLOG": true,
+	"MONITOR": true, "SYNC": true, "PSYNC": true, "REPLCONF": true,
+	// FUNCTION subcommands (LOAD, LIST, DELETE, DUMP, ...) take no keys
+	"FUNCTION": true,
+}
+
+// checkCommandTables reports the first inconsistency between the command
+// tables: a command both prefixed and never prefixed, or a dedicated handler or
+// subcommand key for a command addPrefixToKeys would never reach
+func checkCommandTables(keyed, noPrefix map[string]bool, handlers map[string]keyHandler, subcommands map[string]int) error {
+	for command := range noPrefix {
+		if keyed[command] {
+			return fmt.Errorf("%s is listed both as a key command and as a command without keys", command)
+		}
+	}
+	for command := range handlers {
+		if !keyed[command] {
+			return fmt.Errorf("%s has a dedicated key handler but is not a key command", command)
+		}
+	}
+	for subcommand := range subcommands {
+		if command, _, _ := strings.Cut(subcommand, " "); !keyed[command] {
+			return fmt.Errorf("%s has a subcommand key but %s is not a key command", subcommand, command)
+		}
 	}
+	return nil
 }
 
-// buildRESPArray builds a RESP array from []interface{} (strings or []interface{})
-func (p *RedisProxy) buildRESPArray(arr []interface{}) []byte {
-	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("*%d\r\n", len(arr)))
-	for _, v := range arr {
-		switch vv := v.(type) {
-		case string:
-			buf.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(vv), vv))
-		case []interface{}:
-			buf.Write(p.buildRESPArray(vv))
+// hasSetOption reports whether a SET command carries option, such as NX
+func hasSetOption(args []string, option string) bool {
+	for i := 3; i < len(args); i++ {
+		if strings.EqualFold(args[i], option) {
+			return true
 		}
 	}
-	return buf.Bytes()
+	return false
 }
 
-// addPrefixToKeys adds the configured prefix to Redis keys in commands with proper RESP parsing
-func (p *RedisProxy) addPrefixToKeys(clientConn net.Conn, data []byte) []byte {
-	// Get prefix for this connection
-	p.prefixMux.RLock()
-	prefix, exists := p.prefixes[clientConn]
-	p.prefixMux.RUnlock()
-
-	if !exists || prefix == "" {
-		return data
+// hasExpiryOption reports whether a SET command already sets or keeps an expiry
+func hasExpiryOption(args []string) bool {
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EX", "PX", "EXAT", "PXAT", "KEEPTTL":
+			return true
+		}
 	}
+	return false
+}
 
-	// Only process arrays (commands)
-	if len(data) == 0 || data[0] != '*' {
-		return data
-	}
+// subcommandKeys maps "COMMAND SUBCOMMAND" to the index of the key the subcommand takes
+var subcommandKeys = map[string]int{
+	"CLUSTER KEYSLOT": 2,
 
-	// Parse the RESP array to get the command and arguments
-	args, err := p.parseRESPArray(data)
-	if err != nil {
-		return data
-	}
+	// DEBUG JMAP, SLEEP, SET-ACTIVE-EXPIRE, RELOAD, ... take none
+	"DEBUG OBJECT":   2,
+	"DEBUG SDSLEN":   2,
+	"DEBUG LISTPACK": 2,
+}
 
-	if len(args) == 0 {
-		return data
-	}
+// clusterTopologyCommands are CLUSTER subcommands revealing the backend's nodes
+// and slot layout, which are hidden from tenants unless allowTopology is set
+var clusterTopologyCommands = map[string]bool{
+	"NODES": true, "SLOTS": true, "SHARDS": true, "REPLICAS": true, "SLAVES": true,
+	"MYID": true, "MYSHARDID": true, "LINKS": true,
+}
 
-	command := strings.ToUpper(args[0])
+// clusterKeyspaceCommands are CLUSTER subcommands listing or counting the keys
+// of a hash slot across every tenant, so they are never forwarded
+var clusterKeyspaceCommands = map[string]bool{
+	"GETKEYSINSLOT": true, "COUNTKEYSINSLOT": true,
+}
 
-	// Comprehensive list of all Redis commands that operate on keys
-	// This includes all data structure operations
-	keyCommands := map[string]bool{
-		// String operations
-		"GET": true, "SET": true, "SETEX": true, "SETNX": true, "MSET": true, "MGET": true,
-		"INCR": true, "DECR": true, "INCRBY": true, "DECRBY": true, "INCRBYFLOAT": true,
-		"APPEND": true, "STRLEN": true, "GETRANGE": true, "SETRANGE": true,
-		"GETSET": true, "PSETEX": true, "MSETNX": true,
-
-		// Hash operations
-		"HGET": true, "HSET": true, "HSETNX": true, "HMSET": true, "HMGET": true,
-		"HGETALL": true, "HDEL": true, "HEXISTS": true, "HLEN": true, "HKEYS": true,
-		"HVALS": true, "HINCRBY": true, "HINCRBYFLOAT": true, "HSCAN": true,
-
-		// List operations
-		"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "LLEN": true,
-		"LINDEX": true, "LSET": true, "LRANGE": true, "LTRIM": true, "LREM": true,
-		"LPUSHX": true, "RPUSHX": true, "LINSERT": true, "RPOPLPUSH": true,
-		"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true,
-
-		// Set operations
-		"SADD": true, "SREM": true, "SMEMBERS": true, "SISMEMBER": true, "SCARD": true,
-		"SPOP": true, "SRANDMEMBER": true, "SMOVE": true, "SINTER": true, "SINTERSTORE": true,
-		"SUNION": true, "SUNIONSTORE": true, "SDIFF": true, "SDIFFSTORE": true,
-		"SSCAN": true,
-
-		// Sorted Set operations
-		"ZADD": true, "ZREM": true, "ZSCORE": true, "ZINCRBY": true, "ZCARD": true,
-		"ZRANGE": true, "ZREVRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGEBYSCORE": true,
-		"ZCOUNT": true, "ZRANK": true, "ZREVRANK": true, "ZREMRANGEBYRANK": true,
-		"ZREMRANGEBYSCORE": true, "ZRANGEBYLEX": true, "ZREVRANGEBYLEX": true,
-		"ZREMRANGEBYLEX": true, "ZLEXCOUNT": true, "ZSCAN": true,
-
-		// Key operations
-		"DEL": true, "EXISTS": true, "EXPIRE": true, "EXPIREAT": true, "TTL": true,
-		"PERSIST": true, "PEXPIRE": true, "PEXPIREAT": true, "PTTL": true,
-		"RENAME": true, "RENAMENX": true, "TYPE": true, "RANDOMKEY": true,
-		"DUMP": true, "RESTORE": true, "MOVE": true, "OBJECT": true,
-
-		// Transaction operations
-		"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true,
-
-		// Script operations
-		"EVAL": true, "EVALSHA": true, "SCRIPT": true,
-
-		// Stream operations
-		"XADD": true, "XREAD": true, "XREADGROUP": true, "XRANGE": true, "XREVRANGE": true,
-		"XLEN": true, "XDEL": true, "XTRIM": true, "XACK": true, "XCLAIM": true,
-		"XPENDING": true, "XGROUP": true, "XINFO": true,
-
-		// HyperLogLog operations
-		"PFADD": true, "PFCOUNT": true, "PFMERGE": true,
-
-		// Bitmap operations
-		"SETBIT": true, "GETBIT": true, "BITCOUNT": true, "BITPOS": true,
-		"BITOP": true, "BITFIELD": true,
-
-		// Geo operations
-		"GEOADD": true, "GEOPOS": true, "GEODIST": true, "GEORADIUS": true,
-		"GEORADIUSBYMEMBER": true, "GEOHASH": true,
-
-		// Pub/Sub operations
-		"PUBLISH": true, "SUBSCRIBE": true, "UNSUBSCRIBE": true, "PSUBSCRIBE": true,
-		"PUNSUBSCRIBE": true, "PUBSUB": true,
-	}
+// adminOnlyCommands are "COMMAND SUBCOMMAND" pairs that stall or change the
+// backend for every tenant, so only prefixes in adminTenants may run them
+var adminOnlyCommands = map[string]bool{
+	"CLIENT PAUSE": true, "CLIENT UNPAUSE": true,
+}
 
-	// Check if this is a key command
-	if !keyCommands[command] {
+// invalidateChannel carries client-side caching invalidations to the connection
+// named by CLIENT TRACKING ... REDIRECT. It is the server's channel, so it is
+// never prefixed, and the keys in its messages are unprefixed instead.
+const invalidateChannel = "__redis__:invalidate"
+
+// rewriteTracking prefixes the PREFIX options of CLIENT TRACKING, which are key
+// prefixes. Broadcast tracking without any PREFIX gets the connection's own so
+// it doesn't cover every tenant's keys.
+func (p *RedisProxy) rewriteTracking(data []byte, args []string, prefix string) []byte {
+	if prefix == "" {
 		return data
 	}
-
-	// Special handling for commands that don't need prefixing
-	noPrefixCommands := map[string]bool{
-		"AUTH": true, "PING": true, "ECHO": true, "SELECT": true, "FLUSHDB": true,
-		"FLUSHALL": true, "INFO": true, "CONFIG": true, "CLIENT": true, "SLOWLOG": true,
-		"MONITOR": true, "SYNC": true, "PSYNC": true, "REPLCONF": true,
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+	bcast, prefixed := false, false
+	for i := 2; i < len(newArgs); i++ {
+		switch strings.ToUpper(newArgs[i]) {
+		case "BCAST":
+			bcast = true
+		case "PREFIX":
+			if i+1 < len(newArgs) {
+				newArgs[i+1] = prefix + newArgs[i+1]
+				prefixed = true
+				i++
+			}
+		case "REDIRECT":
+			i++
+		}
+	}
+	if bcast && !prefixed {
+		newArgs = append(newArgs, "PREFIX", prefix)
 	}
+	return p.rebuildRESPArray(data, newArgs)
+}
 
-	if noPrefixCommands[command] {
-		return data
+// clientFlagSubcommands are CLIENT subcommands that only toggle a flag on the
+// calling connection and are forwarded unchanged
+var clientFlagSubcommands = map[string]bool{
+	"NO-EVICT": true, "NO-TOUCH": true,
+}
+
+// rewriteKey returns the backend key for a client key, from KeyRewriter when set.
+// A key starting with globalSentinel loses the sentinel and is not prefixed.
+func (p *RedisProxy) rewriteKey(prefix, command, key string) string {
+	if p.globalSentinel != "" && strings.HasPrefix(key, p.globalSentinel) {
+		return key[len(p.globalSentinel):]
 	}
+	if p.KeyRewriter != nil {
+		return p.KeyRewriter(strings.ToUpper(command), key)
+	}
+	return prefix + key
+}
 
-	// Handle different command patterns
-	switch command {
-	case "MSET", "MGET", "HMSET", "HMGET":
-		// These commands take multiple key-value pairs
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
-		// Set operations with multiple keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "ZINTERSTORE", "ZUNIONSTORE":
-		// Sorted set operations with multiple keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 2)
-	case "BITOP":
-		// BITOP operation destination key + source keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "PFMERGE":
-		// HyperLogLog merge with multiple keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "XREAD", "XREADGROUP":
-		// Stream read operations with multiple streams
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "RENAME":
-		// RENAME takes two keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "RENAMENX":
-		// RENAMENX takes two keys
-		return p.addPrefixToMultipleKeysRESP(data, args, prefix, 1)
-	case "MOVE":
-		// MOVE takes key and database number
-		return p.addPrefixToSingleKeyRESP(data, args, prefix, 1)
-	case "EVAL", "EVALSHA":
-		// EVAL/EVALSHA: script, numkeys, key1, key2, ..., arg1, arg2, ...
-		return p.addPrefixToEvalKeysRESP(data, args, prefix)
-	default:
-		// For most commands, prefix the first key argument
-		return p.addPrefixToSingleKeyRESP(data, args, prefix, 1)
+// rewriteChannel returns the backend name of a pub/sub channel or pattern. It is
+// always prefix plus the channel, never KeyRewriter's result, because
+// confirmations and messages are unprefixed by the plain prefix.
+func (p *RedisProxy) rewriteChannel(prefix, channel string) string {
+	if p.globalSentinel != "" && strings.HasPrefix(channel, p.globalSentinel) {
+		return channel[len(p.globalSentinel):]
 	}
+	return prefix + channel
 }
 
 // addPrefixToSingleKeyRESP adds prefix to a single key at the specified position using RESP parsing
@@ -773,7 +4329,7 @@ func (p *RedisProxy) addPrefixToSingleKeyRESP(data []byte, args []string, prefix
 	}
 
 	originalKey := args[keyIndex]
-	prefixedKey := prefix + originalKey
+	prefixedKey := p.rewriteKey(prefix, args[0], originalKey)
 
 	// Rebuild the RESP array with the prefixed key
 	return p.rebuildRESPArrayWithPrefix(data, args, keyIndex, prefixedKey)
@@ -791,22 +4347,56 @@ func (p *RedisProxy) addPrefixToMultipleKeysRESP(data []byte, args []string, pre
 
 	// Add prefix to all keys starting from startIndex
 	for i := startIndex; i < len(newArgs); i++ {
-		newArgs[i] = prefix + newArgs[i]
+		newArgs[i] = p.rewriteKey(prefix, args[0], newArgs[i])
+	}
+
+	// Rebuild the RESP array
+	return p.rebuildRESPArray(data, newArgs)
+}
+
+// addPrefixToKeyValuePairsRESP prefixes the keys of a command taking key value
+// pairs from index 1 (MSET, MSETNX), leaving the values untouched
+func (p *RedisProxy) addPrefixToKeyValuePairsRESP(data []byte, args []string, prefix string) []byte {
+	if len(args) < 2 {
+		return data
+	}
+
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+	for i := 1; i < len(newArgs); i += 2 {
+		newArgs[i] = p.rewriteKey(prefix, args[0], newArgs[i])
+	}
+	return p.rebuildRESPArray(data, newArgs)
+}
+
+// addPrefixToKeyRangeRESP adds prefix to the keys in args[start:end] using RESP parsing
+func (p *RedisProxy) addPrefixToKeyRangeRESP(data []byte, args []string, prefix string, start, end int) []byte {
+	if len(args) <= start || end <= start {
+		return data
+	}
+
+	// Create a copy of args with prefixed keys
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+
+	for i := start; i < end && i < len(newArgs); i++ {
+		newArgs[i] = p.rewriteKey(prefix, args[0], newArgs[i])
 	}
 
 	// Rebuild the RESP array
 	return p.rebuildRESPArray(data, newArgs)
 }
 
-// addPrefixToEvalKeysRESP handles EVAL/EVALSHA commands which have a specific format using RESP parsing
-func (p *RedisProxy) addPrefixToEvalKeysRESP(data []byte, args []string, prefix string) []byte {
-	if len(args) < 3 {
+// addPrefixToNumKeysRESP handles commands that give their key count at numKeysIndex,
+// followed by that many keys and then arguments that are not keys (EVAL, SINTERCARD)
+func (p *RedisProxy) addPrefixToNumKeysRESP(data []byte, args []string, prefix string, numKeysIndex int) []byte {
+	if len(args) <= numKeysIndex {
 		return data
 	}
 
-	// EVAL format: EVAL script numkeys key1 key2 ... arg1 arg2 ...
-	// Parse numkeys
-	numKeys, err := strconv.Atoi(args[2])
+	// EVAL script numkeys key1 key2 ... arg1 arg2 ...
+	// SINTERCARD numkeys key1 key2 ... [LIMIT n]
+	numKeys, err := strconv.Atoi(args[numKeysIndex])
 	if err != nil || numKeys <= 0 {
 		return data
 	}
@@ -815,28 +4405,113 @@ func (p *RedisProxy) addPrefixToEvalKeysRESP(data []byte, args []string, prefix
 	newArgs := make([]string, len(args))
 	copy(newArgs, args)
 
-	// Add prefix to the specified number of keys (starting from position 3)
-	for i := 3; i < 3+numKeys && i < len(newArgs); i++ {
-		newArgs[i] = prefix + newArgs[i]
+	// Add prefix to the specified number of keys (starting right after numkeys)
+	first := numKeysIndex + 1
+	for i := first; i < first+numKeys && i < len(newArgs); i++ {
+		newArgs[i] = p.rewriteKey(prefix, args[0], newArgs[i])
 	}
 
 	// Rebuild the RESP array
 	return p.rebuildRESPArray(data, newArgs)
 }
 
-// rebuildRESPArray rebuilds a RESP array from the original data and new arguments
-func (p *RedisProxy) rebuildRESPArray(data []byte, args []string) []byte {
-	var result bytes.Buffer
+// addPrefixToGeoStoreRESP prefixes the source key of a GEORADIUS command and the
+// destination of any STORE or STOREDIST option, looking for options from
+// firstOption on so a member named STORE is never mistaken for one
+func (p *RedisProxy) addPrefixToGeoStoreRESP(data []byte, args []string, prefix string, firstOption int) []byte {
+	if len(args) < 2 {
+		return data
+	}
 
-	// Write array header
-	result.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+	newArgs[1] = p.rewriteKey(prefix, args[0], args[1])
+	for i := firstOption; i+1 < len(newArgs); i++ {
+		switch strings.ToUpper(newArgs[i]) {
+		case "STORE", "STOREDIST":
+			newArgs[i+1] = p.rewriteKey(prefix, args[0], newArgs[i+1])
+			i++
+		}
+	}
+	return p.rebuildRESPArray(data, newArgs)
+}
 
-	// Write each argument as a bulk string
-	for _, arg := range args {
-		result.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+// addPrefixToChannelsRESP prefixes every channel or pattern of a (P)SUBSCRIBE
+// or (P)UNSUBSCRIBE except invalidateChannel, which belongs to the server
+func (p *RedisProxy) addPrefixToChannelsRESP(data []byte, args []string, prefix string) []byte {
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+	for i := 1; i < len(newArgs); i++ {
+		if args[i] != invalidateChannel {
+			newArgs[i] = p.rewriteChannel(prefix, args[i])
+		}
 	}
+	return p.rebuildRESPArray(data, newArgs)
+}
 
-	return result.Bytes()
+// addPrefixToSortRESP prefixes the key of a SORT, its STORE destination and
+// the key patterns of its BY and GET options
+func (p *RedisProxy) addPrefixToSortRESP(data []byte, args []string, prefix string) []byte {
+	if len(args) < 2 {
+		return data
+	}
+
+	newArgs := make([]string, len(args))
+	copy(newArgs, args)
+	newArgs[1] = p.rewriteKey(prefix, args[0], args[1])
+	for i := 2; i+1 < len(newArgs); i++ {
+		switch strings.ToUpper(newArgs[i]) {
+		case "BY", "GET":
+			newArgs[i+1] = p.rewriteSortPattern(prefix, args[0], newArgs[i+1])
+			i++
+		case "STORE":
+			newArgs[i+1] = p.rewriteKey(prefix, args[0], newArgs[i+1])
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return p.rebuildRESPArray(data, newArgs)
+}
+
+// rewriteSortPattern prefixes the key part of a SORT BY or GET pattern. Like
+// Redis, a "->" after the '*' starts a hash field, which is kept as is, and
+// "GET #" names the element itself rather than a key.
+func (p *RedisProxy) rewriteSortPattern(prefix, command, pattern string) string {
+	if pattern == "#" {
+		return pattern
+	}
+	if star := strings.IndexByte(pattern, '*'); star >= 0 {
+		if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 {
+			split := star + 1 + arrow
+			if split+2 < len(pattern) {
+				return p.rewriteKey(prefix, command, pattern[:split]) + pattern[split:]
+			}
+		}
+	}
+	return p.rewriteKey(prefix, command, pattern)
+}
+
+// addPrefixToScanMatchRESP prefixes the MATCH pattern of a SCAN, unless the
+// client already wrote the pattern with the connection's prefix. Glob syntax in
+// the prefix is escaped so it only ever matches literally.
+func (p *RedisProxy) addPrefixToScanMatchRESP(data []byte, args []string, prefix string) []byte {
+	escaped := escapeGlob(prefix)
+	for i := 2; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) != "MATCH" {
+			continue
+		}
+		if strings.HasPrefix(args[i+1], prefix) || strings.HasPrefix(args[i+1], escaped) {
+			return data
+		}
+		return p.addPrefixToSingleKeyRESP(data, args, escaped, i+1)
+	}
+	return data
+}
+
+// rebuildRESPArray rebuilds a RESP array from the original data and new arguments
+func (p *RedisProxy) rebuildRESPArray(data []byte, args []string) []byte {
+	return RESPCodec{}.Encode(args)
 }
 
 // rebuildRESPArrayWithPrefix rebuilds a RESP array with a single prefixed key
@@ -850,8 +4525,248 @@ func (p *RedisProxy) rebuildRESPArrayWithPrefix(data []byte, args []string, keyI
 	return p.rebuildRESPArray(data, newArgs)
 }
 
+// responseRewrite describes how a command's reply is rewritten on its way back to the client
+type responseRewrite int
+
+const (
+	// rewriteNone forwards the reply byte-for-byte
+	rewriteNone responseRewrite = iota
+	// rewriteScan drops keys outside the connection's prefix from a SCAN reply
+	rewriteScan
+	// rewriteKeyedPop strips the prefix from the key naming which list a blocking pop served
+	rewriteKeyedPop
+	// rewritePubSub strips the prefix from the channel named in a subscription confirmation
+	rewritePubSub
+	// rewriteValues decompresses string values the proxy stored compressed
+	rewriteValues
+)
+
+// responseRewrites maps commands to the rewrite applied to their replies.
+// Commands returning opaque or binary payloads (DUMP) or values that merely
+// look like keys (hash fields, set members, list elements) are listed explicitly
+// as rewriteNone so they stay untouched as more rewriting is added.
+var responseRewrites = map[string]responseRewrite{
+	"SCAN":     rewriteScan,
+	"DUMP":     rewriteNone,
+	"HGETALL":  rewriteNone,
+	"HKEYS":    rewriteNone,
+	"HVALS":    rewriteNone,
+	"SMEMBERS": rewriteNone,
+	"LRANGE":   rewriteNone,
+	"BLPOP":    rewriteKeyedPop,
+	"BRPOP":    rewriteKeyedPop,
+
+	"SUBSCRIBE":    rewritePubSub,
+	"UNSUBSCRIBE":  rewritePubSub,
+	"PSUBSCRIBE":   rewritePubSub,
+	"PUNSUBSCRIBE": rewritePubSub,
+
+	"GET":    rewriteValues,
+	"GETSET": rewriteValues,
+	"GETDEL": rewriteValues,
+	"GETEX":  rewriteValues,
+	"MGET":   rewriteValues,
+	"SET":    rewriteValues, // SET ... GET returns the old value
+}
+
+// rewriteResponse applies the rewrite registered for command to a server reply
+func (p *RedisProxy) rewriteResponse(clientConn net.Conn, command string, data []byte) []byte {
+	// Error replies may echo prefixed key names back, whatever the command
+	if len(data) > 0 && data[0] == '-' {
+		return p.scrubErrorReply(data, p.getPrefix(clientConn))
+	}
+	// Only bulk strings, arrays and RESP3 pushes may carry keys. Integer and
+	// simple string replies, and data without RESP framing such as an old
+	// server's inline reply, are never touched by a strategy.
+	if len(data) > 0 && data[0] != '$' && data[0] != '*' && data[0] != '>' {
+		return data
+	}
+
+	switch responseRewrites[command] {
+	case rewriteScan:
+		return p.filterScanResponse(clientConn, data, p.getPrefix(clientConn))
+	case rewriteKeyedPop:
+		return p.stripKeyedPopResponse(data, p.getPrefix(clientConn))
+	case rewritePubSub:
+		return p.stripPubSubReply(data, p.getPrefix(clientConn))
+	case rewriteValues:
+		return p.decompressReply(data)
+	default:
+		return data
+	}
+}
+
+// compressedValueMarker starts every value the proxy stored compressed
+const compressedValueMarker = "\x00rdz\x00"
+
+// rawValueCommands work on a string's stored bytes, which are the gzip stream
+// for a compressed value, so they are refused while compression is enabled
+var rawValueCommands = map[string]bool{
+	"APPEND":      true,
+	"SETRANGE":    true,
+	"GETRANGE":    true,
+	"SUBSTR":      true,
+	"STRLEN":      true,
+	"GETBIT":      true,
+	"SETBIT":      true,
+	"BITCOUNT":    true,
+	"BITPOS":      true,
+	"BITFIELD":    true,
+	"BITFIELD_RO": true,
+	"BITOP":       true,
+	"LCS":         true,
+}
+
+// compressValues gzips the string values of a write command that are at least
+// compressMin bytes long, when that makes them smaller. Keys are never
+// compressed.
+func (p *RedisProxy) compressValues(data []byte) []byte {
+	if p.compressMin <= 0 || len(data) < p.compressMin {
+		return data
+	}
+	args, err := p.parseRESPArray(data)
+	if err != nil || len(args) == 0 {
+		return data
+	}
+	var values []int
+	switch strings.ToUpper(args[0]) {
+	case "SET", "SETNX", "GETSET":
+		// SET key value [options]
+		values = []int{2}
+	case "SETEX", "PSETEX":
+		// SETEX key seconds value
+		values = []int{3}
+	case "MSET", "MSETNX":
+		// MSET key value [key value ...]
+		for i := 2; i < len(args); i += 2 {
+			values = append(values, i)
+		}
+	}
+
+	changed := false
+	for _, i := range values {
+		if i >= len(args) || len(args[i]) < p.compressMin || strings.HasPrefix(args[i], compressedValueMarker) {
+			continue
+		}
+		if compressed, ok := compressValue(args[i]); ok {
+			args[i] = compressed
+			changed = true
+		}
+	}
+	if !changed {
+		return data
+	}
+	return p.rebuildRESPArray(data, args)
+}
+
+// compressValue gzips value behind compressedValueMarker, reporting false when
+// compressing would not make it smaller
+func compressValue(value string) (string, bool) {
+	var buf bytes.Buffer
+	buf.WriteString(compressedValueMarker)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(value)); err != nil {
+		return value, false
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(value) {
+		return value, false
+	}
+	return buf.String(), true
+}
+
+// decompressValue restores a value stored by compressValue, returning any other
+// value unchanged
+func decompressValue(value string) string {
+	if !strings.HasPrefix(value, compressedValueMarker) {
+		return value
+	}
+	zr, err := gzip.NewReader(strings.NewReader(value[len(compressedValueMarker):]))
+	if err != nil {
+		return value
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return value
+	}
+	return string(raw)
+}
+
+// decompressReply restores compressed values in a bulk string or array reply.
+// Values are decompressed whether or not compression is still enabled, so
+// turning it off never leaves clients with compressed data.
+func (p *RedisProxy) decompressReply(data []byte) []byte {
+	if !bytes.Contains(data, []byte(compressedValueMarker)) {
+		return data
+	}
+	val, _, err := p.parseRESP(data)
+	if err != nil {
+		return data
+	}
+	switch v := val.(type) {
+	case string:
+		value := decompressValue(v)
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+	case []interface{}:
+		for i, element := range v {
+			if s, ok := element.(string); ok {
+				v[i] = decompressValue(s)
+			}
+		}
+		return p.buildRESPArray(v)
+	}
+	return data
+}
+
+// scrubErrorReply removes the connection's prefix from an error reply so internal
+// key names never leak to the client. Only occurrences that start a token are
+// removed, so a short prefix like "t:" leaves words such as "script:1" alone.
+func (p *RedisProxy) scrubErrorReply(data []byte, prefix string) []byte {
+	if prefix == "" || !bytes.Contains(data, []byte(prefix)) {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); {
+		if bytes.HasPrefix(data[i:], []byte(prefix)) && (i == 0 || !isKeyByte(data[i-1])) {
+			i += len(prefix)
+			continue
+		}
+		out = append(out, data[i])
+		i++
+	}
+	return out
+}
+
+// isKeyByte reports whether b can sit inside a key name, so a prefix preceded by
+// it is part of a longer word rather than the start of a key
+func isKeyByte(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return b == '_' || b == ':' || b == '-' || b == '.'
+}
+
+// stripKeyedPopResponse strips the prefix from the key in a [key, value] blocking pop reply
+func (p *RedisProxy) stripKeyedPopResponse(data []byte, prefix string) []byte {
+	val, _, err := p.parseRESP(data)
+	if err != nil {
+		return data
+	}
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) != 2 {
+		// Null array on timeout, or something we don't understand
+		return data
+	}
+	key, ok := arr[0].(string)
+	if !ok || !strings.HasPrefix(key, prefix) {
+		return data
+	}
+	arr[0] = strings.TrimPrefix(key, prefix)
+	return p.buildRESPArray(arr)
+}
+
 // filterScanResponse filters the keys in a SCAN response to only include those with the given prefix (nested array aware)
-func (p *RedisProxy) filterScanResponse(data []byte, prefix string) []byte {
+func (p *RedisProxy) filterScanResponse(clientConn net.Conn, data []byte, prefix string) []byte {
 	val, _, err := p.parseRESP(data)
 	if err != nil {
 		return data
@@ -869,24 +4784,153 @@ func (p *RedisProxy) filterScanResponse(data []byte, prefix string) []byte {
 	filtered := make([]interface{}, 0, len(keys))
 	for _, k := range keys {
 		if ks, ok := k.(string); ok && strings.HasPrefix(ks, prefix) {
-			filtered = append(filtered, ks)
+			filtered = append(filtered, strings.TrimPrefix(ks, prefix))
 		}
 	}
+	p.recordScanFilter(clientConn, len(keys), len(filtered))
+	// A page whose keys were all filtered out still carries the cursor, with
+	// an empty key array, so the client keeps iterating. Backend filters such
+	// as TYPE make these empty pages more common, never the end of the scan.
 	newArr := []interface{}{cursor, filtered}
 	return p.buildRESPArray(newArr)
 }
 
+// scanFilterStats counts the keys SCAN replies carried from the backend and how
+// many of them belonged to the tenant and were kept
+type scanFilterStats struct {
+	returned int64
+	kept     int64
+}
+
+// String summarizes the counts with the share of keys filtered out
+func (s scanFilterStats) String() string {
+	ratio := 0.0
+	if s.returned > 0 {
+		ratio = float64(s.returned-s.kept) / float64(s.returned)
+	}
+	return fmt.Sprintf("returned=%d kept=%d filtered=%s", s.returned, s.kept, strconv.FormatFloat(ratio, 'f', 3, 64))
+}
+
+// recordScanFilter adds one filtered SCAN page to the proxy-wide and the
+// connection's counts
+func (p *RedisProxy) recordScanFilter(clientConn net.Conn, returned, kept int) {
+	p.connMux.Lock()
+	defer p.connMux.Unlock()
+	p.scanKeys.returned += int64(returned)
+	p.scanKeys.kept += int64(kept)
+	if state, exists := p.conns[clientConn]; exists {
+		state.scanKeys.returned += int64(returned)
+		state.scanKeys.kept += int64(kept)
+	}
+}
+
+// scanFilterSummary reports the SCAN filter counts proxy-wide, or for the
+// connection from remoteAddr when it is not empty
+func (p *RedisProxy) scanFilterSummary(remoteAddr string) (string, bool) {
+	p.connMux.RLock()
+	defer p.connMux.RUnlock()
+	if remoteAddr == "" {
+		return p.scanKeys.String(), true
+	}
+	for conn, state := range p.conns {
+		if conn.RemoteAddr().String() == remoteAddr {
+			return state.scanKeys.String(), true
+		}
+	}
+	return "", false
+}
+
 func main() {
 	// Configuration
 	proxyAddr := getEnv("REDIS_PROXY_ADDR", ":6378")
-	targetAddr :=  "127.0.0.1:6379"
-	log.Printf("targetAddr: %s", targetAddr)
-	// Create and start the proxy
+	targetAddr := getEnv("REDIS_TARGET_ADDR", "127.0.0.1:6379")
 	proxy := NewRedisProxy(proxyAddr, targetAddr)
 
-	log.Printf("Starting Redis proxy")
+	// Logging goes to stderr unless another target is set and can be opened
+	logTarget := getEnv("REDIS_LOG_TARGET", logToStderr)
+	out, err := openLogOutput(logTarget, getEnv("REDIS_LOG_FILE", ""),
+		getEnv("REDIS_SYSLOG_ADDR", ""), getEnv("REDIS_SYSLOG_FACILITY", "daemon"))
+	if err != nil {
+		proxy.logf("Cannot log to %s, logging to stderr instead: %v", logTarget, err)
+	} else {
+		proxy.logger.SetOutput(out)
+	}
+	proxy.logf("targetAddr: %s", targetAddr)
+
+	proxy.logf("Starting Redis proxy %s", version)
+	// Exit 0 on a signal-initiated shutdown so supervisors can tell it from a failure
 	if err := proxy.Start(); err != nil {
-		log.Fatalf("Failed to start proxy: %v", err)
+		proxy.logf("Proxy stopped with error: %v", err)
+		os.Exit(1)
+	}
+	proxy.logf("Redis proxy stopped")
+}
+
+// Log levels (REDIS_LOG_LEVEL)
+const (
+	logLevelDebug  = "debug"  // Everything, including a line per command and reply
+	logLevelInfo   = "info"   // Connection, configuration and error events, no per-command lines
+	logLevelSilent = "silent" // Nothing at all
+)
+
+// debugLogging reports whether per-command lines are logged. Hot paths check it
+// before calling logf so their arguments are never even formatted.
+func (p *RedisProxy) debugLogging() bool {
+	return p.logLevel == logLevelDebug
+}
+
+// logf writes a line to the proxy's logger unless the log level is silent
+func (p *RedisProxy) logf(format string, args ...interface{}) {
+	if p.logger != nil && p.logLevel != logLevelSilent {
+		p.logger.Printf(format, args...)
+	}
+}
+
+// debugf writes a line to the proxy's logger only at the debug level
+func (p *RedisProxy) debugf(format string, args ...interface{}) {
+	if p.debugLogging() {
+		p.logf(format, args...)
+	}
+}
+
+// Log targets (REDIS_LOG_TARGET)
+const (
+	logToStderr = "stderr"
+	logToSyslog = "syslog"
+	logToFile   = "file"
+)
+
+// syslogFacilities maps REDIS_SYSLOG_FACILITY names to syslog facilities
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON, "user": syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// openLogOutput opens the writer for a log target. A file is appended to; syslog
+// is reached over UDP when addr is set and through the local daemon otherwise.
+func openLogOutput(target, file, syslogAddr, facility string) (io.Writer, error) {
+	switch target {
+	case logToStderr:
+		return os.Stderr, nil
+	case logToFile:
+		if file == "" {
+			return nil, fmt.Errorf("REDIS_LOG_FILE is not set")
+		}
+		return os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	case logToSyslog:
+		priority, ok := syslogFacilities[strings.ToLower(facility)]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", facility)
+		}
+		network := ""
+		if syslogAddr != "" {
+			network = "udp"
+		}
+		return syslog.Dial(network, syslogAddr, priority|syslog.LOG_INFO, "redis-proxy")
+	default:
+		return nil, fmt.Errorf("unknown log target %q: must be %s, %s or %s", target, logToStderr, logToSyslog, logToFile)
 	}
 }
 
@@ -897,3 +4941,45 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool gets a boolean environment variable (e.g. "true") with a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %t", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// getEnvInt gets an integer environment variable with a default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvDuration gets a duration environment variable (e.g. "10s") with a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,4413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockBackend is a scripted Redis server that records the commands it receives
+type mockBackend struct {
+	listener net.Listener
+	handler  func(args []string) []byte
+	session  func() func(args []string) []byte // Handler per connection, when replies depend on earlier commands
+	mu       sync.Mutex
+	commands [][]string
+	conns    int
+}
+
+// acceptCommand plays the backend's +OK to the oldest command awaiting a reply
+// on conn, as forwardReply would
+func acceptCommand(proxy *RedisProxy, conn net.Conn) {
+	proxy.noteStateReply(conn, proxy.lookupState(conn), []byte("+OK\r\n"))
+	proxy.completeCommand(conn)
+}
+
+// newMockBackend starts a mock backend that answers every command with handler's reply
+func newMockBackend(t testing.TB, handler func(args []string) []byte) *mockBackend {
+	t.Helper()
+	return newMockBackendOn(t, "127.0.0.1:0", handler)
+}
+
+// newMockBackendOn starts a mock backend listening on addr
+func newMockBackendOn(t testing.TB, addr string, handler func(args []string) []byte) *mockBackend {
+	t.Helper()
+	return startMockBackend(t, addr, &mockBackend{handler: handler})
+}
+
+// newSessionMockBackend starts a mock backend giving each connection its own
+// handler from session, for commands such as SELECT that change later replies
+func newSessionMockBackend(t testing.TB, session func() func(args []string) []byte) *mockBackend {
+	t.Helper()
+	return startMockBackend(t, "127.0.0.1:0", &mockBackend{session: session})
+}
+
+// startMockBackend listens on addr and serves b's connections
+func startMockBackend(t testing.TB, addr string, b *mockBackend) *mockBackend {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to start mock backend: %v", err)
+	}
+	b.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// serve answers commands on a single backend connection
+func (b *mockBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	parser := &RedisProxy{}
+	reader := bufio.NewReader(conn)
+	handler := b.handler
+	if b.session != nil {
+		handler = b.session()
+	}
+	for {
+		data, err := parser.readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, err := parser.parseRESPArray(data)
+		if err != nil {
+			continue
+		}
+		b.mu.Lock()
+		b.commands = append(b.commands, args)
+		b.mu.Unlock()
+		if reply := handler(args); reply != nil {
+			conn.Write(reply)
+		}
+	}
+}
+
+// addr returns the address the mock backend listens on
+func (b *mockBackend) addr() string {
+	return b.listener.Addr().String()
+}
+
+// connections returns how many connections the backend has accepted
+func (b *mockBackend) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns
+}
+
+// received returns a copy of the commands the backend has seen so far
+func (b *mockBackend) received() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.commands...)
+}
+
+// startTestProxy serves p on a random local port and returns its address
+func startTestProxy(t testing.TB, p *RedisProxy) string {
+	t.Helper()
+	return startTestProxyOn(t, p, "127.0.0.1:0")
+}
+
+// startTestProxyOn serves p on addr and returns the address it listens on
+func startTestProxyOn(t testing.TB, p *RedisProxy, addr string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to start proxy listener: %v", err)
+	}
+	return serveTestProxy(t, p, listener)
+}
+
+// serveTestProxy accepts connections on listener for p and returns its address
+func serveTestProxy(t testing.TB, p *RedisProxy, listener net.Listener) string {
+	t.Helper()
+	t.Cleanup(func() { listener.Close() })
+	p.listenAddr = listener.Addr()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testClient is a raw RESP client used to talk to the proxy in tests
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestClient connects a raw RESP client to addr
+func dialTestClient(t testing.TB, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the raw reply bytes
+func (c *testClient) do(t testing.TB, args ...string) []byte {
+	t.Helper()
+	if _, err := c.conn.Write(encodeCommand(args...)); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	return c.readReply(t)
+}
+
+// readReply reads a single raw reply from the proxy
+func (c *testClient) readReply(t testing.TB) []byte {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := (&RedisProxy{}).readRESP(c.reader)
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+// encodeCommand encodes args as a RESP array of bulk strings
+func encodeCommand(args ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf.Bytes()
+}
+
+// bulkString encodes s as a RESP bulk string reply
+func bulkString(s string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent writers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs redirects the proxy's logger into a buffer
+func captureLogs(t *testing.T, proxy *RedisProxy) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	proxy.logger = log.New(buf, "", log.LstdFlags)
+	return buf
+}
+
+// pubsubHandler emulates Redis subscription confirmations and answers other commands with +OK
+func pubsubHandler(args []string) []byte {
+	var buf bytes.Buffer
+	switch strings.ToUpper(args[0]) {
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		for i, channel := range args[1:] {
+			count := i + 1
+			if strings.ToUpper(args[0]) == "UNSUBSCRIBE" {
+				count = len(args) - 2 - i
+			}
+			fmt.Fprintf(&buf, "*3\r\n%s%s:%d\r\n", bulkString(strings.ToLower(args[0])), bulkString(channel), count)
+		}
+	case "PING":
+		buf.WriteString("+PONG\r\n")
+	case "RESET":
+		buf.WriteString("+RESET\r\n")
+	default:
+		buf.WriteString("+OK\r\n")
+	}
+	return buf.Bytes()
+}
+
+// newTestProxy creates a proxy with a fixed default prefix forwarding to targetAddr
+func newTestProxy(targetAddr string) *RedisProxy {
+	p := NewRedisProxy("127.0.0.1:0", targetAddr)
+	p.defaultPrefix = "tenant:"
+	return p
+}
+
+// rewriteCommand runs a command through processClientCommand on a connection
+// using the "tenant:" prefix and returns the arguments forwarded to the server
+func rewriteCommand(t *testing.T, proxy *RedisProxy, args ...string) []string {
+	t.Helper()
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	proxy.setPrefix(conn, "tenant:")
+	defer func() {
+		proxy.connMux.Lock()
+		delete(proxy.conns, conn)
+		proxy.connMux.Unlock()
+	}()
+
+	out, reply := proxy.processClientCommand(conn, encodeCommand(args...))
+	if reply {
+		t.Fatalf("Expected %q to be forwarded, got reply %q", args, out)
+	}
+	forwarded, err := proxy.parseRESPArray(out)
+	if err != nil {
+		t.Fatalf("Failed to parse rewritten command: %v", err)
+	}
+	return forwarded
+}
+
+// assertRewrite checks that a command is forwarded with exactly the expected arguments
+func assertRewrite(t *testing.T, proxy *RedisProxy, in, expected []string) {
+	t.Helper()
+	got := rewriteCommand(t, proxy, in...)
+	if strings.Join(got, "\x00") != strings.Join(expected, "\x00") {
+		t.Errorf("Rewriting %q:\nExpected: %q\nGot:      %q", in, expected, got)
+	}
+}
+
+func TestDumpReplyPassthrough(t *testing.T) {
+	// A DUMP payload full of bytes that look like RESP framing
+	blob := "\x00\x0bmore\r\ndata*2\r\n$3\r\n:1\r\n-ERR\r\n+OK\x09\x00\xff\xfe\r\n"
+	backend := newMockBackend(t, func(args []string) []byte {
+		return bulkString(blob)
+	})
+
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	reply := client.do(t, "DUMP", "mykey")
+	if !bytes.Equal(reply, bulkString(blob)) {
+		t.Errorf("DUMP reply altered:\nExpected: %q\nGot:      %q", bulkString(blob), reply)
+	}
+
+	received := backend.received()
+	if len(received) != 1 || received[0][1] != "tenant:mykey" {
+		t.Errorf("Expected backend to receive DUMP tenant:mykey, got %q", received)
+	}
+
+	if responseRewrites["DUMP"] != rewriteNone {
+		t.Error("Expected DUMP replies to be excluded from response rewriting")
+	}
+}
+
+func TestCommandSequenceTracing(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+
+	proxy := newTestProxy(backend.addr())
+	logs := captureLogs(t, proxy)
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "SET", "a", "1")
+	client.do(t, "SET", "b", "2")
+
+	addr := client.conn.LocalAddr().String()
+	output := logs.String()
+	for _, seq := range []string{"#1", "#2"} {
+		prefix := "[" + addr + " " + seq + "]"
+		if !strings.Contains(output, prefix+" Processing client command") {
+			t.Errorf("Expected command log line tagged %s, logs:\n%s", prefix, output)
+		}
+		if !strings.Contains(output, prefix+" Reply for SET") {
+			t.Errorf("Expected reply log line tagged %s, logs:\n%s", prefix, output)
+		}
+	}
+}
+
+func TestTrackCommandPairsReplies(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	if seq := proxy.trackCommand(conn, "SCAN", 1, false); seq != 1 {
+		t.Errorf("Expected first sequence number 1, got %d", seq)
+	}
+	if seq := proxy.trackCommand(conn, "GET", 1, false); seq != 2 {
+		t.Errorf("Expected second sequence number 2, got %d", seq)
+	}
+
+	for _, expected := range []pendingCommand{{seq: 1, command: "SCAN"}, {seq: 2, command: "GET"}} {
+		cmd, ok := proxy.completeCommand(conn)
+		if !ok || cmd.seq != expected.seq || cmd.command != expected.command {
+			t.Errorf("Expected pending command %+v, got %+v", expected, cmd)
+		}
+	}
+	if _, ok := proxy.completeCommand(conn); ok {
+		t.Error("Expected no pending commands left")
+	}
+}
+
+func TestPrefixTemplate(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+	proxy.prefixTemplate = "tenant:{user}:env:"
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	proxy.processClientCommand(conn, encodeCommand("AUTH", "alice", "secret"))
+	acceptCommand(proxy, conn)
+	if prefix := proxy.getPrefix(conn); prefix != "tenant:alice:env:" {
+		t.Errorf("Expected templated prefix 'tenant:alice:env:', got %q", prefix)
+	}
+
+	got, _ := proxy.processClientCommand(conn, encodeCommand("GET", "mykey"))
+	expected := encodeCommand("GET", "tenant:alice:env:mykey")
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	// Without a template the username alone becomes the prefix
+	proxy.prefixTemplate = ""
+	if prefix := proxy.authPrefix("alice"); prefix != "alice:" {
+		t.Errorf("Expected fallback prefix 'alice:', got %q", prefix)
+	}
+}
+
+func TestValidatePrefixTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid    bool
+	}{
+		{"tenant:{user}:", true},
+		{"{user}:", true},
+		{"tenant:", false},
+		{"tenant:{user}:{env}:", false},
+		{"tenant:{user", false},
+	}
+
+	for _, tt := range tests {
+		err := validatePrefixTemplate(tt.template)
+		if (err == nil) != tt.valid {
+			t.Errorf("validatePrefixTemplate(%q) error = %v, expected valid = %v", tt.template, err, tt.valid)
+		}
+	}
+
+	proxy := NewRedisProxy("127.0.0.1:0", "127.0.0.1:6379")
+	proxy.prefixTemplate = "tenant:"
+	if err := proxy.Start(); err == nil {
+		t.Error("Expected Start to fail with an invalid prefix template")
+	}
+}
+
+func TestAutoPrefixTemplate(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+OK\r\n") })
+	proxy := NewRedisProxy("127.0.0.1:0", backend.addr())
+	proxy.defaultPrefix = ""
+	proxy.autoTemplate = "anon:{ip}:"
+	addr := startTestProxy(t, proxy)
+
+	first := dialTestClient(t, addr)
+	second := dialTestClient(t, addr)
+	first.do(t, "SET", "k", "1")
+	second.do(t, "SET", "k", "2")
+
+	received := backend.received()
+	if len(received) != 2 {
+		t.Fatalf("Expected two commands at the backend, got %q", received)
+	}
+	for _, cmd := range received {
+		if cmd[1] != "anon:127.0.0.1:k" {
+			t.Errorf("Expected both connections to share the IP prefix, got %q", cmd)
+		}
+	}
+
+	for _, tt := range []struct {
+		template string
+		valid    bool
+	}{
+		{"default:{addr}:", true},
+		{"anon:{ip}:", true},
+		{"anon:", false},
+		{"anon:{ip}:{port}:", false},
+	} {
+		if err := validateAutoPrefixTemplate(tt.template); (err == nil) != tt.valid {
+			t.Errorf("validateAutoPrefixTemplate(%q) error = %v, expected valid = %v", tt.template, err, tt.valid)
+		}
+	}
+}
+
+func TestBitmapAndAppendArgumentsUntouched(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	tests := []struct {
+		in       []string
+		expected []string
+	}{
+		{[]string{"APPEND", "key", "more\r\ndata"}, []string{"APPEND", "tenant:key", "more\r\ndata"}},
+		{[]string{"SETBIT", "key", "7", "1"}, []string{"SETBIT", "tenant:key", "7", "1"}},
+		{[]string{"GETBIT", "key", "7"}, []string{"GETBIT", "tenant:key", "7"}},
+	}
+
+	for _, tt := range tests {
+		assertRewrite(t, proxy, tt.in, tt.expected)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	breaker := newCircuitBreaker(2, 50*time.Millisecond, t.Logf)
+
+	breaker.failure()
+	if !breaker.allow() {
+		t.Fatal("Expected breaker to stay closed below the threshold")
+	}
+	breaker.failure()
+	if breaker.allow() {
+		t.Fatal("Expected breaker to open at the threshold")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !breaker.allow() {
+		t.Fatal("Expected a trial dial after the cooldown")
+	}
+	if breaker.allow() {
+		t.Fatal("Expected only one trial dial while half-open")
+	}
+
+	// A failed trial reopens the breaker, a successful one closes it
+	breaker.failure()
+	if breaker.allow() {
+		t.Fatal("Expected breaker to reopen after a failed trial")
+	}
+	time.Sleep(60 * time.Millisecond)
+	breaker.allow()
+	breaker.success()
+	if !breaker.allow() || breaker.String() != "state=closed failures=0" {
+		t.Fatalf("Expected breaker to close after a successful trial, got %s", breaker)
+	}
+}
+
+func TestCircuitBreakerRejectsNewClients(t *testing.T) {
+	// Reserve a port with nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := listener.Addr().String()
+	listener.Close()
+
+	proxy := newTestProxy(deadAddr)
+	proxy.breaker = newCircuitBreaker(2, time.Minute, proxy.logf)
+	proxyAddr := startTestProxy(t, proxy)
+
+	for i := 0; i < 2; i++ {
+		// A failed dial answers the waiting command, then closes the connection
+		client := dialTestClient(t, proxyAddr)
+		if reply := client.do(t, "PING"); string(reply) != "-ERR backend unavailable\r\n" {
+			t.Errorf("Expected the failed dial to be reported, got %q", reply)
+		}
+		if _, err := client.reader.ReadByte(); err == nil {
+			t.Fatal("Expected connection to close after a failed dial")
+		}
+	}
+
+	client := dialTestClient(t, proxyAddr)
+	if reply := client.do(t, "PING"); string(reply) != "-ERR backend unavailable\r\n" {
+		t.Errorf("Expected backend unavailable error, got %q", reply)
+	}
+
+	proxy.adminSocket = t.TempDir() + "/admin.sock"
+	adminListener, err := proxy.startAdminSocket()
+	if err != nil {
+		t.Fatalf("Failed to start admin socket: %v", err)
+	}
+	defer adminListener.Close()
+
+	admin, err := net.Dial("unix", proxy.adminSocket)
+	if err != nil {
+		t.Fatalf("Failed to connect to admin socket: %v", err)
+	}
+	defer admin.Close()
+	admin.Write([]byte("breaker\n"))
+	line, _ := bufio.NewReader(admin).ReadString('\n')
+	if line != "state=open failures=2\n" {
+		t.Errorf("Expected open breaker on admin socket, got %q", line)
+	}
+}
+
+func TestObjectKeyPosition(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	assertRewrite(t, proxy, []string{"OBJECT", "ENCODING", "mykey"}, []string{"OBJECT", "ENCODING", "tenant:mykey"})
+	assertRewrite(t, proxy, []string{"OBJECT", "FREQ", "mykey"}, []string{"OBJECT", "FREQ", "tenant:mykey"})
+	assertRewrite(t, proxy, []string{"OBJECT", "HELP"}, []string{"OBJECT", "HELP"})
+}
+
+func TestObjectMissingKeyErrorScrubbed(t *testing.T) {
+	// The backend echoes the (prefixed) key name in its error
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("-ERR no such key '" + args[2] + "'\r\n")
+	})
+
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	reply := client.do(t, "OBJECT", "ENCODING", "missingkey")
+	if string(reply) != "-ERR no such key 'missingkey'\r\n" {
+		t.Errorf("Expected error without the internal prefix, got %q", reply)
+	}
+
+	received := backend.received()
+	if len(received) != 1 || received[0][2] != "tenant:missingkey" {
+		t.Errorf("Expected backend to receive the prefixed key, got %q", received)
+	}
+}
+
+func TestScrubErrorReplyShortPrefix(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	reply := proxy.scrubErrorReply([]byte("-ERR user_script:1: WRONGTYPE on 't:counter' at t:list\r\n"), "t:")
+	if string(reply) != "-ERR user_script:1: WRONGTYPE on 'counter' at list\r\n" {
+		t.Errorf("Expected only key tokens to lose the prefix, got %q", reply)
+	}
+}
+
+func TestBlockingPopReplyNotTornDown(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		// Hold the reply like a BLPOP waiting on an empty list
+		time.Sleep(2 * time.Second)
+		return []byte("*2\r\n" + string(bulkString(args[1])) + string(bulkString("job-42")))
+	})
+
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	expected := "*2\r\n" + string(bulkString("queue")) + string(bulkString("job-42"))
+	if reply := client.do(t, "BLPOP", "queue", "0"); string(reply) != expected {
+		t.Errorf("Expected delayed BLPOP reply %q, got %q", expected, reply)
+	}
+
+	received := backend.received()
+	if len(received) != 1 || received[0][1] != "tenant:queue" || received[0][2] != "0" {
+		t.Errorf("Expected backend to receive BLPOP tenant:queue 0, got %q", received)
+	}
+}
+
+func TestBlockingPopKeys(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	assertRewrite(t, proxy, []string{"BLPOP", "a", "b", "5"}, []string{"BLPOP", "tenant:a", "tenant:b", "5"})
+	assertRewrite(t, proxy, []string{"BRPOP", "a", "0"}, []string{"BRPOP", "tenant:a", "0"})
+}
+
+func TestValidateAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{":6378", true},
+		{"127.0.0.1:6379", true},
+		{"[::1]:6379", true},
+		{"[::]:6378", true},
+		{"::1:6379", false},
+		{"127.0.0.1", false},
+		{"127.0.0.1:", false},
+	}
+
+	for _, tt := range tests {
+		err := validateAddr(tt.addr)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateAddr(%q) error = %v, expected valid = %v", tt.addr, err, tt.valid)
+		}
+	}
+
+	proxy := NewRedisProxy("127.0.0.1:0", "::1:6379")
+	err := proxy.Start()
+	if err == nil || !strings.Contains(err.Error(), "must be bracketed") {
+		t.Errorf("Expected startup error about bracketing, got %v", err)
+	}
+}
+
+func TestIPv6Addresses(t *testing.T) {
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		listener.Close()
+	}
+
+	backend := newMockBackendOn(t, "[::1]:0", func(args []string) []byte {
+		return []byte("+PONG\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxyAddr := startTestProxyOn(t, proxy, "[::1]:0")
+	for _, addr := range []string{proxyAddr, backend.addr()} {
+		if err := validateAddr(addr); err != nil {
+			t.Fatalf("Expected a valid bracketed IPv6 address, got %s: %v", addr, err)
+		}
+	}
+
+	client := dialTestClient(t, proxyAddr)
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected PONG over IPv6, got %q", reply)
+	}
+}
+
+func TestFunctionCallKeys(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	assertRewrite(t, proxy, []string{"FCALL", "myfunc", "1", "mykey", "arg1"}, []string{"FCALL", "myfunc", "1", "tenant:mykey", "arg1"})
+	assertRewrite(t, proxy, []string{"FCALL_RO", "myfunc", "2", "a", "b", "c"}, []string{"FCALL_RO", "myfunc", "2", "tenant:a", "tenant:b", "c"})
+	assertRewrite(t, proxy, []string{"FCALL", "myfunc", "0", "arg1"}, []string{"FCALL", "myfunc", "0", "arg1"})
+	assertRewrite(t, proxy, []string{"FUNCTION", "DELETE", "mylib"}, []string{"FUNCTION", "DELETE", "mylib"})
+}
+
+// issueTestCert creates a certificate for commonName signed by parent (self-signed when parent is nil)
+func issueTestCert(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes a PEM block to a new file in dir and returns its path
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := dir + "/" + name
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrefixFromClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey, _ := issueTestCert(t, "test-ca", nil, nil)
+	serverCert, serverKey, _ := issueTestCert(t, "proxy", caCert, caKey)
+	_, _, clientPair := issueTestCert(t, "alice", caCert, caKey)
+
+	serverKeyDER, err := x509.MarshalECPrivateKey(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.tlsCertFile = writePEM(t, dir, "server.pem", "CERTIFICATE", serverCert.Raw)
+	proxy.tlsKeyFile = writePEM(t, dir, "server-key.pem", "EC PRIVATE KEY", serverKeyDER)
+	proxy.tlsClientCA = writePEM(t, dir, "ca.pem", "CERTIFICATE", caCert.Raw)
+	proxy.prefixFromCert = true
+	if err := proxy.validateConfig(); err != nil {
+		t.Fatalf("Expected valid TLS config, got %v", err)
+	}
+
+	listener, err := proxy.listen()
+	if err != nil {
+		t.Fatalf("Failed to listen with TLS: %v", err)
+	}
+	proxyAddr := serveTestProxy(t, proxy, listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	conn, err := tls.Dial("tcp", proxyAddr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientPair}})
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	client := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	t.Cleanup(func() { conn.Close() })
+
+	client.do(t, "SET", "k", "v")
+	// AUTH can't move a certificate-bound connection to another tenant
+	client.do(t, "AUTH", "bob", "secret")
+	client.do(t, "SET", "k2", "v")
+
+	received := backend.received()
+	if len(received) != 3 || received[0][1] != "alice:k" || received[2][1] != "alice:k2" {
+		t.Errorf("Expected keys prefixed with the certificate CN, got %q", received)
+	}
+}
+
+func TestTargetCollidesWithProxy(t *testing.T) {
+	tests := []struct {
+		proxyAddr  string
+		targetAddr string
+		collide    bool
+	}{
+		{"127.0.0.1:6378", "127.0.0.1:6378", true},
+		{":6378", "127.0.0.1:6378", true},
+		{"0.0.0.0:6378", "localhost:6378", true},
+		{":6378", "127.0.0.1:6379", false},
+		{"127.0.0.1:6378", "127.0.0.2:6378", false},
+	}
+
+	for _, tt := range tests {
+		if got := addrsCollide(tt.proxyAddr, tt.targetAddr); got != tt.collide {
+			t.Errorf("addrsCollide(%q, %q) = %v, expected %v", tt.proxyAddr, tt.targetAddr, got, tt.collide)
+		}
+	}
+
+	proxy := NewRedisProxy("127.0.0.1:6378", "127.0.0.1:6378")
+	err := proxy.Start()
+	if err == nil || !strings.Contains(err.Error(), "points back at the proxy") {
+		t.Errorf("Expected startup to fail on identical addresses, got %v", err)
+	}
+}
+
+func TestRuntimeSelfDialRejected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Point the proxy at its own listener, bypassing startup validation
+	proxy := newTestProxy(listener.Addr().String())
+	client := dialTestClient(t, serveTestProxy(t, proxy, listener))
+
+	if reply := client.do(t, "PING"); string(reply) != "-ERR proxy target loops back to the proxy\r\n" {
+		t.Errorf("Expected loop error, got %q", reply)
+	}
+}
+
+func TestShardMapRoutesByAuthPrefix(t *testing.T) {
+	okHandler := func(args []string) []byte { return []byte("+OK\r\n") }
+	aliceBackend := newMockBackend(t, okHandler)
+	bobBackend := newMockBackend(t, okHandler)
+	defaultBackend := newMockBackend(t, okHandler)
+
+	path := t.TempDir() + "/shards.json"
+	shards := fmt.Sprintf(`{"alice": %q, "bob:": %q}`, aliceBackend.addr(), bobBackend.addr())
+	if err := os.WriteFile(path, []byte(shards), 0600); err != nil {
+		t.Fatal(err)
+	}
+	shardMap, err := loadShardMap(path)
+	if err != nil {
+		t.Fatalf("Failed to load shard map: %v", err)
+	}
+
+	proxy := newTestProxy(defaultBackend.addr())
+	proxy.shardMap = shardMap
+	proxyAddr := startTestProxy(t, proxy)
+
+	for _, user := range []string{"alice", "bob"} {
+		client := dialTestClient(t, proxyAddr)
+		client.do(t, "AUTH", user, "secret")
+		client.do(t, "SET", "k", "v")
+	}
+	client := dialTestClient(t, proxyAddr)
+	client.do(t, "SET", "k", "v")
+
+	expectations := []struct {
+		backend *mockBackend
+		key     string
+	}{
+		{aliceBackend, "alice:k"},
+		{bobBackend, "bob:k"},
+		{defaultBackend, "tenant:k"},
+	}
+	for _, e := range expectations {
+		received := e.backend.received()
+		if len(received) == 0 || received[len(received)-1][1] != e.key {
+			t.Errorf("Expected backend to receive SET %s, got %q", e.key, received)
+		}
+	}
+	if len(aliceBackend.received()) != 2 || len(bobBackend.received()) != 2 {
+		t.Errorf("Expected each tenant backend to see only its own AUTH and SET")
+	}
+}
+
+func TestLoadShardMapRejectsBadAddress(t *testing.T) {
+	path := t.TempDir() + "/shards.json"
+	if err := os.WriteFile(path, []byte(`{"alice": "::1:6379"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadShardMap(path); err == nil {
+		t.Error("Expected an error for an unbracketed IPv6 backend address")
+	}
+}
+
+func TestBackendDialDeferredUntilNeeded(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+PONG\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	time.Sleep(100 * time.Millisecond)
+	if n := backend.connections(); n != 0 {
+		t.Fatalf("Expected no backend dial before the client sends anything, got %d", n)
+	}
+
+	// Commands the proxy answers itself don't need the backend either
+	if reply := client.do(t, "flushall"); string(reply) != "-ERR Command not allowed\r\n" {
+		t.Errorf("Expected blocked command error, got %q", reply)
+	}
+	if n := backend.connections(); n != 0 {
+		t.Fatalf("Expected no backend dial for a blocked command, got %d", n)
+	}
+
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected PONG, got %q", reply)
+	}
+	if n := backend.connections(); n != 1 {
+		t.Errorf("Expected a single backend dial once a command needed it, got %d", n)
+	}
+}
+
+func TestLocalReplyOrderedBehindPendingReplies(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		time.Sleep(200 * time.Millisecond)
+		return bulkString("slow")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Pipeline a slow GET ahead of a command the proxy rejects itself
+	pipeline := append(encodeCommand("GET", "k"), encodeCommand("flushdb")...)
+	if _, err := client.conn.Write(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	if reply := client.readReply(t); string(reply) != string(bulkString("slow")) {
+		t.Errorf("Expected the GET reply first, got %q", reply)
+	}
+	if reply := client.readReply(t); string(reply) != "-ERR Command not allowed\r\n" {
+		t.Errorf("Expected the blocked command error second, got %q", reply)
+	}
+	if received := backend.received(); len(received) != 1 {
+		t.Errorf("Expected only the GET to reach the backend, got %q", received)
+	}
+}
+
+func TestRandomMemberCommands(t *testing.T) {
+	proxy := NewRedisProxy("", "")
+
+	assertRewrite(t, proxy, []string{"HRANDFIELD", "h", "3", "WITHVALUES"}, []string{"HRANDFIELD", "tenant:h", "3", "WITHVALUES"})
+	assertRewrite(t, proxy, []string{"ZRANDMEMBER", "z", "-5"}, []string{"ZRANDMEMBER", "tenant:z", "-5"})
+	assertRewrite(t, proxy, []string{"SRANDMEMBER", "s", "2"}, []string{"SRANDMEMBER", "tenant:s", "2"})
+}
+
+func TestSubscribedConnectionRejectsKeyCommands(t *testing.T) {
+	backend := newMockBackend(t, pubsubHandler)
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "SUBSCRIBE", "news")
+
+	reply := client.do(t, "GET", "mykey")
+	expected := "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n"
+	if string(reply) != expected {
+		t.Errorf("Expected subscribe-mode error, got %q", reply)
+	}
+
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected PING to be allowed while subscribed, got %q", reply)
+	}
+
+	for _, cmd := range backend.received() {
+		if cmd[0] == "GET" {
+			t.Errorf("Expected GET to be rejected by the proxy, backend received %q", cmd)
+		}
+	}
+}
+
+func TestSubscribedRESP3ConnectionRunsCommands(t *testing.T) {
+	// An element list that reads like a published message under RESP2
+	lookalike := "*3\r\n$7\r\nmessage\r\n$11\r\ntenant:news\r\n$2\r\nhi\r\n"
+	backend := newSessionMockBackend(t, func() func(args []string) []byte {
+		resp3 := false
+		return func(args []string) []byte {
+			switch strings.ToUpper(args[0]) {
+			case "HELLO":
+				resp3 = true
+				return []byte("%1\r\n+proto\r\n:3\r\n")
+			case "RESET":
+				resp3 = false
+				return []byte("+RESET\r\n")
+			case "SUBSCRIBE":
+				if !resp3 {
+					return pubsubHandler(args)
+				}
+				return []byte(">3\r\n$9\r\nsubscribe\r\n" + string(bulkString(args[1])) + ":1\r\n")
+			case "LRANGE":
+				return []byte(">3\r\n" + lookalike[4:] + lookalike)
+			}
+			return []byte("+OK\r\n")
+		}
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "HELLO", "3")
+	if reply := client.do(t, "SUBSCRIBE", "news"); string(reply) != ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" {
+		t.Errorf("Expected the confirmation push unprefixed, got %q", reply)
+	}
+
+	// Under RESP3 the command is forwarded, the message push comes out on its
+	// own and the array answers the command
+	client.conn.Write(encodeCommand("LRANGE", "list", "0", "-1"))
+	if reply := client.readReply(t); string(reply) != ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n" {
+		t.Errorf("Expected the message push unprefixed, got %q", reply)
+	}
+	if reply := client.readReply(t); string(reply) != lookalike {
+		t.Errorf("Expected the LRANGE reply untouched, got %q", reply)
+	}
+	received := backend.received()
+	if got := strings.Join(received[len(received)-1], " "); got != "LRANGE tenant:list 0 -1" {
+		t.Errorf("Expected LRANGE forwarded with the prefix, got %q", got)
+	}
+
+	// RESET goes back to RESP2, where subscribe mode applies again
+	client.do(t, "RESET")
+	client.do(t, "SUBSCRIBE", "news")
+	if reply := client.do(t, "GET", "k"); !strings.HasPrefix(string(reply), "-ERR Can't execute 'get'") {
+		t.Errorf("Expected the subscribe-mode error after RESET, got %q", reply)
+	}
+}
+
+func TestBlockedMessage(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+OK\r\n") })
+	proxy := newTestProxy(backend.addr())
+	proxy.blockedMessage = "NOPERM flushing is disabled, see the wiki"
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "flushdb"); string(reply) != "-NOPERM flushing is disabled, see the wiki\r\n" {
+		t.Errorf("Expected the configured blocked message, got %q", reply)
+	}
+
+	if err := proxy.validateConfig(); err != nil {
+		t.Fatalf("Expected the blocked message to be valid, got %v", err)
+	}
+	proxy.blockedMessage = "ERR two\r\nlines"
+	if err := proxy.validateConfig(); err == nil {
+		t.Error("Expected a multi-line blocked message to be rejected")
+	}
+}
+
+func TestSubscribeWithoutChannels(t *testing.T) {
+	backend := newMockBackend(t, pubsubHandler)
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	for _, command := range []string{"SUBSCRIBE", "PSUBSCRIBE"} {
+		reply := client.do(t, command)
+		expected := fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(command))
+		if string(reply) != expected {
+			t.Errorf("Expected arity error for %s, got %q", command, reply)
+		}
+	}
+
+	// The connection never entered subscribe mode
+	if reply := client.do(t, "SET", "k", "v"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected SET to be forwarded, got %q", reply)
+	}
+	for _, cmd := range backend.received() {
+		if cmd[0] == "SUBSCRIBE" || cmd[0] == "PSUBSCRIBE" {
+			t.Errorf("Expected %s without channels to stay at the proxy", cmd[0])
+		}
+	}
+}
+
+func TestResetLeavesSubscribeMode(t *testing.T) {
+	backend := newMockBackend(t, pubsubHandler)
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "SUBSCRIBE", "news", "sports")
+	client.readReply(t)
+
+	reply := client.do(t, "SET", "mykey", "v")
+	expected := "-ERR Can't execute 'set': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n"
+	if string(reply) != expected {
+		t.Errorf("Expected subscribe-mode error, got %q", reply)
+	}
+
+	if reply := client.do(t, "RESET"); string(reply) != "+RESET\r\n" {
+		t.Fatalf("Expected RESET to be allowed while subscribed, got %q", reply)
+	}
+	if reply := client.do(t, "SET", "mykey", "v"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected SET to be forwarded after RESET, got %q", reply)
+	}
+
+	var sets [][]string
+	for _, cmd := range backend.received() {
+		if cmd[0] == "SET" {
+			sets = append(sets, cmd)
+		}
+	}
+	if len(sets) != 1 || sets[0][1] != "tenant:mykey" {
+		t.Errorf("Expected only the SET after RESET to reach the backend, got %q", sets)
+	}
+}
+
+func TestSubscribeConfirmationsPairedWithCommand(t *testing.T) {
+	backend := newMockBackend(t, pubsubHandler)
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Pipeline a multi-channel SUBSCRIBE ahead of a rejected command: the
+	// rejection must wait for every confirmation
+	pipeline := append(encodeCommand("SUBSCRIBE", "a", "b", "c"), encodeCommand("SET", "k", "v")...)
+	client.conn.Write(pipeline)
+	for i := 1; i <= 3; i++ {
+		reply := client.readReply(t)
+		if !bytes.HasPrefix(reply, []byte("*3\r\n$9\r\nsubscribe\r\n")) || !bytes.HasSuffix(reply, []byte(fmt.Sprintf(":%d\r\n", i))) {
+			t.Errorf("Expected subscribe confirmation %d, got %q", i, reply)
+		}
+	}
+	if reply := client.readReply(t); !bytes.HasPrefix(reply, []byte("-ERR Can't execute 'set'")) {
+		t.Errorf("Expected the SET rejection after the confirmations, got %q", reply)
+	}
+}
+
+// startPubSubBroker starts a backend that delivers PUBLISHed messages to the
+// connections subscribed to the channel, like Redis does
+func startPubSubBroker(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	subscribers := map[string][]net.Conn{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				parser := &RedisProxy{}
+				reader := bufio.NewReader(conn)
+				for {
+					data, err := parser.readRESP(reader)
+					if err != nil {
+						return
+					}
+					args, err := parser.parseRESPArray(data)
+					if err != nil || len(args) == 0 {
+						continue
+					}
+					mu.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "SUBSCRIBE":
+						for i, channel := range args[1:] {
+							subscribers[channel] = append(subscribers[channel], conn)
+							conn.Write(parser.buildRESPArray([]interface{}{"subscribe", channel, int64(i + 1)}))
+						}
+					case "PUBLISH":
+						for _, subscriber := range subscribers[args[1]] {
+							subscriber.Write(parser.buildRESPArray([]interface{}{"message", args[1], args[2]}))
+						}
+						fmt.Fprintf(conn, ":%d\r\n", len(subscribers[args[1]]))
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTrackingInvalidationsUnprefixed(t *testing.T) {
+	parser := &RedisProxy{}
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) != "SUBSCRIBE" {
+			return []byte("+OK\r\n")
+		}
+		// Confirm, then deliver invalidations for both tenants, one for
+		// another tenant only and one for a flush
+		var buf bytes.Buffer
+		buf.Write(parser.buildRESPArray([]interface{}{"subscribe", args[1], int64(1)}))
+		buf.Write(parser.buildRESPArray([]interface{}{"message", args[1], []interface{}{"tenant:a", "other:b"}}))
+		buf.Write(parser.buildRESPArray([]interface{}{"message", args[1], []interface{}{"other:c"}}))
+		buf.Write(parser.buildRESPArray([]interface{}{"message", args[1], nil}))
+		return buf.Bytes()
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "SUBSCRIBE", "__redis__:invalidate")
+	expected := parser.buildRESPArray([]interface{}{"message", "__redis__:invalidate", []interface{}{"a"}})
+	if reply := client.readReply(t); string(reply) != string(expected) {
+		t.Errorf("Expected the tenant's invalidated key unprefixed, got %q", reply)
+	}
+	expected = parser.buildRESPArray([]interface{}{"message", "__redis__:invalidate", nil})
+	if reply := client.readReply(t); string(reply) != string(expected) {
+		t.Errorf("Expected the other tenant's invalidation dropped and the flush passed on, got %q", reply)
+	}
+	if received := backend.received(); received[0][1] != "__redis__:invalidate" {
+		t.Errorf("Expected the invalidation channel unprefixed, got %q", received[0])
+	}
+
+	assertRewrite(t, proxy,
+		[]string{"CLIENT", "TRACKING", "on", "REDIRECT", "7", "BCAST", "PREFIX", "user:"},
+		[]string{"CLIENT", "TRACKING", "on", "REDIRECT", "7", "BCAST", "PREFIX", "tenant:user:"})
+	assertRewrite(t, proxy,
+		[]string{"CLIENT", "TRACKING", "on", "BCAST"},
+		[]string{"CLIENT", "TRACKING", "on", "BCAST", "PREFIX", "tenant:"})
+	assertRewrite(t, proxy,
+		[]string{"CLIENT", "TRACKING", "off"},
+		[]string{"CLIENT", "TRACKING", "off"})
+}
+
+func TestSubscribeConfirmedBeforePublishedMessage(t *testing.T) {
+	proxy := newTestProxy(startPubSubBroker(t))
+	addr := startTestProxy(t, proxy)
+	subscriber := dialTestClient(t, addr)
+	publisher := dialTestClient(t, addr)
+
+	subscriber.conn.Write(encodeCommand("SUBSCRIBE", "news"))
+	// Publish until the broker has the subscription; the prefixed channel must
+	// match on both connections for the message to be delivered
+	for start := time.Now(); string(publisher.do(t, "PUBLISH", "news", "hello")) != ":1\r\n"; {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Expected the subscription to reach the broker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if reply, expected := subscriber.readReply(t), proxy.buildRESPArray([]interface{}{"subscribe", "news", int64(1)}); !bytes.Equal(reply, expected) {
+		t.Errorf("Expected the subscribe confirmation first, got %q", reply)
+	}
+	if reply, expected := subscriber.readReply(t), proxy.buildRESPArray([]interface{}{"message", "news", "hello"}); !bytes.Equal(reply, expected) {
+		t.Errorf("Expected the published message with the prefix stripped, got %q", reply)
+	}
+}
+
+func TestAdminReloadShardMap(t *testing.T) {
+	path := t.TempDir() + "/shards.json"
+	writeShards := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeShards(`{"alice": "10.0.0.1:6379"}`)
+	proxy := NewRedisProxy("127.0.0.1:0", "127.0.0.1:6379")
+	proxy.shardMapFile = path
+	if reply := proxy.adminCommand("reload"); reply != "OK" {
+		t.Fatalf("Expected initial reload to succeed, got %q", reply)
+	}
+	if addr := proxy.backendFor("alice:"); addr != "10.0.0.1:6379" {
+		t.Fatalf("Expected alice on 10.0.0.1:6379, got %s", addr)
+	}
+
+	writeShards(`{"alice": "10.0.0.2:6379", "bob": "10.0.0.3:6379"}`)
+	if reply := proxy.adminCommand("reload"); reply != "OK" {
+		t.Fatalf("Expected reload to succeed, got %q", reply)
+	}
+	if addr := proxy.backendFor("alice:"); addr != "10.0.0.2:6379" {
+		t.Errorf("Expected alice moved to 10.0.0.2:6379, got %s", addr)
+	}
+	if addr := proxy.backendFor("bob:"); addr != "10.0.0.3:6379" {
+		t.Errorf("Expected bob on 10.0.0.3:6379, got %s", addr)
+	}
+
+	// A broken file is reported and the previous config stays in place
+	writeShards(`{"alice": `)
+	if reply := proxy.adminCommand("reload"); !strings.HasPrefix(reply, "ERR shard map") {
+		t.Errorf("Expected a shard map error, got %q", reply)
+	}
+	if addr := proxy.backendFor("alice:"); addr != "10.0.0.2:6379" {
+		t.Errorf("Expected the previous shard map to be kept, got %s", addr)
+	}
+}
+
+func TestDefaultTTLInjectedIntoSet(t *testing.T) {
+	path := t.TempDir() + "/ttls.json"
+	if err := os.WriteFile(path, []byte(`{"tenant": 3600}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.ttlMapFile = path
+	if err := proxy.reloadConfig(); err != nil {
+		t.Fatalf("Failed to load TTL map: %v", err)
+	}
+
+	assertRewrite(t, proxy, []string{"SET", "k", "v"}, []string{"SET", "tenant:k", "v", "EX", "3600"})
+	assertRewrite(t, proxy, []string{"SET", "k", "v", "NX", "GET"}, []string{"SET", "tenant:k", "v", "NX", "GET", "EX", "3600"})
+	assertRewrite(t, proxy, []string{"SET", "k", "v", "EX", "10"}, []string{"SET", "tenant:k", "v", "EX", "10"})
+	assertRewrite(t, proxy, []string{"SET", "k", "v", "px", "500"}, []string{"SET", "tenant:k", "v", "px", "500"})
+	assertRewrite(t, proxy, []string{"SET", "k", "v", "KEEPTTL"}, []string{"SET", "tenant:k", "v", "KEEPTTL"})
+	// The value is never mistaken for an option
+	assertRewrite(t, proxy, []string{"SET", "k", "EX"}, []string{"SET", "tenant:k", "EX", "EX", "3600"})
+
+	// Prefixes without an entry are left alone
+	proxy.defaultTTLs = map[string]int{"other:": 60}
+	assertRewrite(t, proxy, []string{"SET", "k", "v"}, []string{"SET", "tenant:k", "v"})
+
+	if err := os.WriteFile(path, []byte(`{"tenant": 0}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.reloadConfig(); err == nil || !strings.HasPrefix(err.Error(), "TTL map") {
+		t.Errorf("Expected a non-positive TTL to be rejected, got %v", err)
+	}
+}
+
+func TestGetSetForms(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"GETSET", "key", "v"}, []string{"GETSET", "tenant:key", "v"})
+	assertRewrite(t, proxy, []string{"SET", "key", "v", "GET"}, []string{"SET", "tenant:key", "v", "GET"})
+	assertRewrite(t, proxy, []string{"SET", "key", "v", "NX", "GET", "EX", "10"}, []string{"SET", "tenant:key", "v", "NX", "GET", "EX", "10"})
+}
+
+func TestHashMultiFieldCommands(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"HDEL", "h", "f1", "f2", "f3"}, []string{"HDEL", "tenant:h", "f1", "f2", "f3"})
+	assertRewrite(t, proxy, []string{"HSET", "h", "f1", "v1", "f2", "v2"}, []string{"HSET", "tenant:h", "f1", "v1", "f2", "v2"})
+	assertRewrite(t, proxy, []string{"HMSET", "h", "f1", "v1", "f2", "v2"}, []string{"HMSET", "tenant:h", "f1", "v1", "f2", "v2"})
+	assertRewrite(t, proxy, []string{"HMGET", "h", "f1", "f2"}, []string{"HMGET", "tenant:h", "f1", "f2"})
+	// Fields and values that look like keys, or are empty, are kept exactly
+	assertRewrite(t, proxy, []string{"HSET", "h", "tenant:f", "", "", "v"}, []string{"HSET", "tenant:h", "tenant:f", "", "", "v"})
+}
+
+func TestCommandTablesConsistent(t *testing.T) {
+	if err := checkCommandTables(keyCommands, noPrefixCommands, keyHandlers, subcommandKeys); err != nil {
+		t.Fatalf("Command tables are inconsistent: %v", err)
+	}
+
+	keyed := map[string]bool{"GET": true, "CLUSTER": true}
+	for _, tc := range []struct {
+		noPrefix    map[string]bool
+		handlers    map[string]keyHandler
+		subcommands map[string]int
+		expected    string
+	}{
+		{map[string]bool{"GET": true}, nil, nil, "GET is listed both"},
+		{nil, map[string]keyHandler{"MGET": keysFrom(1)}, nil, "MGET has a dedicated key handler"},
+		{nil, nil, map[string]int{"DEBUG OBJECT": 2}, "DEBUG OBJECT has a subcommand key"},
+	} {
+		err := checkCommandTables(keyed, tc.noPrefix, tc.handlers, tc.subcommands)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.expected) {
+			t.Errorf("Expected an error starting %q, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestSortedSetStoreKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"ZINTERSTORE", "out", "2", "a", "b", "WEIGHTS", "1", "2"},
+		[]string{"ZINTERSTORE", "tenant:out", "2", "tenant:a", "tenant:b", "WEIGHTS", "1", "2"})
+	assertRewrite(t, proxy, []string{"ZUNIONSTORE", "out", "1", "a", "AGGREGATE", "MAX"},
+		[]string{"ZUNIONSTORE", "tenant:out", "1", "tenant:a", "AGGREGATE", "MAX"})
+}
+
+func TestDefaultKeyedCommandsCounted(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	if got := proxy.adminCommand("default-keyed"); got != "(none)" {
+		t.Errorf("Expected no counts yet, got %q", got)
+	}
+
+	rewriteCommand(t, proxy, "GETRANGE", "k", "0", "10")
+	rewriteCommand(t, proxy, "getrange", "k", "0", "-1")
+	rewriteCommand(t, proxy, "INCR", "n")
+	// Commands with a dedicated case are not counted
+	rewriteCommand(t, proxy, "MGET", "a", "b")
+
+	if got := proxy.adminCommand("default-keyed"); got != "GETRANGE=2 INCR=1" {
+		t.Errorf("Expected default-keyed counts, got %q", got)
+	}
+}
+
+func TestWeightedTargets(t *testing.T) {
+	targets, err := parseTargets(" 10.0.0.1:6379=2, 10.0.0.2:6379 ,")
+	if err != nil {
+		t.Fatalf("Failed to parse targets: %v", err)
+	}
+	if len(targets) != 2 || targets[0].addr != "10.0.0.1:6379" || targets[0].weight != 2 || targets[1].weight != 1 {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+	for _, bad := range []string{"", "10.0.0.1:6379=0", "10.0.0.1:6379=x", "10.0.0.1"} {
+		if _, err := parseTargets(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+
+	// Picks are interleaved, not bursts of the heavier backend
+	pool := newTargetPool(targets)
+	var picks []string
+	for i := 0; i < 6; i++ {
+		picks = append(picks, strings.TrimSuffix(pool.next(), ":6379"))
+	}
+	if got := strings.Join(picks, " "); got != "10.0.0.1 10.0.0.2 10.0.0.1 10.0.0.1 10.0.0.2 10.0.0.1" {
+		t.Errorf("Unexpected pick order %s", got)
+	}
+}
+
+func TestConnectionsDistributedAcrossTargets(t *testing.T) {
+	handler := func(args []string) []byte { return []byte("+OK\r\n") }
+	first := newMockBackend(t, handler)
+	second := newMockBackend(t, handler)
+	proxy := newTestProxy("127.0.0.1:1")
+	proxy.targets = newTargetPool([]weightedTarget{{addr: first.addr(), weight: 1}, {addr: second.addr(), weight: 1}})
+	proxyAddr := startTestProxy(t, proxy)
+
+	for i := 0; i < 4; i++ {
+		client := dialTestClient(t, proxyAddr)
+		// Every command of a connection goes to the backend it was given
+		client.do(t, "SET", "k", "v")
+		client.do(t, "GET", "k")
+	}
+
+	for i, backend := range []*mockBackend{first, second} {
+		backend.mu.Lock()
+		conns, commands := backend.conns, len(backend.commands)
+		backend.mu.Unlock()
+		if conns != 2 || commands != 4 {
+			t.Errorf("Backend %d: expected 2 connections and 4 commands, got %d and %d", i, conns, commands)
+		}
+	}
+}
+
+func TestAdminConfigDump(t *testing.T) {
+	path := t.TempDir() + "/shards.json"
+	if err := os.WriteFile(path, []byte(`{"alice": "10.0.0.1:6379"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REDIS_DEFAULT_PREFIX", "app")
+	t.Setenv("REDIS_SHARD_MAP", path)
+	t.Setenv("REDIS_COMMAND_TIMEOUT", "2s")
+	t.Setenv("REDIS_COMMAND_WHITELIST", "set,get")
+	t.Setenv("REDIS_SELECT_MODE", selectScope)
+	proxy := NewRedisProxy("127.0.0.1:0", "10.0.0.9:6379")
+	if err := proxy.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	proxy.PrefixResolver = func(username, password string, remote net.Addr) (string, error) {
+		return "secret-" + password, nil
+	}
+
+	reply := proxy.adminCommand("config")
+	var config configSnapshot
+	if err := json.Unmarshal([]byte(reply), &config); err != nil {
+		t.Fatalf("Expected JSON, got %q: %v", reply, err)
+	}
+	if config.DefaultPrefix != "app:" || config.TargetAddr != "10.0.0.9:6379" || config.CommandTimeout != "2s" ||
+		config.SelectMode != selectScope || config.ShardMap["alice:"] != "10.0.0.1:6379" ||
+		strings.Join(config.CommandWhitelist, ",") != "GET,SET" || !config.PrefixResolver {
+		t.Errorf("Config doesn't reflect the environment: %s", reply)
+	}
+	if strings.Contains(reply, "\n") {
+		t.Error("Expected a single-line reply")
+	}
+}
+
+// shortWriteConn accepts at most chunk bytes per Write and fails every write
+// after the first failAfter writes when failAfter is positive
+type shortWriteConn struct {
+	net.Conn
+	chunk     int
+	failAfter int
+	mu        sync.Mutex
+	written   bytes.Buffer
+	writes    int
+	closed    bool
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failAfter > 0 && c.writes >= c.failAfter {
+		return 0, fmt.Errorf("connection reset")
+	}
+	c.writes++
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	c.written.Write(b)
+	return len(b), nil
+}
+
+func (c *shortWriteConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *shortWriteConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6379}
+}
+
+func TestWriteAllLoopsOverShortWrites(t *testing.T) {
+	conn := &shortWriteConn{chunk: 3}
+	data := encodeCommand("SET", "tenant:key", "value")
+
+	n, err := writeAll(conn, data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Expected %d bytes written, got %d (%v)", len(data), n, err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), data) {
+		t.Errorf("Expected %q, got %q", data, conn.written.Bytes())
+	}
+	if conn.writes <= 1 {
+		t.Errorf("Expected several short writes, got %d", conn.writes)
+	}
+}
+
+func TestPartialWriteClosesBothConnections(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client, src := net.Pipe()
+	defer client.Close()
+	proxy.setPrefix(src, "tenant:")
+
+	dst := &shortWriteConn{chunk: 3, failAfter: 1}
+	done := make(chan struct{})
+	go func() {
+		proxy.forwardWithPrefix(bufio.NewReader(src), src, dst, true)
+		close(done)
+	}()
+
+	if _, err := client.Write(encodeCommand("GET", "mykey")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected forwarding to stop after a partial write")
+	}
+
+	dst.mu.Lock()
+	closed := dst.closed
+	dst.mu.Unlock()
+	if !closed {
+		t.Error("Expected the backend connection to be closed")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the client connection to be closed")
+	}
+}
+
+func TestBackendLatencyHistogram(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			time.Sleep(150 * time.Millisecond)
+			return []byte("$-1\r\n")
+		case "BLPOP":
+			time.Sleep(300 * time.Millisecond)
+			return []byte("*-1\r\n")
+		default:
+			return []byte("+OK\r\n")
+		}
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "SET", "fast", "1")
+	client.do(t, "GET", "slow")
+	client.do(t, "BLPOP", "queue", "1")
+
+	cumulative := proxy.latency.cumulative()
+	bucket := func(bound float64) uint64 {
+		for i, b := range latencyBuckets {
+			if b == bound {
+				return cumulative[i]
+			}
+		}
+		t.Fatalf("No bucket for %v", bound)
+		return 0
+	}
+	if got := bucket(0.1); got != 1 {
+		t.Errorf("Expected 1 reply within 100ms, got %d", got)
+	}
+	if got := bucket(0.25); got != 2 {
+		t.Errorf("Expected 2 replies within 250ms, got %d", got)
+	}
+	if got := cumulative[len(cumulative)-1]; got != 2 {
+		t.Errorf("Expected the blocking BLPOP to be excluded, got %d observations", got)
+	}
+
+	var buf bytes.Buffer
+	proxy.writeMetrics(&buf)
+	for _, line := range []string{
+		"# TYPE redis_proxy_backend_latency_seconds histogram",
+		`redis_proxy_backend_latency_seconds_bucket{le="0.1"} 1`,
+		`redis_proxy_backend_latency_seconds_bucket{le="0.25"} 2`,
+		`redis_proxy_backend_latency_seconds_bucket{le="+Inf"} 2`,
+		"redis_proxy_backend_latency_seconds_count 2",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	if summary := proxy.adminCommand("latency"); !strings.HasPrefix(summary, "count=2 ") || !strings.Contains(summary, "p99<=0.25s") {
+		t.Errorf("Unexpected latency summary %q", summary)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "KEYS":
+			time.Sleep(500 * time.Millisecond)
+			return []byte("*0\r\n")
+		case "BLPOP":
+			time.Sleep(300 * time.Millisecond)
+			return []byte("*-1\r\n")
+		default:
+			return []byte("+OK\r\n")
+		}
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.commandTimeout = 100 * time.Millisecond
+	addr := startTestProxy(t, proxy)
+
+	// Blocking commands may outlast the timeout
+	client := dialTestClient(t, addr)
+	if reply := client.do(t, "BLPOP", "queue", "1"); string(reply) != "*-1\r\n" {
+		t.Errorf("Expected BLPOP to time out on the server, got %q", reply)
+	}
+	if reply := client.do(t, "SET", "k", "v"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected +OK after BLPOP, got %q", reply)
+	}
+
+	client = dialTestClient(t, addr)
+	start := time.Now()
+	if reply := client.do(t, "KEYS", "*"); string(reply) != "-ERR proxy: command timed out\r\n" {
+		t.Fatalf("Expected a timeout error, got %q", reply)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the timeout to fire before the slow reply, took %s", elapsed)
+	}
+
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.reader.ReadByte(); err == nil {
+		t.Error("Expected the connection to be reset after the timeout")
+	}
+}
+
+func TestStreamedReplyOutlastsTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start backend: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := (&RedisProxy{}).readRESP(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		// The reply starts in time but its tail arrives after the command timeout
+		conn.Write([]byte("*3\r\n$1\r\na\r\n"))
+		time.Sleep(300 * time.Millisecond)
+		conn.Write([]byte("$1\r\nb\r\n$1\r\nc\r\n"))
+		time.Sleep(time.Second)
+	}()
+	proxy := newTestProxy(listener.Addr().String())
+	proxy.commandTimeout = 100 * time.Millisecond
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "LRANGE", "list", "0", "-1"); string(reply) != "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n" {
+		t.Errorf("Expected the whole streamed reply, got %q", reply)
+	}
+}
+
+func TestCollectionRepliesKeepPrefixedValues(t *testing.T) {
+	// Field names and members that happen to start with the tenant prefix
+	fields := []interface{}{"tenant:field", "tenant:value", "other", "tenant:x"}
+	backend := newMockBackend(t, func(args []string) []byte {
+		return (&RedisProxy{}).buildRESPArray(fields)
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	expected := proxy.buildRESPArray(fields)
+	for _, cmd := range [][]string{
+		{"HGETALL", "h"},
+		{"HKEYS", "h"},
+		{"HVALS", "h"},
+		{"SMEMBERS", "s"},
+		{"LRANGE", "l", "0", "-1"},
+	} {
+		if responseRewrites[cmd[0]] != rewriteNone {
+			t.Errorf("Expected %s to be marked rewriteNone", cmd[0])
+		}
+		if reply := client.do(t, cmd...); !bytes.Equal(reply, expected) {
+			t.Errorf("%s reply altered:\nExpected: %q\nGot:      %q", cmd[0], expected, reply)
+		}
+	}
+}
+
+func TestStartContextCleanShutdown(t *testing.T) {
+	// Reserve a free port for the proxy to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := NewRedisProxy(addr, "127.0.0.1:6379")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- proxy.StartContext(ctx) }()
+
+	// Wait until the proxy accepts connections
+	for start := time.Now(); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Proxy never started listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Proxy did not stop after the context was cancelled")
+	}
+}
+
+func TestStartContextListenFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	proxy := NewRedisProxy(listener.Addr().String(), "127.0.0.1:6379")
+	if err := proxy.StartContext(context.Background()); err == nil {
+		t.Error("Expected an error when the proxy address is already in use")
+	}
+}
+
+func TestAdminSocketFailureNotFatal(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+PONG\r\n") })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := NewRedisProxy(addr, backend.addr())
+	proxy.adminSocket = t.TempDir() + "/missing/admin.sock"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- proxy.StartContext(ctx) }()
+
+	for start := time.Now(); ; {
+		select {
+		case err := <-result:
+			t.Fatalf("Expected the proxy to keep running without its admin socket, got %v", err)
+		default:
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Proxy never started listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := dialTestClient(t, addr)
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected PING to be served, got %q", reply)
+	}
+}
+
+func TestUnsubscribeAllConfirmationsStripped(t *testing.T) {
+	// A backend that remembers subscriptions so UNSUBSCRIBE without arguments
+	// can confirm each of them
+	var mu sync.Mutex
+	var channels []string
+	backend := newMockBackend(t, func(args []string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		var buf bytes.Buffer
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			for _, channel := range args[1:] {
+				channels = append(channels, channel)
+				fmt.Fprintf(&buf, "*3\r\n%s%s:%d\r\n", bulkString("subscribe"), bulkString(channel), len(channels))
+			}
+		case "UNSUBSCRIBE":
+			for i, channel := range channels {
+				fmt.Fprintf(&buf, "*3\r\n%s%s:%d\r\n", bulkString("unsubscribe"), bulkString(channel), len(channels)-1-i)
+			}
+			channels = nil
+		case "PING":
+			buf.WriteString("+PONG\r\n")
+		}
+		return buf.Bytes()
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	confirmation := func(kind, channel string, count int) string {
+		return fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulkString(kind), bulkString(channel), count)
+	}
+
+	client.conn.Write(encodeCommand("SUBSCRIBE", "a", "b", "c"))
+	for i, channel := range []string{"a", "b", "c"} {
+		if reply := string(client.readReply(t)); reply != confirmation("subscribe", channel, i+1) {
+			t.Errorf("Expected stripped subscribe confirmation for %s, got %q", channel, reply)
+		}
+	}
+
+	client.conn.Write(encodeCommand("UNSUBSCRIBE"))
+	for i, channel := range []string{"a", "b", "c"} {
+		if reply := string(client.readReply(t)); reply != confirmation("unsubscribe", channel, 2-i) {
+			t.Errorf("Expected stripped unsubscribe confirmation for %s, got %q", channel, reply)
+		}
+	}
+
+	// The unsubscribe-all consumed exactly its own confirmations
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected +PONG after unsubscribing, got %q", reply)
+	}
+
+	received := backend.received()
+	if got := strings.Join(received[0], " "); got != "SUBSCRIBE tenant:a tenant:b tenant:c" {
+		t.Errorf("Expected every channel prefixed, got %q", got)
+	}
+}
+
+// scriptedConn is a net.Conn test double that serves scripted input bytes to
+// its reader and records everything written to it
+type scriptedConn struct {
+	net.Conn
+	input  *bytes.Reader
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+// newScriptedConn creates a scriptedConn whose reads return input, then io.EOF
+func newScriptedConn(input []byte) *scriptedConn {
+	return &scriptedConn{input: bytes.NewReader(input)}
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) { return c.input.Read(b) }
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.output.Write(b)
+}
+
+func (c *scriptedConn) Close() error                      { return nil }
+func (c *scriptedConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *scriptedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+// written returns a copy of everything written to the connection
+func (c *scriptedConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.output.Bytes()...)
+}
+
+// forwardScripted drives forwardWithPrefix in one direction until input is
+// exhausted and returns the bytes it wrote. client is the client side of the
+// connection, whose state (prefix, pending commands) the proxy consults; when
+// forwarding client->server, client's own scripted input is used instead.
+func forwardScripted(proxy *RedisProxy, client *scriptedConn, input []byte, isClientToServer bool) []byte {
+	if isClientToServer {
+		server := newScriptedConn(nil)
+		client.input = bytes.NewReader(input)
+		proxy.forwardWithPrefix(bufio.NewReader(client), client, server, true)
+		return server.written()
+	}
+	server := newScriptedConn(input)
+	before := len(client.written())
+	proxy.forwardWithPrefix(bufio.NewReader(server), server, client, false)
+	return client.written()[before:]
+}
+
+func TestForwardClientToServerPrefixesKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client := newScriptedConn(nil)
+	proxy.setPrefix(client, "tenant:")
+
+	input := append(encodeCommand("GET", "mykey"), encodeCommand("SET", "other", "value")...)
+	got := forwardScripted(proxy, client, input, true)
+
+	expected := append(encodeCommand("GET", "tenant:mykey"), encodeCommand("SET", "tenant:other", "value")...)
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestForwardServerToClientFiltersScan(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client := newScriptedConn(nil)
+	proxy.setPrefix(client, "tenant:")
+	proxy.trackCommand(client, "SCAN", 1, false)
+
+	reply := proxy.buildRESPArray([]interface{}{"0", []interface{}{"tenant:a", "other:b", "tenant:c"}})
+	got := forwardScripted(proxy, client, reply, false)
+
+	expected := proxy.buildRESPArray([]interface{}{"0", []interface{}{"a", "c"}})
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestClusterCommands(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"CLUSTER", "KEYSLOT", "mykey"}, []string{"CLUSTER", "KEYSLOT", "tenant:mykey"})
+	assertRewrite(t, proxy, []string{"cluster", "keyslot", "mykey"}, []string{"cluster", "keyslot", "tenant:mykey"})
+	assertRewrite(t, proxy, []string{"CLUSTER", "INFO"}, []string{"CLUSTER", "INFO"})
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	for _, sub := range []string{"NODES", "slots", "SHARDS"} {
+		out, reply := proxy.processClientCommand(conn, encodeCommand("CLUSTER", sub))
+		expected := fmt.Sprintf("-ERR CLUSTER %s is not available through the proxy\r\n", strings.ToUpper(sub))
+		if !reply || string(out) != expected {
+			t.Errorf("Expected CLUSTER %s to be rejected with %q, got %q", sub, expected, out)
+		}
+	}
+
+	proxy.allowTopology = true
+	assertRewrite(t, proxy, []string{"CLUSTER", "NODES"}, []string{"CLUSTER", "NODES"})
+
+	// Other tenants' keys in a slot stay hidden even with the topology allowed
+	for _, args := range [][]string{{"CLUSTER", "GETKEYSINSLOT", "42", "10"}, {"CLUSTER", "countkeysinslot", "42"}} {
+		out, reply := proxy.processClientCommand(conn, encodeCommand(args...))
+		expected := fmt.Sprintf("-ERR CLUSTER %s is not available through the proxy\r\n", strings.ToUpper(args[1]))
+		if !reply || string(out) != expected {
+			t.Errorf("Expected CLUSTER %s to be rejected with %q, got %q", args[1], expected, out)
+		}
+	}
+}
+
+// replayCapture re-runs captured client commands through processClientCommand,
+// one pipe per captured connection starting from its first recorded prefix, and
+// reports every command the proxy now rewrites differently
+func replayCapture(t *testing.T, proxy *RedisProxy, records []captureRecord) {
+	t.Helper()
+	conns := make(map[string]net.Conn)
+	defer func() {
+		proxy.connMux.Lock()
+		defer proxy.connMux.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+			delete(proxy.conns, conn)
+		}
+	}()
+
+	for i, rec := range records {
+		conn, ok := conns[rec.Conn]
+		if !ok {
+			conn, _ = net.Pipe()
+			conns[rec.Conn] = conn
+			proxy.setPrefix(conn, rec.Prefix)
+		}
+		out, reply := proxy.processClientCommand(conn, rec.In)
+		// No server replies arrive in a replay; take the command as accepted so
+		// an AUTH or SELECT settles, and don't leave commands pending
+		proxy.noteStateReply(conn, proxy.lookupState(conn), []byte("+OK\r\n"))
+		proxy.connMux.Lock()
+		proxy.conns[conn].pending = nil
+		proxy.connMux.Unlock()
+		if !bytes.Equal(out, rec.Out) || reply != rec.Reply {
+			t.Errorf("Record %d (%s, %q): expected %q (reply=%v), got %q (reply=%v)",
+				i+1, rec.Conn, rec.In, rec.Out, rec.Reply, out, reply)
+		}
+	}
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	path := t.TempDir() + "/capture.jsonl"
+	capture, err := openCaptureLog(path, proxy.logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.capture = capture
+
+	client := dialTestClient(t, startTestProxy(t, proxy))
+	client.do(t, "AUTH", "alice", "secret")
+	client.do(t, "SET", "k", "v")
+	client.do(t, "MGET", "k", "other")
+	client.do(t, "CLUSTER", "NODES")
+	client.conn.Close()
+	capture.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := readCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 captured commands, got %d", len(records))
+	}
+	for _, captured := range [][]byte{records[0].In, records[0].Out} {
+		if !bytes.Equal(captured, encodeCommand("AUTH", "alice", redactedPassword)) {
+			t.Errorf("Expected the AUTH password to be redacted, got %q", captured)
+		}
+	}
+	if rec := records[1]; rec.Prefix != "alice:" || !bytes.Equal(rec.Out, encodeCommand("SET", "alice:k", "v")) {
+		t.Errorf("Unexpected SET record %+v", rec)
+	}
+	if !records[3].Reply {
+		t.Error("Expected the rejected CLUSTER NODES to be captured as a proxy reply")
+	}
+
+	replayCapture(t, newTestProxy(backend.addr()), records)
+}
+
+func TestRedactCredentials(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	for _, tc := range []struct{ in, expected []byte }{
+		{encodeCommand("AUTH", "secret"), encodeCommand("AUTH", redactedPassword)},
+		{encodeCommand("HELLO", "3", "AUTH", "alice", "secret", "SETNAME", "app"),
+			encodeCommand("HELLO", "3", "AUTH", "alice", redactedPassword, "SETNAME", "app")},
+		{[]byte("AUTH alice secret\r\n"), []byte("AUTH alice " + redactedPassword + "\r\n")},
+		{encodeCommand("HELLO", "3"), encodeCommand("HELLO", "3")},
+		{encodeCommand("SET", "auth", "secret"), encodeCommand("SET", "auth", "secret")},
+	} {
+		if got := proxy.redactCredentials(tc.in); !bytes.Equal(got, tc.expected) {
+			t.Errorf("redactCredentials(%q) = %q, expected %q", tc.in, got, tc.expected)
+		}
+	}
+}
+
+func TestScanReplyAllKeysFiltered(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client := newScriptedConn(nil)
+	proxy.setPrefix(client, "tenant:")
+	proxy.trackCommand(client, "SCAN", 1, false)
+
+	reply := proxy.buildRESPArray([]interface{}{"17", []interface{}{"other:a", "default:b"}})
+	got := forwardScripted(proxy, client, reply, false)
+
+	expected := "*2\r\n$2\r\n17\r\n*0\r\n"
+	if string(got) != expected {
+		t.Errorf("Expected cursor with an empty key array %q, got %q", expected, got)
+	}
+}
+
+func TestSimpleRepliesPassThrough(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client := newScriptedConn(nil)
+	proxy.setPrefix(client, "tenant:")
+
+	for _, tc := range []struct{ command, reply string }{
+		{"INCR", ":123\r\n"},
+		{"LLEN", ":0\r\n"},
+		{"EXISTS", ":2\r\n"},
+		{"SET", "+OK\r\n"},
+		// Strategies that rewrite arrays leave non-array replies alone
+		{"SCAN", ":5\r\n"},
+		{"BLPOP", "+tenant:list\r\n"},
+		{"SUBSCRIBE", ":1\r\n"},
+	} {
+		proxy.trackCommand(client, tc.command, 1, false)
+		if got := forwardScripted(proxy, client, []byte(tc.reply), false); string(got) != tc.reply {
+			t.Errorf("%s: expected %q passed through unchanged, got %q", tc.command, tc.reply, got)
+		}
+	}
+}
+
+func TestPasswordOnlyAuth(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	// Rejected by default, leaving the prefix alone
+	proxy.setPrefix(conn, "tenant:")
+	out, reply := proxy.processClientCommand(conn, encodeCommand("AUTH", "secret"))
+	if !reply || !strings.HasPrefix(string(out), "-ERR AUTH needs a username") {
+		t.Errorf("Expected password-only AUTH to be rejected, got %q (reply=%v)", out, reply)
+	}
+	if prefix := proxy.getPrefix(conn); prefix != "tenant:" {
+		t.Errorf("Expected prefix tenant:, got %q", prefix)
+	}
+
+	proxy.passwordAuth = passwordAuthDefault
+	if out, reply := proxy.processClientCommand(conn, encodeCommand("AUTH", "secret")); reply || !bytes.Equal(out, encodeCommand("AUTH", "secret")) {
+		t.Errorf("Expected AUTH forwarded unchanged, got %q (reply=%v)", out, reply)
+	}
+	acceptCommand(proxy, conn)
+	if prefix := proxy.getPrefix(conn); prefix != "tenant:" {
+		t.Errorf("Expected the default prefix kept, got %q", prefix)
+	}
+
+	proxy.passwordAuth = passwordAuthPrefix
+	if _, reply := proxy.processClientCommand(conn, encodeCommand("AUTH", "secret")); reply {
+		t.Error("Expected AUTH to be forwarded")
+	}
+	acceptCommand(proxy, conn)
+	if prefix := proxy.getPrefix(conn); prefix != "secret:" {
+		t.Errorf("Expected password-based prefix secret:, got %q", prefix)
+	}
+
+	proxy.passwordAuth = "sometimes"
+	if err := proxy.validateConfig(); err == nil || !strings.Contains(err.Error(), "REDIS_PASSWORD_AUTH") {
+		t.Errorf("Expected an invalid mode to be rejected, got %v", err)
+	}
+}
+
+func TestInlineServerReplies(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			return []byte("PONG\r\n")
+		case "SCAN":
+			return []byte("tenant:a other:b\r\n")
+		}
+		return []byte("$1\r\nv\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	pipeline := append(encodeCommand("PING"), encodeCommand("SCAN", "0")...)
+	pipeline = append(pipeline, encodeCommand("GET", "k")...)
+	if _, err := client.conn.Write(pipeline); err != nil {
+		t.Fatalf("Failed to send pipeline: %v", err)
+	}
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"PONG\r\n", "tenant:a other:b\r\n"} {
+		if line, err := client.reader.ReadString('\n'); err != nil || line != expected {
+			t.Errorf("Expected inline reply %q forwarded untouched, got %q (%v)", expected, line, err)
+		}
+	}
+	if reply := client.readReply(t); string(reply) != "$1\r\nv\r\n" {
+		t.Errorf("Expected the next reply still in step, got %q", reply)
+	}
+}
+
+func TestExpireFlagsEndToEnd(t *testing.T) {
+	var mu sync.Mutex
+	ttls := map[string]int{}
+	backend := newMockBackend(t, func(args []string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.ToUpper(args[0]) != "EXPIRE" {
+			return []byte("+OK\r\n")
+		}
+		seconds, _ := strconv.Atoi(args[2])
+		_, hasTTL := ttls[args[1]]
+		for _, flag := range args[3:] {
+			switch strings.ToUpper(flag) {
+			case "NX":
+				if hasTTL {
+					return []byte(":0\r\n")
+				}
+			case "XX":
+				if !hasTTL {
+					return []byte(":0\r\n")
+				}
+			case "GT":
+				if !hasTTL || seconds <= ttls[args[1]] {
+					return []byte(":0\r\n")
+				}
+			}
+		}
+		ttls[args[1]] = seconds
+		return []byte(":1\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"EXPIRE", "key", "100", "XX"}, ":0\r\n"},
+		{[]string{"EXPIRE", "key", "100"}, ":1\r\n"},
+		{[]string{"EXPIRE", "key", "100", "NX"}, ":0\r\n"},
+		{[]string{"EXPIRE", "key", "50", "GT"}, ":0\r\n"},
+		{[]string{"EXPIRE", "key", "200", "gt"}, ":1\r\n"},
+	} {
+		if reply := client.do(t, tc.args...); string(reply) != tc.reply {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.reply, reply)
+		}
+	}
+
+	for _, cmd := range backend.received() {
+		if cmd[1] != "tenant:key" {
+			t.Errorf("Expected the key prefixed and flags untouched, got %v", cmd)
+		}
+	}
+}
+
+func TestTenantConnectionLimit(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.tenantMaxConns = 2
+	proxyAddr := startTestProxy(t, proxy)
+
+	var alice []*testClient
+	for i := 0; i < 2; i++ {
+		client := dialTestClient(t, proxyAddr)
+		if reply := client.do(t, "AUTH", "alice", "secret"); string(reply) != "+OK\r\n" {
+			t.Fatalf("Expected AUTH %d to succeed, got %q", i, reply)
+		}
+		alice = append(alice, client)
+	}
+
+	extra := dialTestClient(t, proxyAddr)
+	if reply := extra.do(t, "AUTH", "alice", "secret"); string(reply) != "-ERR tenant connection limit reached\r\n" {
+		t.Errorf("Expected the third alice connection to be rejected, got %q", reply)
+	}
+	// The rejected connection keeps working under its previous prefix
+	if reply := extra.do(t, "SET", "k", "v"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected the connection to stay usable, got %q", reply)
+	}
+
+	// Closing a connection frees its slot
+	alice[0].conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply := extra.do(t, "AUTH", "alice", "secret")
+		if string(reply) == "+OK\r\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected AUTH to succeed once a slot was freed, got %q", reply)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Connections without AUTH share the default prefix and are never limited,
+	// so idle anonymous clients can't lock new clients out before AUTH
+	for i := 0; i < 3; i++ {
+		dialTestClient(t, proxyAddr).do(t, "PING")
+	}
+	client := dialTestClient(t, proxyAddr)
+	if reply := client.do(t, "PING"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected a fourth default-prefix connection to be served, got %q", reply)
+	}
+	if reply := client.do(t, "AUTH", "bob", "secret"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected AUTH to bob to succeed, got %q", reply)
+	}
+}
+
+func TestDumpRestoreAcrossTenants(t *testing.T) {
+	var mu sync.Mutex
+	values := map[string]string{"alice:key": "\x00\x05hello\x0b\x00tenant:ref"}
+	backend := newMockBackend(t, func(args []string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "DUMP":
+			value, ok := values[args[1]]
+			if !ok {
+				return []byte("$-1\r\n")
+			}
+			return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+		case "RESTORE":
+			values[args[1]] = args[3]
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxyAddr := startTestProxy(t, proxy)
+
+	alice := dialTestClient(t, proxyAddr)
+	alice.do(t, "AUTH", "alice", "secret")
+	val, _, err := proxy.parseRESP(alice.do(t, "DUMP", "key"))
+	blob, ok := val.(string)
+	if err != nil || !ok || blob != "\x00\x05hello\x0b\x00tenant:ref" {
+		t.Fatalf("Expected the serialized value untouched, got %q (%v)", val, err)
+	}
+
+	bob := dialTestClient(t, proxyAddr)
+	bob.do(t, "AUTH", "bob", "secret")
+	if reply := bob.do(t, "RESTORE", "key", "0", blob); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected RESTORE to succeed, got %q", reply)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if values["bob:key"] != blob {
+		t.Errorf("Expected the value restored as bob:key, got keys %v", values)
+	}
+}
+
+func TestHelloNamePassthrough(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		name := ""
+		for i := 1; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "SETNAME" {
+				name = args[i+1]
+			}
+		}
+		return (&RedisProxy{}).buildRESPArray([]interface{}{"server", "redis", "proto", int64(2), "name", name})
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Client names are not namespaced, so the name in the reply is the one set
+	reply := client.do(t, "HELLO", "2", "SETNAME", "worker-1")
+	expected := proxy.buildRESPArray([]interface{}{"server", "redis", "proto", int64(2), "name", "worker-1"})
+	if !bytes.Equal(reply, expected) {
+		t.Errorf("Expected the HELLO reply unchanged, got %q", reply)
+	}
+	if got := strings.Join(backend.received()[0], " "); got != "HELLO 2 SETNAME worker-1" {
+		t.Errorf("Expected HELLO forwarded unchanged, got %q", got)
+	}
+}
+
+func TestPipelinedAuthThenCommand(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// AUTH and SET arrive in a single write, buffered together
+	pipeline := append(encodeCommand("AUTH", "alice", "secret"), encodeCommand("SET", "k", "v")...)
+	if _, err := client.conn.Write(pipeline); err != nil {
+		t.Fatalf("Failed to send pipeline: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if reply := client.readReply(t); string(reply) != "+OK\r\n" {
+			t.Errorf("Expected +OK for command %d, got %q", i, reply)
+		}
+	}
+
+	received := backend.received()
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 commands at the backend, got %d", len(received))
+	}
+	if got := strings.Join(received[1], " "); got != "SET alice:k v" {
+		t.Errorf("Expected SET under the AUTH-derived prefix, got %q", got)
+	}
+}
+
+func TestTenantFlush(t *testing.T) {
+	var mu sync.Mutex
+	keys := map[string]bool{"alice:a": true, "alice:b": true, "alice:db1:c": true, "bob:a": true, "bob:b": true}
+	backend := newMockBackend(t, func(args []string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "SCAN":
+			matched := []interface{}{}
+			for key := range keys {
+				if ok, _ := path.Match(args[3], key); ok {
+					matched = append(matched, key)
+				}
+			}
+			return (&RedisProxy{}).buildRESPArray([]interface{}{"0", matched})
+		case "UNLINK":
+			removed := 0
+			for _, key := range args[1:] {
+				if keys[key] {
+					delete(keys, key)
+					removed++
+				}
+			}
+			return []byte(fmt.Sprintf(":%d\r\n", removed))
+		}
+		return []byte("+OK\r\n")
+	})
+	remaining := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		var names []string
+		for key := range keys {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	proxy := newTestProxy(backend.addr())
+	proxyAddr := startTestProxy(t, proxy)
+
+	// Without the setting flushes stay blocked
+	client := dialTestClient(t, proxyAddr)
+	client.do(t, "AUTH", "alice", "secret")
+	if reply := client.do(t, "flushdb"); string(reply) != "-ERR Command not allowed\r\n" {
+		t.Errorf("Expected FLUSHDB to be blocked, got %q", reply)
+	}
+
+	proxy.tenantFlush = true
+	proxy.selectMode = selectScope
+	client = dialTestClient(t, proxyAddr)
+	client.do(t, "AUTH", "alice", "secret")
+	client.do(t, "SELECT", "1")
+	if reply := client.do(t, "FLUSHDB"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected +OK from the tenant FLUSHDB, got %q", reply)
+	}
+	if got := remaining(); got != "alice:a,alice:b,bob:a,bob:b" {
+		t.Errorf("Expected only alice's db 1 flushed, got %s", got)
+	}
+	if reply := client.do(t, "FLUSHALL"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected +OK from the tenant FLUSHALL, got %q", reply)
+	}
+	if got := remaining(); got != "bob:a,bob:b" {
+		t.Errorf("Expected only bob's keys left, got %s", got)
+	}
+
+	// The side connection replayed the client's AUTH before scanning
+	var auths int
+	for _, cmd := range backend.received() {
+		if cmd[0] == "AUTH" {
+			auths++
+		}
+	}
+	if auths != 4 {
+		t.Errorf("Expected AUTH on the client connections and each flush connection, got %d", auths)
+	}
+}
+
+func TestTenantFlushSelectedDatabase(t *testing.T) {
+	var mu sync.Mutex
+	dbs := map[int]map[string]bool{
+		0: {"alice:a": true, "bob:a": true},
+		3: {"alice:c": true, "bob:c": true},
+	}
+	backend := newSessionMockBackend(t, func() func(args []string) []byte {
+		db := 0
+		return func(args []string) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			keys := dbs[db]
+			switch strings.ToUpper(args[0]) {
+			case "SELECT":
+				db, _ = strconv.Atoi(args[1])
+				if dbs[db] == nil {
+					dbs[db] = map[string]bool{}
+				}
+			case "SET":
+				// Slow enough for a pipelined flush to overtake it if it could
+				mu.Unlock()
+				time.Sleep(100 * time.Millisecond)
+				mu.Lock()
+				keys[args[1]] = true
+			case "INFO":
+				var info strings.Builder
+				info.WriteString("# Keyspace\r\n")
+				for n := 0; n <= 3; n++ {
+					if len(dbs[n]) > 0 {
+						fmt.Fprintf(&info, "db%d:keys=%d,expires=0,avg_ttl=0\r\n", n, len(dbs[n]))
+					}
+				}
+				return bulkString(info.String())
+			case "SCAN":
+				matched := []interface{}{}
+				for key := range keys {
+					if ok, _ := path.Match(args[3], key); ok {
+						matched = append(matched, key)
+					}
+				}
+				return (&RedisProxy{}).buildRESPArray([]interface{}{"0", matched})
+			case "UNLINK":
+				removed := 0
+				for _, key := range args[1:] {
+					if keys[key] {
+						delete(keys, key)
+						removed++
+					}
+				}
+				return []byte(fmt.Sprintf(":%d\r\n", removed))
+			}
+			return []byte("+OK\r\n")
+		}
+	})
+	remaining := func(db int) string {
+		mu.Lock()
+		defer mu.Unlock()
+		var names []string
+		for key := range dbs[db] {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	proxy := newTestProxy(backend.addr())
+	proxy.tenantFlush = true
+	client := dialTestClient(t, startTestProxy(t, proxy))
+	client.do(t, "AUTH", "alice", "secret")
+	client.do(t, "SELECT", "3")
+
+	// The SET pipelined ahead of the flush reaches the backend first
+	client.conn.Write(append(encodeCommand("SET", "d", "v"), encodeCommand("FLUSHDB")...))
+	for _, expected := range []string{"+OK\r\n", "+OK\r\n"} {
+		if reply := client.readReply(t); string(reply) != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	}
+	if got := remaining(3); got != "bob:c" {
+		t.Errorf("Expected alice's keys in db 3 flushed, got %s", got)
+	}
+	if got := remaining(0); got != "alice:a,bob:a" {
+		t.Errorf("Expected db 0 untouched by FLUSHDB on db 3, got %s", got)
+	}
+
+	mu.Lock()
+	dbs[3]["alice:e"] = true
+	mu.Unlock()
+	if reply := client.do(t, "FLUSHALL"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected +OK from the tenant FLUSHALL, got %q", reply)
+	}
+	if got := remaining(0) + "|" + remaining(3); got != "bob:a|bob:c" {
+		t.Errorf("Expected FLUSHALL to clear alice's keys in every database, got %s", got)
+	}
+}
+
+func TestCommandWhitelist(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.allowCommands = parseCommandList(" get, set ,,")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	assertRewrite(t, proxy, []string{"SET", "k", "v"}, []string{"SET", "tenant:k", "v"})
+	assertRewrite(t, proxy, []string{"get", "k"}, []string{"get", "tenant:k"})
+
+	out, reply := proxy.processClientCommand(conn, encodeCommand("KEYS", "*"))
+	if !reply || string(out) != "-ERR command not permitted\r\n" {
+		t.Errorf("Expected KEYS to be rejected, got %q (reply=%v)", out, reply)
+	}
+	for _, args := range [][]string{{"AUTH", "alice", "secret"}, {"PING"}, {"QUIT"}} {
+		if _, reply := proxy.processClientCommand(conn, encodeCommand(args...)); reply {
+			t.Errorf("Expected %s to be implicitly permitted", args[0])
+		}
+		acceptCommand(proxy, conn)
+	}
+	for _, inline := range []string{"FLUSHALL\r\n", "KEYS *\r\n"} {
+		out, reply := proxy.processClientCommand(conn, []byte(inline))
+		if !reply || string(out) != "-ERR command not permitted\r\n" {
+			t.Errorf("Expected inline %q to be rejected, got %q (reply=%v)", inline, out, reply)
+		}
+	}
+
+	if parseCommandList("") != nil {
+		t.Error("Expected an empty whitelist to allow every command")
+	}
+}
+
+func TestScanTypeAcrossIterations(t *testing.T) {
+	// The backend keyspace in cursor order, two keys per page
+	keyspace := []struct{ key, kind string }{
+		{"tenant:h1", "hash"}, {"other:h2", "hash"},
+		{"tenant:s1", "string"}, {"other:h3", "hash"},
+		{"tenant:h4", "hash"}, {"tenant:s2", "string"},
+	}
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) != "SCAN" {
+			return []byte("+OK\r\n")
+		}
+		cursor, _ := strconv.Atoi(args[1])
+		kind := ""
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "TYPE" {
+				kind = args[i+1]
+			}
+		}
+		keys := []interface{}{}
+		end := min(cursor+2, len(keyspace))
+		for _, entry := range keyspace[cursor:end] {
+			if kind == "" || entry.kind == kind {
+				keys = append(keys, entry.key)
+			}
+		}
+		next := strconv.Itoa(end)
+		if end == len(keyspace) {
+			next = "0"
+		}
+		return (&RedisProxy{}).buildRESPArray([]interface{}{next, keys})
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// The second page holds no tenant hash, yet still carries the cursor on
+	var pages []string
+	cursor := "0"
+	for {
+		val, _, err := proxy.parseRESP(client.do(t, "SCAN", cursor, "TYPE", "hash"))
+		if err != nil {
+			t.Fatalf("Failed to parse SCAN reply: %v", err)
+		}
+		reply := val.([]interface{})
+		var keys []string
+		for _, k := range reply[1].([]interface{}) {
+			keys = append(keys, k.(string))
+		}
+		pages = append(pages, strings.Join(keys, ","))
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if got := strings.Join(pages, "|"); got != "h1||h4" {
+		t.Errorf("Expected pages \"h1||h4\", got %q", got)
+	}
+	for i, cmd := range backend.received() {
+		if got := strings.Join(cmd, " "); got != fmt.Sprintf("SCAN %d TYPE hash", i*2) {
+			t.Errorf("Expected the backend cursor and TYPE forwarded, got %q", got)
+		}
+	}
+}
+
+func TestCommandTimeoutClearedWhenIdle(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.commandTimeout = 100 * time.Millisecond
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Replies racing the next pipelined command must not leave a deadline behind
+	const n = 200
+	var batch []byte
+	for i := 0; i < n; i++ {
+		batch = append(batch, encodeCommand("SET", "k", "v")...)
+	}
+	client.conn.Write(batch)
+	for i := 0; i < n; i++ {
+		if reply := client.readReply(t); string(reply) != "+OK\r\n" {
+			t.Fatalf("Expected +OK for command %d, got %q", i, reply)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if reply := client.do(t, "PING"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected an idle connection to stay usable, got %q", reply)
+	}
+}
+
+func TestWaitAOFPassthroughNotTimedOut(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) == "WAITAOF" {
+			time.Sleep(300 * time.Millisecond)
+			return []byte("*2\r\n:1\r\n:0\r\n")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.commandTimeout = 100 * time.Millisecond
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "WAITAOF", "1", "0", "1000"); string(reply) != "*2\r\n:1\r\n:0\r\n" {
+		t.Errorf("Expected the WAITAOF reply forwarded unchanged, got %q", reply)
+	}
+	received := backend.received()
+	if got := strings.Join(received[0], " "); got != "WAITAOF 1 0 1000" {
+		t.Errorf("Expected WAITAOF forwarded unmodified, got %q", got)
+	}
+}
+
+func TestPrefixResolver(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	tenants := map[string]string{"token-a": "acme:", "token-b": "globex:prod:"}
+	proxy.PrefixResolver = func(username, password string, remote net.Addr) (string, error) {
+		if remote == nil {
+			return "", fmt.Errorf("no remote address")
+		}
+		if prefix, ok := tenants[password]; ok {
+			return prefix, nil
+		}
+		return "", fmt.Errorf("unknown token")
+	}
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	proxy.processClientCommand(conn, encodeCommand("AUTH", "token-a"))
+	acceptCommand(proxy, conn)
+	got, _ := proxy.processClientCommand(conn, encodeCommand("GET", "k"))
+	if !bytes.Equal(got, encodeCommand("GET", "acme:k")) {
+		t.Errorf("Expected GET acme:k, got %q", got)
+	}
+	acceptCommand(proxy, conn)
+
+	proxy.processClientCommand(conn, encodeCommand("AUTH", "anyone", "token-b"))
+	acceptCommand(proxy, conn)
+	got, _ = proxy.processClientCommand(conn, encodeCommand("GET", "k"))
+	if !bytes.Equal(got, encodeCommand("GET", "globex:prod:k")) {
+		t.Errorf("Expected GET globex:prod:k, got %q", got)
+	}
+
+	out, reply := proxy.processClientCommand(conn, encodeCommand("AUTH", "bogus"))
+	if !reply || string(out) != "-ERR unknown token\r\n" {
+		t.Errorf("Expected the AUTH to be rejected, got %q", out)
+	}
+	if prefix := proxy.getPrefix(conn); prefix != "globex:prod:" {
+		t.Errorf("Expected a rejected AUTH to keep the prefix, got %q", prefix)
+	}
+}
+
+func TestIntersectionCardinalityKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"SINTERCARD", "2", "s1", "s2", "LIMIT", "5"}, []string{"SINTERCARD", "2", "tenant:s1", "tenant:s2", "LIMIT", "5"})
+	assertRewrite(t, proxy, []string{"SINTERCARD", "1", "s1"}, []string{"SINTERCARD", "1", "tenant:s1"})
+	assertRewrite(t, proxy, []string{"ZINTERCARD", "2", "z1", "z2", "LIMIT", "10"}, []string{"ZINTERCARD", "2", "tenant:z1", "tenant:z2", "LIMIT", "10"})
+}
+
+func TestKeyCountSeededAndUpdated(t *testing.T) {
+	stored := []string{"alice:a", "alice:b", "bob:x", "alice:c"}
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "SCAN":
+			// Two pages, filtered by the MATCH prefix like Redis would
+			pattern := strings.TrimSuffix(args[3], "*")
+			page, next := stored[:2], "2"
+			if args[1] == "2" {
+				page, next = stored[2:], "0"
+			}
+			keys := []interface{}{}
+			for _, key := range page {
+				if strings.HasPrefix(key, pattern) {
+					keys = append(keys, key)
+				}
+			}
+			return (&RedisProxy{}).buildRESPArray([]interface{}{next, keys})
+		case "DEL":
+			return []byte(fmt.Sprintf(":%d\r\n", len(args)-1))
+		default:
+			return []byte("+OK\r\n")
+		}
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.keyCounts = newKeyCountCache(0)
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "AUTH", "alice", "secret")
+	for start := time.Now(); proxy.adminCommand("keycount alice:") != "3"; {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Expected alice: to be seeded with 3 keys, got %q", proxy.adminCommand("keycount alice:"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received := backend.received(); strings.Join(received[1], " ") != "AUTH alice secret" {
+		t.Errorf("Expected the seeding scan to authenticate first, got %q", received[1])
+	}
+
+	// A plain SET may overwrite an existing key, so only SET NX counts
+	for i := 0; i < 3; i++ {
+		client.do(t, "SET", "a", "1")
+	}
+	if got := proxy.adminCommand("keycount alice:"); got != "3" {
+		t.Errorf("Expected overwriting SETs not to be counted, got %s", got)
+	}
+	client.do(t, "SET", "d", "1", "nx")
+	if got := proxy.adminCommand("keycount alice:"); got != "4" {
+		t.Errorf("Expected 4 keys after SET NX, got %s", got)
+	}
+	client.do(t, "DEL", "a", "b")
+	if got := proxy.adminCommand("keycount"); got != "alice:=2" {
+		t.Errorf("Expected alice:=2 after DEL, got %s", got)
+	}
+
+	proxy.keyCounts.observe("alice:", "FLUSHALL", []byte("+OK\r\n"))
+	if got := proxy.adminCommand("keycount alice:"); !strings.HasPrefix(got, "ERR") {
+		t.Errorf("Expected the count to be dropped after a flush, got %s", got)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := escapeGlob(`a*b?[c]\d:`); got != `a\*b\?\[c\]\\d:` {
+		t.Errorf("Unexpected escaped pattern %q", got)
+	}
+}
+
+func TestHashFieldTTLKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"HEXPIRE", "myhash", "100", "FIELDS", "2", "a", "b"}, []string{"HEXPIRE", "tenant:myhash", "100", "FIELDS", "2", "a", "b"})
+	assertRewrite(t, proxy, []string{"HPEXPIREAT", "myhash", "1700000000000", "NX", "FIELDS", "1", "a"}, []string{"HPEXPIREAT", "tenant:myhash", "1700000000000", "NX", "FIELDS", "1", "a"})
+	assertRewrite(t, proxy, []string{"HTTL", "myhash", "FIELDS", "1", "a"}, []string{"HTTL", "tenant:myhash", "FIELDS", "1", "a"})
+	assertRewrite(t, proxy, []string{"HPERSIST", "myhash", "FIELDS", "1", "a"}, []string{"HPERSIST", "tenant:myhash", "FIELDS", "1", "a"})
+}
+
+func TestSelectModes(t *testing.T) {
+	selectAndGet := func(proxy *RedisProxy) (selectOut []byte, selectReply bool, get []byte, db int) {
+		conn, _ := net.Pipe()
+		defer conn.Close()
+		proxy.setPrefix(conn, "tenant:")
+		selectOut, selectReply = proxy.processClientCommand(conn, encodeCommand("SELECT", "3"))
+		get, _ = proxy.processClientCommand(conn, encodeCommand("GET", "k"))
+		acceptCommand(proxy, conn)
+		proxy.connMux.RLock()
+		db = proxy.conns[conn].db
+		proxy.connMux.RUnlock()
+		return
+	}
+
+	proxy := newTestProxy("127.0.0.1:6379")
+	out, reply, get, db := selectAndGet(proxy)
+	if reply || !bytes.Equal(out, encodeCommand("SELECT", "3")) {
+		t.Errorf("pass-through: expected SELECT forwarded, got %q (reply=%v)", out, reply)
+	}
+	if !bytes.Equal(get, encodeCommand("GET", "tenant:k")) || db != 3 {
+		t.Errorf("pass-through: expected GET tenant:k with db 3 tracked, got %q, db %d", get, db)
+	}
+
+	proxy.selectMode = selectScope
+	out, reply, get, db = selectAndGet(proxy)
+	if !reply || string(out) != "+OK\r\n" {
+		t.Errorf("scope-into-prefix: expected SELECT answered with +OK, got %q (reply=%v)", out, reply)
+	}
+	if !bytes.Equal(get, encodeCommand("GET", "tenant:db3:k")) || db != 3 {
+		t.Errorf("scope-into-prefix: expected GET tenant:db3:k, got %q, db %d", get, db)
+	}
+
+	proxy.selectMode = selectReject
+	out, reply, get, db = selectAndGet(proxy)
+	if !reply || string(out) != "-ERR SELECT is not allowed through the proxy\r\n" {
+		t.Errorf("reject: expected SELECT rejected, got %q (reply=%v)", out, reply)
+	}
+	if !bytes.Equal(get, encodeCommand("GET", "tenant:k")) || db != 0 {
+		t.Errorf("reject: expected GET tenant:k on db 0, got %q, db %d", get, db)
+	}
+
+	proxy.selectMode = "bogus"
+	if err := proxy.validateConfig(); err == nil || !strings.Contains(err.Error(), "REDIS_SELECT_MODE") {
+		t.Errorf("Expected an invalid select mode to be rejected, got %v", err)
+	}
+}
+
+func TestSelectTrackedOnceAccepted(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.EqualFold(args[0], "SELECT") && args[1] != "3" {
+			return []byte("-ERR DB index is out of range\r\n")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+	connDB := func() int {
+		proxy.connMux.RLock()
+		defer proxy.connMux.RUnlock()
+		for _, state := range proxy.conns {
+			return state.db
+		}
+		return -1
+	}
+
+	client.do(t, "SELECT", "3")
+	if db := connDB(); db != 3 {
+		t.Errorf("Expected database 3 tracked after +OK, got %d", db)
+	}
+	if reply := client.do(t, "SELECT", "99"); !strings.HasPrefix(string(reply), "-ERR") {
+		t.Fatalf("Expected the backend to reject SELECT 99, got %q", reply)
+	}
+	if db := connDB(); db != 3 {
+		t.Errorf("Expected a rejected SELECT to keep database 3, got %d", db)
+	}
+}
+
+func TestSelectScopeKeepsTenantRouting(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.selectMode = selectScope
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	proxy.setPrefix(conn, "tenant:")
+
+	proxy.processClientCommand(conn, encodeCommand("SELECT", "0"))
+	if prefix := proxy.getPrefix(conn); prefix != "tenant:" {
+		t.Errorf("Expected database 0 to use the plain prefix, got %q", prefix)
+	}
+	proxy.processClientCommand(conn, encodeCommand("SELECT", "2"))
+	if prefix := proxy.tenantPrefix(conn); prefix != "tenant:" {
+		t.Errorf("Expected the tenant prefix to stay unscoped, got %q", prefix)
+	}
+	if out, _ := proxy.processClientCommand(conn, encodeCommand("SELECT", "x")); string(out) != "-ERR value is not an integer or out of range\r\n" {
+		t.Errorf("Expected a non-numeric database to be rejected, got %q", out)
+	}
+}
+
+func TestUnknownProtocolFragmented(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	reader := bufio.NewReader(server)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	read := func() {
+		data, err := proxy.readRESP(reader)
+		results <- result{data, err}
+	}
+
+	// An inline command split across writes is returned whole, and the read
+	// doesn't wait for anything beyond it
+	go read()
+	client.Write([]byte("PI"))
+	select {
+	case r := <-results:
+		t.Fatalf("Expected to wait for the rest of the line, got %q (%v)", r.data, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	client.Write([]byte("NG\r\n"))
+	select {
+	case r := <-results:
+		if r.err != nil || string(r.data) != "PING\r\n" {
+			t.Errorf("Expected PING\\r\\n, got %q (%v)", r.data, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the complete inline command to be returned")
+	}
+
+	// The RESP command following it is read normally
+	go read()
+	client.Write(encodeCommand("GET", "k"))
+	if r := <-results; r.err != nil || !bytes.Equal(r.data, encodeCommand("GET", "k")) {
+		t.Errorf("Expected the following RESP command, got %q (%v)", r.data, r.err)
+	}
+}
+
+func TestUnknownProtocolSizeCapped(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	line := strings.Repeat("x", maxUnknownProtocolSize+1) + "\r\n"
+	reader := bufio.NewReader(strings.NewReader(line))
+
+	if _, err := proxy.readRESP(reader); err == nil {
+		t.Error("Expected an error for unknown data beyond the size cap")
+	}
+}
+
+func TestMaxArgs(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.maxArgs = 3
+
+	reader := bufio.NewReader(strings.NewReader("*1000000\r\n$3\r\nGET\r\n"))
+	if _, err := proxy.readCommand(reader); !errors.Is(err, errTooManyArgs) {
+		t.Errorf("Expected errTooManyArgs from readCommand, got %v", err)
+	}
+	if _, err := proxy.parseRESPArray([]byte("*1000000\r\n$3\r\nGET\r\n")); !errors.Is(err, errTooManyArgs) {
+		t.Errorf("Expected errTooManyArgs from parseRESPArray, got %v", err)
+	}
+	if _, err := proxy.parseRESPArray([]byte("*-2\r\n")); err == nil {
+		t.Error("Expected a negative array length to be rejected")
+	}
+	if _, err := proxy.readRESP(bufio.NewReader(strings.NewReader("$-5\r\n"))); err == nil {
+		t.Error("Expected a negative bulk string length to be rejected")
+	}
+
+	// Replies from the server are not limited
+	reply := encodeCommand("a", "b", "c", "d", "e")
+	if got, err := proxy.readRESP(bufio.NewReader(bytes.NewReader(reply))); err != nil || !bytes.Equal(got, reply) {
+		t.Errorf("Expected a 5 element reply to be read, got %q (%v)", got, err)
+	}
+}
+
+func TestRESPCodecRoundTrip(t *testing.T) {
+	codec := RESPCodec{}
+
+	args := []string{"SET", "user:1", "", "hello\r\nworld"}
+	encoded := codec.Encode(args)
+	if !bytes.Equal(encoded, encodeCommand(args...)) {
+		t.Errorf("Expected Encode to match encodeCommand, got %q", encoded)
+	}
+	decoded, err := codec.Decode(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil || !bytes.Equal(decoded, encoded) {
+		t.Errorf("Expected the encoded command to decode unchanged, got %q (%v)", decoded, err)
+	}
+
+	// Several values back to back, including nested and null ones
+	stream := "+OK\r\n-ERR bad\r\n:42\r\n$-1\r\n*-1\r\n*2\r\n*1\r\n$1\r\na\r\n:7\r\n"
+	reader := bufio.NewReader(strings.NewReader(stream))
+	for _, want := range []string{"+OK\r\n", "-ERR bad\r\n", ":42\r\n", "$-1\r\n", "*-1\r\n", "*2\r\n*1\r\n$1\r\na\r\n:7\r\n"} {
+		got, err := codec.Decode(reader)
+		if err != nil || string(got) != want {
+			t.Errorf("Expected %q, got %q (%v)", want, got, err)
+		}
+	}
+	if _, err := codec.Decode(reader); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+
+	// MaxArgs only limits the top-level array
+	limited := RESPCodec{MaxArgs: 2}
+	if _, err := limited.Decode(bufio.NewReader(bytes.NewReader(codec.Encode([]string{"a", "b", "c"})))); !errors.Is(err, errTooManyArgs) {
+		t.Errorf("Expected errTooManyArgs, got %v", err)
+	}
+	nested := "*1\r\n*3\r\n:1\r\n:2\r\n:3\r\n"
+	if got, err := limited.Decode(bufio.NewReader(strings.NewReader(nested))); err != nil || string(got) != nested {
+		t.Errorf("Expected a nested array to be read, got %q (%v)", got, err)
+	}
+}
+
+func TestProtocolErrorsReported(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxyAddr := startTestProxy(t, proxy)
+
+	for _, tc := range []struct {
+		name, input, expected string
+		connected             bool
+	}{
+		{"bulk length not a number", "*2\r\n$3\r\nGET\r\n$abc\r\nkey\r\n", "-ERR Protocol error: invalid bulk length\r\n", false},
+		{"negative bulk length", "*2\r\n$3\r\nGET\r\n$-5\r\n", "-ERR Protocol error: invalid bulk length\r\n", false},
+		{"multibulk length not a number", "*x\r\n", "-ERR Protocol error: invalid multibulk length\r\n", false},
+		// After the backend is dialed, errors are reported from the forwarding loop
+		{"bad bulk length once connected", "*2\r\n$3\r\nGET\r\n$1x\r\n", "-ERR Protocol error: invalid bulk length\r\n", true},
+	} {
+		client := dialTestClient(t, proxyAddr)
+		if tc.connected {
+			client.do(t, "SET", "k", "v")
+		}
+		if _, err := client.conn.Write([]byte(tc.input)); err != nil {
+			t.Fatalf("%s: failed to send: %v", tc.name, err)
+		}
+		if reply := client.readReply(t); string(reply) != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, reply)
+		}
+		if _, err := client.reader.ReadByte(); err == nil {
+			t.Errorf("%s: expected the connection to be closed", tc.name)
+		}
+	}
+
+	if reply := protocolErrorReply(io.EOF); reply != nil {
+		t.Errorf("Expected no reply for an I/O error, got %q", reply)
+	}
+}
+
+// endlessReader yields the same byte forever, like a peer that never sends a newline
+type endlessReader byte
+
+func (r endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r)
+	}
+	return len(b), nil
+}
+
+func TestMaxLineLength(t *testing.T) {
+	codec := RESPCodec{MaxLineLength: 1024}
+	for _, tc := range []struct{ first, expected string }{
+		{"+", "Protocol error: too big inline request"},
+		{"-", "Protocol error: too big inline request"},
+		{":", "Protocol error: too big inline request"},
+		{"$", "Protocol error: too big bulk count string"},
+		{"*", "Protocol error: too big mbulk count string"},
+		{"x", "Protocol error: too big inline request"},
+	} {
+		reader := bufio.NewReader(io.MultiReader(strings.NewReader(tc.first), endlessReader('7')))
+		if _, err := codec.Decode(reader); err == nil || err.Error() != tc.expected {
+			t.Errorf("%q: expected %q, got %v", tc.first, tc.expected, err)
+		}
+	}
+
+	// Lines within the limit are read as before
+	if got, err := codec.Decode(bufio.NewReader(strings.NewReader("+OK\r\n"))); err != nil || string(got) != "+OK\r\n" {
+		t.Errorf("Expected +OK, got %q (%v)", got, err)
+	}
+
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.maxLineLength = 16
+	client := dialTestClient(t, startTestProxy(t, proxy))
+	client.conn.Write([]byte("*" + strings.Repeat("9", 8192)))
+	if reply := client.readReply(t); string(reply) != "-ERR Protocol error: too big mbulk count string\r\n" {
+		t.Errorf("Expected a protocol error for the long header, got %q", reply)
+	}
+}
+
+func TestMaxArgsClosesConnection(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return encodeCommand("a", "b", "c", "d", "e")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.maxArgs = 4
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "LRANGE", "list", "0", "-1"); !bytes.Equal(reply, encodeCommand("a", "b", "c", "d", "e")) {
+		t.Errorf("Expected the large reply forwarded, got %q", reply)
+	}
+
+	if reply := client.do(t, "DEL", "a", "b", "c", "d"); string(reply) != "-ERR Protocol error: invalid multibulk length\r\n" {
+		t.Errorf("Expected a protocol error, got %q", reply)
+	}
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.reader.ReadByte(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestRequireRESPRejectsInline(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+PONG\r\n") })
+	proxy := newTestProxy(backend.addr())
+	proxy.requireRESP = true
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Fatalf("Expected a RESP command to be forwarded, got %q", reply)
+	}
+
+	client.conn.Write([]byte("PING\r\n"))
+	if reply := client.readReply(t); string(reply) != "-ERR Protocol error: expected '$', got 'P'\r\n" {
+		t.Errorf("Expected a protocol error for an inline command, got %q", reply)
+	}
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.reader.ReadByte(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if received := backend.received(); len(received) != 1 {
+		t.Errorf("Expected only the RESP command at the backend, got %q", received)
+	}
+}
+
+func TestEmptyCommandIgnored(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+PONG\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	proxy.setPrefix(conn, "tenant:")
+	out, reply := proxy.processClientCommand(conn, []byte("*0\r\n"))
+	if !reply || len(out) != 0 {
+		t.Errorf("Expected *0 to be dropped without a reply, got %q (reply=%v)", out, reply)
+	}
+	if _, pending := proxy.completeCommand(conn); pending {
+		t.Error("Expected *0 not to be tracked as a pending command")
+	}
+
+	client := dialTestClient(t, startTestProxy(t, proxy))
+	client.conn.Write([]byte("*0\r\n"))
+	if reply := client.do(t, "PING"); string(reply) != "+PONG\r\n" {
+		t.Errorf("Expected +PONG right after the empty command, got %q", reply)
+	}
+	if received := backend.received(); len(received) != 1 || received[0][0] != "PING" {
+		t.Errorf("Expected only PING to reach the backend, got %q", received)
+	}
+}
+
+func TestAdminKillConnections(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxyAddr := startTestProxy(t, proxy)
+
+	proxy.adminSocket = t.TempDir() + "/admin.sock"
+	adminListener, err := proxy.startAdminSocket()
+	if err != nil {
+		t.Fatalf("Failed to start admin socket: %v", err)
+	}
+	defer adminListener.Close()
+	admin, err := net.Dial("unix", proxy.adminSocket)
+	if err != nil {
+		t.Fatalf("Failed to connect to admin socket: %v", err)
+	}
+	defer admin.Close()
+	adminReader := bufio.NewReader(admin)
+	adminDo := func(line string) string {
+		admin.Write([]byte(line + "\n"))
+		reply, _ := adminReader.ReadString('\n')
+		return strings.TrimSuffix(reply, "\n")
+	}
+	assertClosed := func(client *testClient) {
+		t.Helper()
+		client.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.reader.ReadByte(); err == nil {
+			t.Error("Expected the connection to be closed")
+		}
+	}
+
+	victim := dialTestClient(t, proxyAddr)
+	victim.do(t, "SET", "k", "v")
+	bystander := dialTestClient(t, proxyAddr)
+	bystander.do(t, "SET", "k", "v")
+
+	if reply := adminDo("kill " + victim.conn.LocalAddr().String()); reply != "killed=1" {
+		t.Errorf("Expected killed=1, got %q", reply)
+	}
+	assertClosed(victim)
+	if reply := bystander.do(t, "GET", "k"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected the other connection to keep working, got %q", reply)
+	}
+
+	alice := dialTestClient(t, proxyAddr)
+	alice.do(t, "AUTH", "alice", "secret")
+	if reply := adminDo("kill-prefix alice"); reply != "killed=1" {
+		t.Errorf("Expected killed=1, got %q", reply)
+	}
+	assertClosed(alice)
+
+	if reply := adminDo("kill 127.0.0.1:1"); !strings.HasPrefix(reply, "ERR no connection") {
+		t.Errorf("Expected an error for an unknown address, got %q", reply)
+	}
+}
+
+func TestMaxInflightWindow(t *testing.T) {
+	gate := make(chan struct{})
+	backend := newMockBackend(t, func(args []string) []byte {
+		<-gate
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.maxInflight = 4
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Pipeline far more commands than the window while the backend is stalled
+	const total = 20
+	var pipeline []byte
+	for i := 0; i < total; i++ {
+		pipeline = append(pipeline, encodeCommand("SET", fmt.Sprintf("k%d", i), "v")...)
+	}
+	go client.conn.Write(pipeline)
+
+	pendingCount := func() int {
+		proxy.connMux.RLock()
+		defer proxy.connMux.RUnlock()
+		most := 0
+		for _, state := range proxy.conns {
+			most = max(most, len(state.pending))
+		}
+		return most
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := pendingCount(); got != 4 {
+		t.Errorf("Expected the window to hold 4 commands in flight, got %d", got)
+	}
+
+	close(gate)
+	for i := 0; i < total; i++ {
+		if reply := client.readReply(t); string(reply) != "+OK\r\n" {
+			t.Fatalf("Expected +OK for command %d, got %q", i, reply)
+		}
+	}
+	if got := len(backend.received()); got != total {
+		t.Errorf("Expected all %d commands to reach the backend, got %d", total, got)
+	}
+}
+
+func TestMaxInflightClientCloseWhileWaiting(t *testing.T) {
+	gate := make(chan struct{})
+	defer close(gate)
+	backend := newMockBackend(t, func(args []string) []byte {
+		<-gate
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.maxInflight = 2
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	var pipeline []byte
+	for i := 0; i < 5; i++ {
+		pipeline = append(pipeline, encodeCommand("SET", fmt.Sprintf("k%d", i), "v")...)
+	}
+	client.conn.Write(pipeline)
+	time.Sleep(100 * time.Millisecond)
+	client.conn.Close()
+
+	// The backend never answers, yet the hang-up must still tear the connection down
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		proxy.connMux.RLock()
+		open := len(proxy.conns)
+		proxy.connMux.RUnlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the connection to be cleaned up after the client closed, %d still open", open)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestScanMatchPrefixed(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"SCAN", "0", "MATCH", "user:*"}, []string{"SCAN", "0", "MATCH", "tenant:user:*"})
+	assertRewrite(t, proxy, []string{"SCAN", "0", "COUNT", "100", "match", "user:*"}, []string{"SCAN", "0", "COUNT", "100", "match", "tenant:user:*"})
+	assertRewrite(t, proxy, []string{"SCAN", "0", "MATCH", "tenant:user:*"}, []string{"SCAN", "0", "MATCH", "tenant:user:*"})
+	assertRewrite(t, proxy, []string{"SCAN", "0"}, []string{"SCAN", "0"})
+	assertRewrite(t, proxy, []string{"SCAN", "0", "COUNT", "10"}, []string{"SCAN", "0", "COUNT", "10"})
+}
+
+func TestScanMatchGlobSafe(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	// Glob syntax in the client's pattern is kept
+	assertRewrite(t, proxy, []string{"SCAN", "0", "MATCH", "user:?"}, []string{"SCAN", "0", "MATCH", "tenant:user:?"})
+	assertRewrite(t, proxy, []string{"SCAN", "0", "MATCH", "[abc]*"}, []string{"SCAN", "0", "MATCH", "tenant:[abc]*"})
+
+	// Glob syntax in the prefix is escaped, binary bytes are kept as they are
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	for _, tc := range []struct{ prefix, pattern, expected string }{
+		{"t[1]:", "user:?", `t\[1\]:user:?`},
+		{"a*b?:", "[abc]", `a\*b\?:[abc]`},
+		{"\xff\x00:", "k\xfe*", "\xff\x00:k\xfe*"},
+		{"t[1]:", `t\[1\]:user:*`, `t\[1\]:user:*`},
+	} {
+		proxy.setPrefix(conn, tc.prefix)
+		out, _ := proxy.processClientCommand(conn, encodeCommand("SCAN", "0", "MATCH", tc.pattern))
+		if expected := encodeCommand("SCAN", "0", "MATCH", tc.expected); !bytes.Equal(out, expected) {
+			t.Errorf("Prefix %q, pattern %q: expected %q, got %q", tc.prefix, tc.pattern, expected, out)
+		}
+		proxy.untrackCommand(conn)
+	}
+}
+
+func TestScanBareStarScopedToTenant(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		keys := []interface{}{}
+		for _, key := range []string{"tenant:a", "other:b", "tenant:sub:c"} {
+			if matched, _ := path.Match(args[3], key); matched {
+				keys = append(keys, key)
+			}
+		}
+		return (&RedisProxy{}).buildRESPArray([]interface{}{"0", keys})
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	reply := client.do(t, "SCAN", "0", "MATCH", "*")
+	expected := proxy.buildRESPArray([]interface{}{"0", []interface{}{"a", "sub:c"}})
+	if !bytes.Equal(reply, expected) {
+		t.Errorf("Expected only the tenant's keys, stripped, got %q", reply)
+	}
+	if got := strings.Join(backend.received()[0], " "); got != "SCAN 0 MATCH tenant:*" {
+		t.Errorf("Expected the bare star scoped to the tenant, got %q", got)
+	}
+}
+
+func TestCompressLargeValues(t *testing.T) {
+	var mu sync.Mutex
+	values := map[string]string{}
+	backend := newMockBackend(t, func(args []string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			values[args[1]] = args[2]
+			return []byte("+OK\r\n")
+		case "MGET":
+			var reply []interface{}
+			for _, key := range args[1:] {
+				reply = append(reply, values[key])
+			}
+			return (&RedisProxy{}).buildRESPArray(reply)
+		}
+		value := values[args[1]]
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.compressMin = 64
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	large := strings.Repeat("compressible ", 100)
+	client.do(t, "SET", "big", large)
+	client.do(t, "SET", "small", "tiny")
+
+	mu.Lock()
+	stored := values["tenant:big"]
+	if !strings.HasPrefix(stored, compressedValueMarker) || len(stored) >= len(large) {
+		t.Errorf("Expected the large value stored compressed, got %d bytes", len(stored))
+	}
+	if values["tenant:small"] != "tiny" {
+		t.Errorf("Expected the small value stored as is, got %q", values["tenant:small"])
+	}
+	mu.Unlock()
+
+	if reply := client.do(t, "GET", "big"); string(reply) != fmt.Sprintf("$%d\r\n%s\r\n", len(large), large) {
+		t.Errorf("Expected GET to return the original value, got %d bytes", len(reply))
+	}
+	expected := proxy.buildRESPArray([]interface{}{large, "tiny"})
+	if reply := client.do(t, "MGET", "big", "small"); !bytes.Equal(reply, expected) {
+		t.Errorf("Expected MGET to return the original values, got %d bytes", len(reply))
+	}
+
+	// Commands on the stored bytes would see or corrupt the gzip stream
+	for _, args := range [][]string{{"STRLEN", "big"}, {"append", "big", "more"}, {"GETRANGE", "big", "0", "4"}, {"SETRANGE", "big", "0", "x"}} {
+		expected := fmt.Sprintf("-ERR %s is not available while the proxy compresses values\r\n", strings.ToUpper(args[0]))
+		if reply := client.do(t, args...); string(reply) != expected {
+			t.Errorf("Expected %s to be refused, got %q", args[0], reply)
+		}
+	}
+	for _, cmd := range backend.received() {
+		if rawValueCommands[strings.ToUpper(cmd[0])] {
+			t.Errorf("Expected %s never to reach the backend", cmd[0])
+		}
+	}
+}
+
+func TestDebugSubcommandKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"DEBUG", "OBJECT", "key"}, []string{"DEBUG", "OBJECT", "tenant:key"})
+	assertRewrite(t, proxy, []string{"debug", "sdslen", "key"}, []string{"debug", "sdslen", "tenant:key"})
+	assertRewrite(t, proxy, []string{"DEBUG", "SET-ACTIVE-EXPIRE", "0"}, []string{"DEBUG", "SET-ACTIVE-EXPIRE", "0"})
+	assertRewrite(t, proxy, []string{"DEBUG", "JMAP"}, []string{"DEBUG", "JMAP"})
+}
+
+func TestClientFlagsPassThrough(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	for _, flag := range []string{"NO-EVICT", "no-touch"} {
+		if reply := client.do(t, "CLIENT", flag, "on"); string(reply) != "+OK\r\n" {
+			t.Errorf("Expected +OK for CLIENT %s, got %q", flag, reply)
+		}
+	}
+
+	received := backend.received()
+	if len(received) != 2 ||
+		strings.Join(received[0], " ") != "CLIENT NO-EVICT on" ||
+		strings.Join(received[1], " ") != "CLIENT no-touch on" {
+		t.Errorf("Expected the flag commands forwarded unchanged, got %q", received)
+	}
+}
+
+func TestKeyCountGauge(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) == "SCAN" {
+			return (&RedisProxy{}).buildRESPArray([]interface{}{"0", []interface{}{}})
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.keyCounts = newKeyCountCache(0)
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "AUTH", "alice", "secret")
+	for start := time.Now(); proxy.adminCommand("keycount alice:") != "0"; {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Expected alice: to be seeded, got %q", proxy.adminCommand("keycount alice:"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		client.do(t, "SET", key, "1", "NX")
+	}
+
+	var buf bytes.Buffer
+	proxy.writeMetrics(&buf)
+	for _, line := range []string{
+		"# TYPE redis_proxy_tenant_keys gauge",
+		`redis_proxy_tenant_keys{prefix="alice:"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestKeyCountEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newKeyCountCache(2)
+	for _, prefix := range []string{"a:", "b:"} {
+		cache.startSeeding(prefix)
+		cache.finishSeeding(prefix, 1, true)
+	}
+	cache.observe("a:", "SET NX", []byte("+OK\r\n"))
+	cache.startSeeding("c:")
+	cache.finishSeeding("c:", 5, true)
+
+	if got := cache.String(); got != "a:=2 c:=5" {
+		t.Errorf("Expected b: evicted as least recently used, got %s", got)
+	}
+	if !cache.startSeeding("b:") {
+		t.Error("Expected an evicted prefix to be seeded again")
+	}
+}
+
+func TestXReadBlockDetection(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		blocking bool
+	}{
+		{[]string{"XREAD", "BLOCK", "0", "STREAMS", "s", "$"}, true},
+		{[]string{"xread", "COUNT", "10", "block", "5000", "STREAMS", "s", "0"}, true},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "BLOCK", "100", "STREAMS", "s", ">"}, true},
+		{[]string{"XREAD", "STREAMS", "s", "0"}, false},
+		// A stream named BLOCK is not the option
+		{[]string{"XREAD", "STREAMS", "BLOCK", "0"}, false},
+		{[]string{"BLPOP", "q", "0"}, true},
+		{[]string{"GET", "k"}, false},
+	} {
+		if got := isBlockingCommand(strings.ToUpper(tc.args[0]), tc.args); got != tc.blocking {
+			t.Errorf("%q: expected blocking=%v, got %v", tc.args, tc.blocking, got)
+		}
+	}
+
+	backend := newMockBackend(t, func(args []string) []byte {
+		time.Sleep(300 * time.Millisecond)
+		return []byte("*-1\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.commandTimeout = 100 * time.Millisecond
+	addr := startTestProxy(t, proxy)
+
+	client := dialTestClient(t, addr)
+	if reply := client.do(t, "XREAD", "BLOCK", "0", "STREAMS", "s", "$"); string(reply) != "*-1\r\n" {
+		t.Errorf("Expected XREAD BLOCK to be exempt from the timeout, got %q", reply)
+	}
+	client = dialTestClient(t, addr)
+	if reply := client.do(t, "XREAD", "STREAMS", "s", "0"); string(reply) != "-ERR proxy: command timed out\r\n" {
+		t.Errorf("Expected a non-blocking XREAD to time out, got %q", reply)
+	}
+}
+
+func TestUnknownCommandPolicy(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+
+	for _, tc := range []struct {
+		policy    string
+		reply     string
+		forwarded bool
+		seen      string
+	}{
+		{unknownForward, "+OK\r\n", true, "(none)"},
+		{unknownReject, "-ERR unknown command 'frobnicate'\r\n", false, "(none)"},
+		{unknownLog, "+OK\r\n", true, "FROBNICATE=1"},
+	} {
+		before := len(backend.received())
+		proxy := newTestProxy(backend.addr())
+		proxy.unknownPolicy = tc.policy
+		client := dialTestClient(t, startTestProxy(t, proxy))
+
+		if reply := client.do(t, "frobnicate", "x"); string(reply) != tc.reply {
+			t.Errorf("%s: expected %q, got %q", tc.policy, tc.reply, reply)
+		}
+		// Commands from the tables are never affected
+		if reply := client.do(t, "GET", "k"); string(reply) != "+OK\r\n" {
+			t.Errorf("%s: expected GET to be forwarded, got %q", tc.policy, reply)
+		}
+
+		forwarded := false
+		for _, cmd := range backend.received()[before:] {
+			if cmd[0] == "frobnicate" {
+				forwarded = true
+			}
+		}
+		if forwarded != tc.forwarded {
+			t.Errorf("%s: expected forwarded=%v", tc.policy, tc.forwarded)
+		}
+		if got := proxy.adminCommand("unknown-commands"); got != tc.seen {
+			t.Errorf("%s: expected unknown-commands %q, got %q", tc.policy, tc.seen, got)
+		}
+	}
+
+	proxy := newTestProxy(backend.addr())
+	proxy.unknownPolicy = "drop"
+	if err := proxy.validateConfig(); err == nil || !strings.Contains(err.Error(), "REDIS_UNKNOWN_COMMAND") {
+		t.Errorf("Expected an invalid policy to be refused, got %v", err)
+	}
+}
+
+func TestBackendLossClosesClient(t *testing.T) {
+	// A backend that drops the connection after answering one command
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := (&RedisProxy{}).readRESP(bufio.NewReader(conn)); err == nil {
+				conn.Write([]byte("+OK\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+	proxy := newTestProxy(listener.Addr().String())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "SELECT", "2"); string(reply) != "+OK\r\n" {
+		t.Fatalf("Expected +OK for SELECT, got %q", reply)
+	}
+	// The proxy never dials a fresh backend behind the client's back, where the
+	// selected database and AUTH would be lost; the client sees the connection end
+	client.conn.Write(encodeCommand("GET", "k"))
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the client connection to be closed, got %v", err)
+	}
+}
+
+func TestMultiMemberLookups(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"SMISMEMBER", "myset", "a", "b", "c"}, []string{"SMISMEMBER", "tenant:myset", "a", "b", "c"})
+	assertRewrite(t, proxy, []string{"ZMSCORE", "myzset", "x", "y"}, []string{"ZMSCORE", "tenant:myzset", "x", "y"})
+}
+
+func TestKeyPlusValuesCommands(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	// One key followed by values or members, none of which are keys
+	assertRewrite(t, proxy, []string{"LPUSH", "list", "v1", "v2", "v3"}, []string{"LPUSH", "tenant:list", "v1", "v2", "v3"})
+	assertRewrite(t, proxy, []string{"RPUSH", "list", "v1", "v2", "v3"}, []string{"RPUSH", "tenant:list", "v1", "v2", "v3"})
+	assertRewrite(t, proxy, []string{"SADD", "set", "a", "b", "c"}, []string{"SADD", "tenant:set", "a", "b", "c"})
+	assertRewrite(t, proxy, []string{"ZADD", "zset", "NX", "1", "a", "2", "b"}, []string{"ZADD", "tenant:zset", "NX", "1", "a", "2", "b"})
+
+	// Several keys, each followed by its value
+	assertRewrite(t, proxy, []string{"MSET", "k1", "v1", "k2", "v2"}, []string{"MSET", "tenant:k1", "v1", "tenant:k2", "v2"})
+	assertRewrite(t, proxy, []string{"MSETNX", "k1", "v1", "k2", "v2"}, []string{"MSETNX", "tenant:k1", "v1", "tenant:k2", "v2"})
+}
+
+func TestTypeCache(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "TYPE":
+			return []byte("+string\r\n")
+		case "OBJECT":
+			return bulkString("embstr")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.typeCacheTTL = time.Minute
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	lookups := func() (types, encodings int) {
+		for _, cmd := range backend.received() {
+			switch cmd[0] {
+			case "TYPE":
+				types++
+			case "OBJECT":
+				encodings++
+			}
+		}
+		return types, encodings
+	}
+
+	for i := 0; i < 3; i++ {
+		if reply := client.do(t, "TYPE", "k"); string(reply) != "+string\r\n" {
+			t.Fatalf("Expected TYPE reply, got %q", reply)
+		}
+		if reply := client.do(t, "OBJECT", "ENCODING", "k"); string(reply) != string(bulkString("embstr")) {
+			t.Fatalf("Expected OBJECT ENCODING reply, got %q", reply)
+		}
+	}
+	if types, encodings := lookups(); types != 1 || encodings != 1 {
+		t.Errorf("Expected repeated lookups to hit the cache, backend saw %d TYPE and %d OBJECT", types, encodings)
+	}
+
+	// A write to the key drops its entries, other keys keep theirs
+	client.do(t, "TYPE", "other")
+	client.do(t, "SET", "k", "v")
+	client.do(t, "TYPE", "k")
+	client.do(t, "OBJECT", "ENCODING", "k")
+	client.do(t, "TYPE", "other")
+	if types, encodings := lookups(); types != 3 || encodings != 2 {
+		t.Errorf("Expected SET to invalidate only k, backend saw %d TYPE and %d OBJECT", types, encodings)
+	}
+
+	// Inside MULTI the server queues the lookup, so it is never answered locally
+	client.do(t, "MULTI")
+	client.do(t, "TYPE", "k")
+	client.do(t, "EXEC")
+	if types, _ := lookups(); types != 4 {
+		t.Errorf("Expected TYPE inside MULTI to reach the backend, backend saw %d TYPE", types)
+	}
+}
+
+func TestMultiKeyExists(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte(":2\r\n") })
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "EXISTS", "k1", "k2", "k3"); string(reply) != ":2\r\n" {
+		t.Errorf("Expected the integer reply unchanged, got %q", reply)
+	}
+	received := backend.received()
+	if len(received) != 1 || strings.Join(received[0], " ") != "EXISTS tenant:k1 tenant:k2 tenant:k3" {
+		t.Errorf("Expected every key prefixed, got %q", received)
+	}
+
+	for _, command := range []string{"DEL", "UNLINK", "TOUCH", "WATCH"} {
+		assertRewrite(t, proxy, []string{command, "a", "b"}, []string{command, "tenant:a", "tenant:b"})
+	}
+}
+
+func TestDeniedCommandsCounter(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+OK\r\n") })
+	proxy := newTestProxy(backend.addr())
+	proxy.allowCommands = parseCommandList("GET,FLUSHDB,CLIENT")
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	client.do(t, "flushdb")
+	client.do(t, "flushdb")
+	client.do(t, "CLIENT", "PAUSE", "100")
+	client.do(t, "SET", "k", "v")
+	client.do(t, "GET", "k")
+
+	var buf bytes.Buffer
+	proxy.writeMetrics(&buf)
+	for _, line := range []string{
+		`redis_proxy_denied_commands_total{prefix="tenant:",reason="acl"} 1`,
+		`redis_proxy_denied_commands_total{prefix="tenant:",reason="blocked"} 2`,
+		`redis_proxy_denied_commands_total{prefix="tenant:",reason="whitelist"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	// Only the most recently denied prefixes are kept
+	denied := newDeniedCounter(2)
+	denied.observe("a:", denyBlocked)
+	denied.observe("b:", denyBlocked)
+	denied.observe("a:", denyLimit)
+	denied.observe("c:", denyWhitelist)
+	if _, ok := denied.counts["b:"]; ok || len(denied.counts) != 2 {
+		t.Errorf("Expected b: to be dropped for c:, got %v", denied.counts)
+	}
+}
+
+func TestRequireAuthRejectsEarlyCommands(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte { return []byte("+OK\r\n") })
+	proxy := newTestProxy(backend.addr())
+	proxy.requireAuth = true
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Pipelined before AUTH: each command is refused, the connection stays open
+	client.conn.Write(append(encodeCommand("GET", "k"), encodeCommand("SET", "k", "v")...))
+	for i := 0; i < 2; i++ {
+		if reply := client.readReply(t); string(reply) != "-NOAUTH Authentication required.\r\n" {
+			t.Errorf("Expected NOAUTH before AUTH, got %q", reply)
+		}
+	}
+
+	if reply := client.do(t, "AUTH", "alice", "secret"); string(reply) != "+OK\r\n" {
+		t.Fatalf("Expected AUTH to be accepted, got %q", reply)
+	}
+	if reply := client.do(t, "GET", "k"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected GET to be forwarded after AUTH, got %q", reply)
+	}
+
+	received := backend.received()
+	if len(received) != 2 || received[0][0] != "AUTH" || strings.Join(received[1], " ") != "GET alice:k" {
+		t.Errorf("Expected only AUTH and the prefixed GET at the backend, got %q", received)
+	}
+}
+
+func TestRequireAuthFailedAuth(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) == "AUTH" && args[2] != "secret" {
+			return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.requireAuth = true
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// Inline commands can't be checked, so they are refused like any other
+	client.conn.Write([]byte("GET k\r\n"))
+	if reply := client.readReply(t); string(reply) != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("Expected NOAUTH for an inline command, got %q", reply)
+	}
+
+	// An AUTH the backend rejects leaves the connection unauthenticated
+	if reply := client.do(t, "AUTH", "alice", "wrong"); !strings.HasPrefix(string(reply), "-WRONGPASS") {
+		t.Fatalf("Expected the backend to reject AUTH, got %q", reply)
+	}
+	if reply := client.do(t, "GET", "k"); string(reply) != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("Expected NOAUTH after a failed AUTH, got %q", reply)
+	}
+
+	// A command pipelined behind a good AUTH waits for its reply
+	client.conn.Write(append(encodeCommand("AUTH", "alice", "secret"), encodeCommand("GET", "k")...))
+	for _, expected := range []string{"+OK\r\n", "+OK\r\n"} {
+		if reply := client.readReply(t); string(reply) != expected {
+			t.Errorf("Expected %q after a pipelined AUTH, got %q", expected, reply)
+		}
+	}
+
+	received := backend.received()
+	if len(received) != 3 || received[0][0] != "AUTH" || received[1][0] != "AUTH" || strings.Join(received[2], " ") != "GET alice:k" {
+		t.Errorf("Expected only the two AUTHs and the prefixed GET at the backend, got %q", received)
+	}
+}
+
+func TestFailedAuthKeepsPrefix(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) == "AUTH" && args[2] != "secret" {
+			return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "AUTH", "bob", "secret"); string(reply) != "+OK\r\n" {
+		t.Fatalf("Expected AUTH to be accepted, got %q", reply)
+	}
+	// Neither a second AUTH the backend rejects nor a command pipelined behind
+	// it moves the connection to alice's keys
+	client.conn.Write(append(encodeCommand("AUTH", "alice", "wrong"), encodeCommand("GET", "k")...))
+	if reply := client.readReply(t); !strings.HasPrefix(string(reply), "-WRONGPASS") {
+		t.Fatalf("Expected the backend to reject AUTH, got %q", reply)
+	}
+	client.readReply(t)
+	client.do(t, "SET", "k", "v")
+
+	received := backend.received()
+	var keys []string
+	for _, args := range received[2:] {
+		keys = append(keys, args[1])
+	}
+	if strings.Join(keys, " ") != "bob:k bob:k" {
+		t.Errorf("Expected the commands after the failed AUTH to stay on bob's keys, got %q", received)
+	}
+	proxy.connMux.RLock()
+	defer proxy.connMux.RUnlock()
+	for _, state := range proxy.conns {
+		if !bytes.Equal(state.auth, encodeCommand("AUTH", "bob", "secret")) {
+			t.Errorf("Expected bob's AUTH kept for key scans, got %q", state.auth)
+		}
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	hello := "%2\r\n+server\r\n$5\r\nredis\r\n+proto\r\n:3\r\n"
+	backend := newMockBackend(t, func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			if len(args) < 5 || args[4] != "secret" {
+				return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			}
+			return []byte(hello)
+		case "GET":
+			// Client-side caching invalidations arrive in band under RESP3
+			return []byte(">2\r\n$10\r\ninvalidate\r\n*2\r\n$7\r\nalice:k\r\n$5\r\nbob:k\r\n_\r\n")
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.requireAuth = true
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "HELLO", "3"); string(reply) != "-NOAUTH Authentication required.\r\n" {
+		t.Errorf("Expected NOAUTH for a HELLO without AUTH, got %q", reply)
+	}
+	if reply := client.do(t, "HELLO", "3", "AUTH", "alice", "wrong"); !strings.HasPrefix(string(reply), "-WRONGPASS") {
+		t.Errorf("Expected the backend to reject the credentials, got %q", reply)
+	}
+	if reply := client.do(t, "HELLO", "3", "AUTH", "alice", "secret", "SETNAME", "app"); string(reply) != hello {
+		t.Fatalf("Expected the HELLO reply passed through, got %q", reply)
+	}
+
+	// The push goes out on its own with only alice's keys, then the reply
+	client.conn.Write(encodeCommand("GET", "k"))
+	expected := ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n"
+	if reply := client.readReply(t); string(reply) != expected {
+		t.Errorf("Expected the invalidation %q, got %q", expected, reply)
+	}
+	if reply := client.readReply(t); string(reply) != "_\r\n" {
+		t.Errorf("Expected the RESP3 null reply, got %q", reply)
+	}
+
+	received := backend.received()
+	if got := strings.Join(received[len(received)-1], " "); got != "GET alice:k" {
+		t.Errorf("Expected GET alice:k at the backend, got %q", got)
+	}
+	proxy.connMux.RLock()
+	defer proxy.connMux.RUnlock()
+	for _, state := range proxy.conns {
+		if !bytes.Equal(state.auth, encodeCommand("AUTH", "alice", "secret")) {
+			t.Errorf("Expected the credentials kept as an AUTH for key scans, got %q", state.auth)
+		}
+	}
+}
+
+func TestIntegerArgumentsCoerced(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	proxy.setPrefix(conn, "tenant:")
+
+	tests := []struct {
+		raw      string
+		expected []byte
+	}{
+		// An integer where a key is expected is prefixed as its string form
+		{"*2\r\n$4\r\nINCR\r\n:5\r\n", encodeCommand("INCR", "tenant:5")},
+		{"*3\r\n$6\r\nEXPIRE\r\n:-12\r\n:60\r\n", encodeCommand("EXPIRE", "tenant:-12", "60")},
+		// Commands without keys still reach Redis as bulk strings only
+		{"*2\r\n$4\r\nECHO\r\n:42\r\n", encodeCommand("ECHO", "42")},
+	}
+	for _, tt := range tests {
+		out, reply := proxy.processClientCommand(conn, []byte(tt.raw))
+		if reply || !bytes.Equal(out, tt.expected) {
+			t.Errorf("processClientCommand(%q) = %q, expected %q", tt.raw, out, tt.expected)
+		}
+	}
+}
+
+func TestLogOutputTargets(t *testing.T) {
+	path := t.TempDir() + "/proxy.log"
+	out, err := openLogOutput(logToFile, path, "", "")
+	if err != nil {
+		t.Fatalf("Failed to open the log file: %v", err)
+	}
+	log.New(out, "", 0).Printf("hello file")
+	out.(io.Closer).Close()
+	if raw, _ := os.ReadFile(path); string(raw) != "hello file\n" {
+		t.Errorf("Expected the log line in the file, got %q", raw)
+	}
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	out, err = openLogOutput(logToSyslog, "", collector.LocalAddr().String(), "local3")
+	if err != nil {
+		t.Fatalf("Failed to open syslog: %v", err)
+	}
+	defer out.(io.Closer).Close()
+	log.New(out, "", 0).Printf("hello syslog")
+	buf := make([]byte, 1024)
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	// local3 (19) * 8 + info (6)
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "<158>") || !strings.Contains(string(buf[:n]), "redis-proxy") ||
+		!strings.Contains(string(buf[:n]), "hello syslog") {
+		t.Errorf("Expected the log line at the syslog collector, got %q (%v)", buf[:n], err)
+	}
+
+	for _, tc := range []struct{ target, facility string }{{"journald", ""}, {logToFile, ""}, {logToSyslog, "kern2"}} {
+		if _, err := openLogOutput(tc.target, "", "", tc.facility); err == nil {
+			t.Errorf("Expected %s (facility %q) to be refused", tc.target, tc.facility)
+		}
+	}
+}
+
+func TestSortPatterns(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy,
+		[]string{"SORT", "mylist", "BY", "w:*->score", "GET", "d:*->name"},
+		[]string{"SORT", "tenant:mylist", "BY", "tenant:w:*->score", "GET", "tenant:d:*->name"})
+	assertRewrite(t, proxy,
+		[]string{"SORT", "mylist", "LIMIT", "0", "10", "GET", "#", "GET", "d:*", "ALPHA", "STORE", "dest"},
+		[]string{"SORT", "tenant:mylist", "LIMIT", "0", "10", "GET", "#", "GET", "tenant:d:*", "ALPHA", "STORE", "tenant:dest"})
+	assertRewrite(t, proxy,
+		[]string{"SORT_RO", "mylist", "BY", "nosort"},
+		[]string{"SORT_RO", "tenant:mylist", "BY", "tenant:nosort"})
+
+	// Only the key part of a pattern reaches a KeyRewriter
+	proxy.KeyRewriter = func(command, key string) string { return "h(" + key + ")" }
+	assertRewrite(t, proxy,
+		[]string{"SORT", "mylist", "BY", "w:*->score", "GET", "d:*->name"},
+		[]string{"SORT", "h(mylist)", "BY", "h(w:*)->score", "GET", "h(d:*)->name"})
+}
+
+func TestKeyRewriterHook(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	var seen []string
+	proxy.KeyRewriter = func(command, key string) string {
+		seen = append(seen, command)
+		return strings.ToUpper(key)
+	}
+
+	assertRewrite(t, proxy, []string{"SET", "user:1", "value"}, []string{"SET", "USER:1", "value"})
+	assertRewrite(t, proxy, []string{"mget", "a", "b"}, []string{"mget", "A", "B"})
+	assertRewrite(t, proxy, []string{"EVAL", "return 1", "1", "k", "arg"}, []string{"EVAL", "return 1", "1", "K", "arg"})
+	assertRewrite(t, proxy, []string{"HSET", "h", "field", "value"}, []string{"HSET", "H", "field", "value"})
+	if strings.Join(seen, " ") != "SET MGET MGET EVAL HSET" {
+		t.Errorf("Expected the rewriter to see upper-case command names, got %q", seen)
+	}
+
+	// Channels keep the plain prefix that confirmations and messages are stripped of
+	seen = nil
+	assertRewrite(t, proxy, []string{"SUBSCRIBE", "news", "alerts"}, []string{"SUBSCRIBE", "tenant:news", "tenant:alerts"})
+	assertRewrite(t, proxy, []string{"PSUBSCRIBE", "news.*"}, []string{"PSUBSCRIBE", "tenant:news.*"})
+	assertRewrite(t, proxy, []string{"PUBLISH", "news", "hello"}, []string{"PUBLISH", "tenant:news", "hello"})
+	if len(seen) != 0 {
+		t.Errorf("Expected the rewriter never to see channels, got %q", seen)
+	}
+
+	proxy.KeyRewriter = nil
+	assertRewrite(t, proxy, []string{"SET", "user:1", "value"}, []string{"SET", "tenant:user:1", "value"})
+}
+
+func TestAttributeBeforeReply(t *testing.T) {
+	attr := "|1\r\n+key-popularity\r\n*2\r\n$8\r\ntenant:a\r\n:7\r\n"
+	scanReply := "*2\r\n$1\r\n0\r\n*2\r\n$8\r\ntenant:a\r\n$7\r\nother:b\r\n"
+
+	decoded, err := RESPCodec{}.Decode(bufio.NewReader(strings.NewReader(attr + scanReply + "+OK\r\n")))
+	if err != nil || string(decoded) != attr+scanReply {
+		t.Fatalf("Expected the attribute decoded with its reply, got %q (%v)", decoded, err)
+	}
+
+	backend := newMockBackend(t, func(args []string) []byte { return []byte(attr + scanReply) })
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	// The attribute is forwarded untouched and the SCAN reply after it filtered
+	expected := attr + "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n"
+	if reply := client.do(t, "SCAN", "0"); string(reply) != expected {
+		t.Errorf("Expected %q, got %q", expected, reply)
+	}
+}
+
+func TestStreamReplyAfterCleanup(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+	client := newScriptedConn(nil)
+
+	// The connection's state is gone, as after cleanup racing canStreamReply
+	reply := "*2\r\n$1\r\na\r\n$1\r\nb\r\n"
+	if err := proxy.streamReply(client, newScriptedConn(nil), bufio.NewReader(strings.NewReader(reply))); err != nil {
+		t.Fatalf("Expected the reply to be streamed, got %v", err)
+	}
+	if got := string(client.written()); got != reply {
+		t.Errorf("Expected %q passed through, got %q", reply, got)
+	}
+}
+
+func TestStreamMatchesDecode(t *testing.T) {
+	codec := RESPCodec{}
+	for _, raw := range []string{
+		"*3\r\n$1\r\na\r\n:5\r\n*2\r\n+ok\r\n$-1\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"$5\r\nhello\r\n",
+		"-ERR nope\r\n",
+		"%2\r\n+server\r\n$5\r\nredis\r\n+proto\r\n:3\r\n",
+		"~2\r\n#t\r\n_\r\n",
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n",
+		",3.14\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"=8\r\ntxt:some\r\n",
+		"!9\r\nERR nope!\r\n",
+	} {
+		var streamed bytes.Buffer
+		if err := codec.Stream(bufio.NewReader(strings.NewReader(raw)), &streamed); err != nil {
+			t.Errorf("%q: unexpected error %v", raw, err)
+			continue
+		}
+		decoded, _ := codec.Decode(bufio.NewReader(strings.NewReader(raw)))
+		if streamed.String() != raw || !bytes.Equal(streamed.Bytes(), decoded) {
+			t.Errorf("%q: streamed %q, decoded %q", raw, streamed.Bytes(), decoded)
+		}
+	}
+	if err := codec.Stream(bufio.NewReader(strings.NewReader("*x\r\n")), io.Discard); err == nil || err.Error() != "Protocol error: invalid multibulk length" {
+		t.Errorf("Expected an invalid multibulk length, got %v", err)
+	}
+}
+
+func TestLargeReplyStreamedUnchanged(t *testing.T) {
+	elements := make([]interface{}, 10000)
+	for i := range elements {
+		elements[i] = fmt.Sprintf("tenant:element-%d", i)
+	}
+	reply := (&RedisProxy{}).buildRESPArray(elements)
+	backend := newMockBackend(t, func(args []string) []byte {
+		if strings.ToUpper(args[0]) == "LRANGE" {
+			return reply
+		}
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if got := client.do(t, "LRANGE", "list", "0", "-1"); !bytes.Equal(got, reply) {
+		t.Errorf("Expected the %d byte reply unchanged, got %d bytes", len(reply), len(got))
+	}
+	// The connection stays in sync after a streamed reply
+	if got := client.do(t, "SET", "k", "v"); string(got) != "+OK\r\n" {
+		t.Errorf("Expected +OK after the streamed reply, got %q", got)
+	}
+}
+
+func BenchmarkLargeLRANGEReply(b *testing.B) {
+	elements := make([]interface{}, 10000)
+	for i := range elements {
+		elements[i] = strings.Repeat("x", 64)
+	}
+	reply := (&RedisProxy{}).buildRESPArray(elements)
+	backend := newMockBackend(b, func(args []string) []byte {
+		return reply
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.logger.SetOutput(io.Discard)
+	client := dialTestClient(b, startTestProxy(b, proxy))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(reply)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.do(b, "LRANGE", "list", "0", "-1")
+	}
+}
+
+func TestTypeEndToEnd(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		if args[1] == "tenant:present" {
+			return []byte("+string\r\n")
+		}
+		return []byte("+none\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	if reply := client.do(t, "TYPE", "present"); string(reply) != "+string\r\n" {
+		t.Errorf("Expected +string, got %q", reply)
+	}
+	if reply := client.do(t, "TYPE", "missing"); string(reply) != "+none\r\n" {
+		t.Errorf("Expected +none, got %q", reply)
+	}
+	received := backend.received()
+	if len(received) != 2 || strings.Join(received[0], " ") != "TYPE tenant:present" || strings.Join(received[1], " ") != "TYPE tenant:missing" {
+		t.Errorf("Expected both keys prefixed, got %q", received)
+	}
+}
+
+func TestGlobalSentinelSkipsPrefix(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	// Disabled by default, so the sentinel is just part of the key
+	assertRewrite(t, proxy, []string{"GET", "{global}config"}, []string{"GET", "tenant:{global}config"})
+
+	proxy.globalSentinel = "{global}"
+	assertRewrite(t, proxy, []string{"GET", "{global}config"}, []string{"GET", "config"})
+	assertRewrite(t, proxy, []string{"GET", "mykey"}, []string{"GET", "tenant:mykey"})
+	assertRewrite(t, proxy, []string{"MGET", "{global}a", "b"}, []string{"MGET", "a", "tenant:b"})
+	// Only a leading sentinel counts, and values are never touched
+	assertRewrite(t, proxy, []string{"SET", "x{global}", "{global}v"}, []string{"SET", "tenant:x{global}", "{global}v"})
+}
+
+func TestGeoRadiusStoreKeys(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"GEORADIUSBYMEMBER", "geo:k", "member1", "100", "m", "STORE", "out"},
+		[]string{"GEORADIUSBYMEMBER", "tenant:geo:k", "member1", "100", "m", "STORE", "tenant:out"})
+	assertRewrite(t, proxy, []string{"GEORADIUS", "geo:k", "15", "37", "200", "km", "ASC", "storedist", "near"},
+		[]string{"GEORADIUS", "tenant:geo:k", "15", "37", "200", "km", "ASC", "storedist", "tenant:near"})
+	// A member named STORE is not an option
+	assertRewrite(t, proxy, []string{"GEORADIUSBYMEMBER", "geo:k", "STORE", "5", "km", "WITHDIST"},
+		[]string{"GEORADIUSBYMEMBER", "tenant:geo:k", "STORE", "5", "km", "WITHDIST"})
+}
+
+// captureRedisCLI runs redis-cli with args against a local listener and returns
+// the raw bytes of the last command it sent
+func captureRedisCLI(t *testing.T, args ...string) []byte {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sent := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			sent <- nil
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var last []byte
+		for {
+			data, err := (&RedisProxy{}).readRESP(reader)
+			if err != nil {
+				sent <- last
+				return
+			}
+			last = data
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	cmd := exec.Command("redis-cli", append([]string{"--no-raw", "-h", host, "-p", port}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("redis-cli %q failed: %v\n%s", args, err, out)
+	}
+	select {
+	case data := <-sent:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatalf("redis-cli %q sent nothing", args)
+		return nil
+	}
+}
+
+func TestRedisCLIWireFormat(t *testing.T) {
+	if _, err := exec.LookPath("redis-cli"); err != nil {
+		t.Skip("redis-cli is not installed")
+	}
+	proxy := newTestProxy("127.0.0.1:6379")
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	proxy.setPrefix(conn, "tenant:")
+
+	// The rewritten command must be byte for byte what redis-cli itself sends
+	// for the prefixed command
+	for _, tc := range []struct{ args, prefixed []string }{
+		{[]string{"GET", "k"}, []string{"GET", "tenant:k"}},
+		{[]string{"SET", "key with spaces", ""}, []string{"SET", "tenant:key with spaces", ""}},
+		{[]string{"HSET", "h", "field", "value"}, []string{"HSET", "tenant:h", "field", "value"}},
+		{[]string{"MGET", "a", "\u043a\u043b\u044e\u0447"}, []string{"MGET", "tenant:a", "tenant:\u043a\u043b\u044e\u0447"}},
+		{[]string{"EVAL", "return 1", "1", "k", "arg"}, []string{"EVAL", "return 1", "1", "tenant:k", "arg"}},
+		{[]string{"ZINTERSTORE", "out", "2", "a", "b"}, []string{"ZINTERSTORE", "tenant:out", "2", "tenant:a", "tenant:b"}},
+	} {
+		out, reply := proxy.processClientCommand(conn, captureRedisCLI(t, tc.args...))
+		if reply {
+			t.Fatalf("%q: expected the command to be forwarded, got reply %q", tc.args, out)
+		}
+		if expected := captureRedisCLI(t, tc.prefixed...); !bytes.Equal(out, expected) {
+			t.Errorf("%q: expected %q, got %q", tc.args, expected, out)
+		}
+	}
+}
+
+func TestClientPauseAdminOnly(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	proxy.adminTenants = parsePrefixList("ops")
+	addr := startTestProxy(t, proxy)
+
+	tenant := dialTestClient(t, addr)
+	tenant.do(t, "AUTH", "alice", "secret")
+	if reply := tenant.do(t, "CLIENT", "PAUSE", "1000"); string(reply) != "-ERR CLIENT PAUSE is reserved for admin tenants\r\n" {
+		t.Errorf("Expected CLIENT PAUSE to be rejected for a tenant, got %q", reply)
+	}
+	if reply := tenant.do(t, "client", "unpause"); string(reply) != "-ERR CLIENT UNPAUSE is reserved for admin tenants\r\n" {
+		t.Errorf("Expected CLIENT UNPAUSE to be rejected for a tenant, got %q", reply)
+	}
+
+	admin := dialTestClient(t, addr)
+	admin.do(t, "AUTH", "ops", "secret")
+	if reply := admin.do(t, "CLIENT", "PAUSE", "1000"); string(reply) != "+OK\r\n" {
+		t.Errorf("Expected CLIENT PAUSE to be forwarded for the admin tenant, got %q", reply)
+	}
+
+	var pauses int
+	for _, cmd := range backend.received() {
+		if strings.ToUpper(cmd[0]) == "CLIENT" {
+			pauses++
+		}
+	}
+	if pauses != 1 {
+		t.Errorf("Expected only the admin's CLIENT PAUSE on the backend, got %d", pauses)
+	}
+}
+
+func TestScanFilterCounters(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		keys := []interface{}{"tenant:a", "other:b", "tenant:c", "other:d"}
+		return (&RedisProxy{}).buildRESPArray([]interface{}{"0", keys})
+	})
+	proxy := newTestProxy(backend.addr())
+	addr := startTestProxy(t, proxy)
+	client := dialTestClient(t, addr)
+	idle := dialTestClient(t, addr)
+	idle.do(t, "SCAN", "0")
+
+	client.do(t, "SCAN", "0")
+	client.do(t, "SCAN", "0", "COUNT", "100")
+	if got := proxy.adminCommand("scan-filter " + client.conn.LocalAddr().String()); got != "returned=8 kept=4 filtered=0.500" {
+		t.Errorf("Unexpected per-connection counts %q", got)
+	}
+	if got := proxy.adminCommand("scan-filter"); got != "returned=12 kept=6 filtered=0.500" {
+		t.Errorf("Unexpected proxy-wide counts %q", got)
+	}
+	if got := proxy.adminCommand("scan-filter 10.0.0.1:1"); !strings.HasPrefix(got, "ERR") {
+		t.Errorf("Expected an error for an unknown connection, got %q", got)
+	}
+
+	var buf bytes.Buffer
+	proxy.writeMetrics(&buf)
+	for _, line := range []string{"redis_proxy_scan_keys_returned_total 12", "redis_proxy_scan_keys_kept_total 6"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestInfoLevelSkipsCommandLines(t *testing.T) {
+	var buf bytes.Buffer
+	proxy := newTestProxy("127.0.0.1:6379")
+	proxy.logger = log.New(&buf, "", 0)
+	proxy.logLevel = logLevelInfo
+	rewriteCommand(t, proxy, "GET", "k")
+	if strings.Contains(buf.String(), "Processing client command") {
+		t.Errorf("Expected no per-command lines at info level, got:\n%s", buf.String())
+	}
+
+	proxy.logLevel = logLevelDebug
+	rewriteCommand(t, proxy, "GET", "k")
+	if !strings.Contains(buf.String(), "Processing client command") {
+		t.Errorf("Expected per-command lines at debug level, got:\n%s", buf.String())
+	}
+}
+
+func TestSilentLevelDropsConnectionLines(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	for _, level := range []string{logLevelInfo, logLevelSilent} {
+		proxy := newTestProxy(backend.addr())
+		proxy.logLevel = level
+		logs := captureLogs(t, proxy)
+		client := dialTestClient(t, startTestProxy(t, proxy))
+		client.do(t, "PING")
+
+		logged := strings.Contains(logs.String(), "New connection")
+		if logged != (level != logLevelSilent) {
+			t.Errorf("Level %s: expected connection lines logged=%v, got:\n%s", level, !logged, logs.String())
+		}
+	}
+}
+
+func BenchmarkLogLevels(b *testing.B) {
+	backend := newMockBackend(b, func(args []string) []byte {
+		return []byte("$1\r\nv\r\n")
+	})
+	for _, level := range []string{logLevelDebug, logLevelSilent} {
+		b.Run(level, func(b *testing.B) {
+			proxy := newTestProxy(backend.addr())
+			proxy.logLevel = level
+			proxy.logger.SetOutput(io.Discard)
+			client := dialTestClient(b, startTestProxy(b, proxy))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.do(b, "GET", "k")
+			}
+		})
+	}
+}
+
+func TestStreamAdminCommands(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"XSETID", "mystream", "5-0"}, []string{"XSETID", "tenant:mystream", "5-0"})
+	assertRewrite(t, proxy, []string{"XAUTOCLAIM", "mystream", "g", "c", "0", "0"}, []string{"XAUTOCLAIM", "tenant:mystream", "g", "c", "0", "0"})
+	assertRewrite(t, proxy, []string{"XAUTOCLAIM", "mystream", "g", "c", "3600000", "0-0", "COUNT", "25", "JUSTID"},
+		[]string{"XAUTOCLAIM", "tenant:mystream", "g", "c", "3600000", "0-0", "COUNT", "25", "JUSTID"})
+}
+
+func TestXAddOptionsUntouched(t *testing.T) {
+	proxy := newTestProxy("127.0.0.1:6379")
+
+	assertRewrite(t, proxy, []string{"XADD", "s", "NOMKSTREAM", "MAXLEN", "~", "1000", "*", "f", "v"},
+		[]string{"XADD", "tenant:s", "NOMKSTREAM", "MAXLEN", "~", "1000", "*", "f", "v"})
+	assertRewrite(t, proxy, []string{"XADD", "s", "MINID", "=", "0-1", "LIMIT", "10", "5-0", "s", "tenant:x"},
+		[]string{"XADD", "tenant:s", "MINID", "=", "0-1", "LIMIT", "10", "5-0", "s", "tenant:x"})
+}
+
+func TestProxyVersionCommand(t *testing.T) {
+	backend := newMockBackend(t, func(args []string) []byte {
+		return []byte("+OK\r\n")
+	})
+	proxy := newTestProxy(backend.addr())
+	client := dialTestClient(t, startTestProxy(t, proxy))
+
+	defer func(previous string) { version = previous }(version)
+	version = "1.2.3"
+	if reply := client.do(t, "PROXY", "version"); string(reply) != "$5\r\n1.2.3\r\n" {
+		t.Errorf("Expected the build version, got %q", reply)
+	}
+	if reply := client.do(t, "PROXY", "STATUS"); !strings.HasPrefix(string(reply), "-ERR unknown PROXY subcommand") {
+		t.Errorf("Expected an error for an unknown subcommand, got %q", reply)
+	}
+	if received := backend.received(); len(received) != 0 {
+		t.Errorf("Expected PROXY commands to stay in the proxy, backend got %q", received)
+	}
+}
@@ -18,7 +18,8 @@ fi
 
 # Build the proxy
 echo "Building Redis proxy..."
-go build -o redis-proxy main.go
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+go build -ldflags "-X main.version=$VERSION" -o redis-proxy main.go
 
 if [ $? -eq 0 ]; then
     echo "✅ Redis proxy built successfully!"
@@ -0,0 +1,307 @@
+// Package proxytest runs real client libraries against the proxy built from
+// the repository root, so framing issues the hand-written RESP tests miss show
+// up through the client's own encoder and decoder.
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// memoryBackend is a minimal Redis server keeping string keys in memory. It
+// accepts HELLO 3 with alice's credentials and then answers in RESP3, like a
+// Redis 6 server would.
+type memoryBackend struct {
+	listener net.Listener
+	mu       sync.Mutex
+	keys     map[string]string
+	hellos   int // HELLO 3 commands accepted
+}
+
+func startMemoryBackend(t *testing.T) *memoryBackend {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start backend: %v", err)
+	}
+	b := &memoryBackend{listener: listener, keys: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *memoryBackend) addr() string {
+	return b.listener.Addr().String()
+}
+
+// snapshot returns a copy of the stored keys and values
+func (b *memoryBackend) snapshot() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make(map[string]string, len(b.keys))
+	for k, v := range b.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
+// helloCount returns how many HELLO 3 commands were accepted
+func (b *memoryBackend) helloCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hellos
+}
+
+func (b *memoryBackend) set(key, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys[key] = value
+}
+
+func (b *memoryBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	resp3 := false
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(b.handle(args, &resp3)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a command; resp3 is the connection's protocol, which HELLO sets
+func (b *memoryBackend) handle(args []string, resp3 *bool) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		if len(args) < 2 || args[1] != "3" {
+			return []byte("-NOPROTO unsupported protocol version\r\n")
+		}
+		if len(args) < 5 || strings.ToUpper(args[2]) != "AUTH" || args[3] != "alice" || args[4] != "secret" {
+			return []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		}
+		*resp3 = true
+		b.hellos++
+		return []byte("%3\r\n" + string(bulk("server")) + string(bulk("redis")) +
+			string(bulk("version")) + string(bulk("7.2.0")) + string(bulk("proto")) + ":3\r\n")
+	case "PING":
+		return []byte("+PONG\r\n")
+	case "SET":
+		b.keys[args[1]] = args[2]
+		return []byte("+OK\r\n")
+	case "GET":
+		value, ok := b.keys[args[1]]
+		if !ok && *resp3 {
+			return []byte("_\r\n")
+		} else if !ok {
+			return []byte("$-1\r\n")
+		}
+		return bulk(value)
+	case "DEL":
+		removed := 0
+		for _, key := range args[1:] {
+			if _, ok := b.keys[key]; ok {
+				delete(b.keys, key)
+				removed++
+			}
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", removed))
+	case "SCAN":
+		// A single pass over every key, filtered by MATCH
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var matched []string
+		for key := range b.keys {
+			if ok, _ := path.Match(pattern, key); ok {
+				matched = append(matched, key)
+			}
+		}
+		sort.Strings(matched)
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", bulk("0"), len(matched))
+		for _, key := range matched {
+			reply += string(bulk(key))
+		}
+		return []byte(reply)
+	default:
+		// AUTH, CLIENT SETINFO and anything else the client sends on connect
+		return []byte("+OK\r\n")
+	}
+}
+
+func bulk(s string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+// readCommand reads one RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// startProxy builds the proxy from the repository root and runs it against
+// targetAddr, returning the address it listens on
+func startProxy(t *testing.T, targetAddr string) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not on the PATH")
+	}
+	bin := filepath.Join(t.TempDir(), "redis-proxy")
+	build := exec.Command("go", "build", "-o", bin, "main.go")
+	build.Dir = filepath.Join("..", "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build the proxy: %v\n%s", err, out)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy := exec.Command(bin)
+	proxy.Env = append(os.Environ(),
+		"REDIS_PROXY_ADDR="+addr,
+		"REDIS_TARGET_ADDR="+targetAddr,
+		"REDIS_LOG_LEVEL=silent",
+		"REDIS_REQUIRE_AUTH=true",
+	)
+	if err := proxy.Start(); err != nil {
+		t.Fatalf("Failed to start the proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		proxy.Process.Kill()
+		proxy.Wait()
+	})
+
+	for start := time.Now(); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Proxy never started listening: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGoRedisThroughProxy(t *testing.T) {
+	backend := startMemoryBackend(t)
+	backend.set("other:secret", "not yours")
+	ctx := context.Background()
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     startProxy(t, backend.addr()),
+		Username: "alice",
+		Password: "secret",
+	})
+	defer client.Close()
+
+	if err := client.Set(ctx, "greeting", "hello", 0).Err(); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if err := client.Set(ctx, "farewell", "bye", 0).Err(); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if got := backend.snapshot()["alice:greeting"]; got != "hello" {
+		t.Errorf("Expected the backend to store alice:greeting, keys are %v", backend.snapshot())
+	}
+
+	// go-redis connects with HELLO 3 AUTH, so every reply here is RESP3
+	if hellos := backend.helloCount(); hellos == 0 {
+		t.Error("Expected the client to authenticate with HELLO 3")
+	}
+	hello, err := client.Do(ctx, "HELLO", "3", "AUTH", "alice", "secret").Result()
+	if props, ok := hello.(map[interface{}]interface{}); err != nil || !ok || props["proto"] != int64(3) {
+		t.Errorf("Expected HELLO 3 to answer with the server properties, got %v, %v", hello, err)
+	}
+
+	value, err := client.Get(ctx, "greeting").Result()
+	if err != nil || value != "hello" {
+		t.Errorf("Expected GET to return hello, got %q, %v", value, err)
+	}
+	if _, err := client.Get(ctx, "missing").Result(); err != redis.Nil {
+		t.Errorf("Expected GET of a missing key to return redis.Nil, got %v", err)
+	}
+
+	keys, cursor, err := client.Scan(ctx, 0, "*", 100).Result()
+	if err != nil {
+		t.Fatalf("SCAN failed: %v", err)
+	}
+	sort.Strings(keys)
+	if cursor != 0 || strings.Join(keys, ",") != "farewell,greeting" {
+		t.Errorf("Expected SCAN to return only the tenant's unprefixed keys, got %v (cursor %d)", keys, cursor)
+	}
+
+	removed, err := client.Del(ctx, "greeting").Result()
+	if err != nil || removed != 1 {
+		t.Errorf("Expected DEL to remove one key, got %d, %v", removed, err)
+	}
+	if _, ok := backend.snapshot()["alice:greeting"]; ok {
+		t.Error("Expected alice:greeting to be deleted from the backend")
+	}
+	if backend.snapshot()["other:secret"] != "not yours" {
+		t.Error("Expected another tenant's key to be left alone")
+	}
+}